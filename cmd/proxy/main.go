@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -13,11 +14,12 @@ import (
 	"time"
 
 	"github.com/braw-dev/memex/internal/proxy"
+	"github.com/braw-dev/memex/internal/store"
 )
 
 func main() {
 	ctx := context.Background()
-	if err := run(ctx, os.Stdout, os.Args, os.Getenv); err != nil {
+	if err := run(ctx, os.Stdin, os.Stdout, os.Args, os.Getenv); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
@@ -25,6 +27,7 @@ func main() {
 
 func run(
 	ctx context.Context,
+	stdin io.Reader,
 	w io.Writer,
 	args []string,
 	getenv func(string) string,
@@ -36,12 +39,43 @@ func run(
 		return fmt.Errorf("failed to load config: %w", err)
 	}
 
+	if len(args) > 1 {
+		switch args[1] {
+		case "mcp-wrap":
+			return runMCPWrap(ctx, config, stdin, w, args[2:])
+		case "explain":
+			return runExplain(config, stdin, w, args[2:])
+		case "reencrypt":
+			return runReencrypt(config, w, getenv)
+		case "keys":
+			return runKeys(config, w, args[2:])
+		case "shadow-report":
+			return runShadowReport(config, w, args[2:])
+		case "stats":
+			return runStats(config, w, args[2:])
+		}
+	}
+	return serve(ctx, config, w)
+}
+
+// serve runs the HTTP proxy until it receives a signal or ctx is cancelled
+func serve(ctx context.Context, config *proxy.ProxyConfig, w io.Writer) error {
 	if err := setupLogger(config.Log); err != nil {
 		return fmt.Errorf("failed to setup logger: %w", err)
 	}
+	if err := proxy.CheckAuth(config); err != nil {
+		return err
+	}
+
+	// Open the cache and audit store
+	st, err := openStore(config)
+	if err != nil {
+		return fmt.Errorf("failed to open store: %w", err)
+	}
+	defer st.Close()
 
 	// Create handler using NewServer (returns http.Handler)
-	handler := proxy.NewServer(config)
+	handler := proxy.NewServer(config, proxy.WithStore(st))
 
 	// Initialize http.Server
 	srv := &http.Server{
@@ -86,6 +120,205 @@ func run(
 	return nil
 }
 
+// runMCPWrap relays a stdio MCP server started from args (after an optional "--")
+func runMCPWrap(ctx context.Context, config *proxy.ProxyConfig, stdin io.Reader, w io.Writer, args []string) error {
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("usage: memex mcp-wrap -- <cmd> [args...]")
+	}
+
+	// stdout carries JSON-RPC, so logs must never go there
+	if config.Log.Path == "stdout" {
+		config.Log.Path = "stderr"
+	}
+	if err := setupLogger(config.Log); err != nil {
+		return fmt.Errorf("failed to setup logger: %w", err)
+	}
+
+	// DuckDB allows a single process per database file; relay without caching when it is busy
+	st, err := openStore(config)
+	if err != nil {
+		slog.Warn("Store unavailable, MCP results will not be cached", "err", err)
+	} else {
+		defer st.Close()
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	return proxy.NewMCPWrapper(config, st, args).Run(ctx, stdin, w)
+}
+
+// openStore opens the store, encrypting cached responses when a key is configured
+func openStore(config *proxy.ProxyConfig) (*store.Store, error) {
+	st, err := store.NewStore(config.StorePath)
+	if err != nil {
+		return nil, err
+	}
+	if key := config.Cache.EncryptionKey; key != "" {
+		st.UseCipher(store.NewCipher(string(key)))
+	}
+	return st, nil
+}
+
+// runReencrypt rewrites stored blobs from the previous key (MEMEX_PREVIOUS_ENCRYPTION_KEY,
+// unset for plaintext) to the configured one (unset to decrypt)
+func runReencrypt(config *proxy.ProxyConfig, w io.Writer, getenv func(string) string) error {
+	st, err := store.NewStore(config.StorePath)
+	if err != nil {
+		return fmt.Errorf("failed to open store: %w", err)
+	}
+	defer st.Close()
+
+	var from, to *store.Cipher
+	if key := getenv("MEMEX_PREVIOUS_ENCRYPTION_KEY"); key != "" {
+		from = store.NewCipher(key)
+	}
+	if key := config.Cache.EncryptionKey; key != "" {
+		to = store.NewCipher(string(key))
+	}
+	n, err := st.Reencrypt(from, to, proxy.ScopeSalt)
+	if err != nil {
+		return fmt.Errorf("failed to re-encrypt store: %w", err)
+	}
+	fmt.Fprintf(w, "Re-encrypted %d blobs\n", n)
+	return nil
+}
+
+// runKeys manages virtual API keys while the proxy is stopped (the admin API serves
+// the same purpose while it runs)
+func runKeys(config *proxy.ProxyConfig, w io.Writer, args []string) error {
+	const usage = "usage: memex keys create <user> [name] | list | revoke <id>"
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	st, err := store.NewStore(config.StorePath)
+	if err != nil {
+		return fmt.Errorf("failed to open store: %w", err)
+	}
+	defer st.Close()
+
+	switch {
+	case args[0] == "create" && (len(args) == 2 || len(args) == 3):
+		name := ""
+		if len(args) == 3 {
+			name = args[2]
+		}
+		key, record, err := proxy.IssueVirtualKey(st, args[1], name)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Created key %s for %s. It will not be shown again:\n%s\n", record.KeyID, record.UserID, key)
+	case args[0] == "list" && len(args) == 1:
+		keys, err := st.ListVirtualKeys()
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			status := "active"
+			if k.RevokedAt != nil {
+				status = "revoked " + k.RevokedAt.Format(time.DateOnly)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", k.KeyID, k.UserID, k.Name, k.CreatedAt.Format(time.DateOnly), status)
+		}
+	case args[0] == "revoke" && len(args) == 2:
+		if err := st.RevokeVirtualKey(args[1]); err != nil {
+			return fmt.Errorf("failed to revoke %s: %w", args[1], err)
+		}
+		fmt.Fprintf(w, "Revoked key %s\n", args[1])
+	default:
+		return errors.New(usage)
+	}
+	return nil
+}
+
+// runShadowReport suggests a similarity threshold from the comparisons shadow mode
+// recorded, optionally only those of a recent period (e.g. "168h")
+func runShadowReport(config *proxy.ProxyConfig, w io.Writer, args []string) error {
+	since, err := parseSince(args)
+	if err != nil {
+		return errors.New("usage: memex shadow-report [period]")
+	}
+	st, err := store.NewStore(config.StorePath)
+	if err != nil {
+		return fmt.Errorf("failed to open store: %w", err)
+	}
+	defer st.Close()
+	return proxy.ShadowReport(config, st, since, w)
+}
+
+// runStats prints cache effectiveness and the outcome of sampled hit verification,
+// optionally for a recent period (e.g. "24h")
+func runStats(config *proxy.ProxyConfig, w io.Writer, args []string) error {
+	since, err := parseSince(args)
+	if err != nil {
+		return errors.New("usage: memex stats [period]")
+	}
+	st, err := store.NewStore(config.StorePath)
+	if err != nil {
+		return fmt.Errorf("failed to open store: %w", err)
+	}
+	defer st.Close()
+
+	stats, err := st.Stats(since)
+	if err != nil {
+		return fmt.Errorf("failed to read stats: %w", err)
+	}
+	hitRate := 0.0
+	if stats.Requests > 0 {
+		hitRate = float64(stats.Hits) / float64(stats.Requests) * 100
+	}
+	fmt.Fprintf(w, "Requests:       %d (%d cache hits, %.1f%%)\n", stats.Requests, stats.Hits, hitRate)
+	fmt.Fprintf(w, "Tokens saved:   %d\n", stats.TokensSaved)
+	fmt.Fprintf(w, "Cache entries:  %d\n", stats.Entries)
+	if stats.Verified == 0 {
+		fmt.Fprintf(w, "Verified hits:  none (set cache.verify.sample_rate to sample hits)\n")
+		return nil
+	}
+	fmt.Fprintf(w, "Verified hits:  %d (mean answer similarity %.2f)\n", stats.Verified, stats.MeanSimilarity)
+	fmt.Fprintf(w, "Stale evicted:  %d (%.1f%% of verified)\n", stats.Evicted, float64(stats.Evicted)/float64(stats.Verified)*100)
+	return nil
+}
+
+// parseSince reads an optional period argument (a duration such as "168h") as the time
+// it started; without one, everything recorded is included
+func parseSince(args []string) (time.Time, error) {
+	switch len(args) {
+	case 0:
+		return time.Time{}, nil
+	case 1:
+		period, err := time.ParseDuration(args[0])
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Now().Add(-period), nil
+	}
+	return time.Time{}, errors.New("too many arguments")
+}
+
+// runExplain shows how a request body read from a file (or stdin) is normalised for caching
+func runExplain(config *proxy.ProxyConfig, stdin io.Reader, w io.Writer, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: memex explain [request.json|-]")
+	}
+	in := stdin
+	if len(args) == 1 && args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	body, err := io.ReadAll(in)
+	if err != nil {
+		return fmt.Errorf("failed to read request: %w", err)
+	}
+	return proxy.Explain(config, body, w)
+}
+
 func setupLogger(cfg proxy.LogConfig) error {
 	var level slog.Level
 	switch strings.ToLower(cfg.Level) {
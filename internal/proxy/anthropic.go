@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/braw-dev/memex/pkg/types"
+)
+
+// countTokensCodec handles Anthropic's /v1/messages/count_tokens, which is deterministic
+// for a given model and body
+type countTokensCodec struct{}
+
+func (countTokensCodec) fingerprint(r *http.Request, body []byte) ([]byte, string, error) {
+	m, err := canonicalBody(body)
+	if err != nil {
+		return nil, "", err
+	}
+	fp, err := buildFingerprint(types.SchemaAnthropicCountTokens, "", m)
+	return fp, contentText(m["system"]), err
+}
+
+// usage reports no tokens: counting them does not consume any
+func (countTokensCodec) usage(contentType string, body []byte) (usage, bool) {
+	var resp struct {
+		InputTokens *int `json:"input_tokens"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil || resp.InputTokens == nil {
+		return usage{}, false
+	}
+	return usage{}, true
+}
+
+// modelsCodec handles model listings (GET /v1/models) for Anthropic and OpenAI.
+// The list depends on the provider and the account, so both are part of the fingerprint.
+type modelsCodec struct {
+	ttl time.Duration
+}
+
+func (modelsCodec) method() string {
+	return http.MethodGet
+}
+
+func (modelsCodec) fingerprint(r *http.Request, body []byte) ([]byte, string, error) {
+	var b bytes.Buffer
+	for _, part := range []string{
+		types.SchemaModels.String(),
+		upstreamHost(r),
+		r.URL.RawQuery,
+		hashText(r.Header.Get("x-api-key") + "\x00" + r.Header.Get("Authorization")),
+	} {
+		b.WriteString(part)
+		b.WriteByte(0)
+	}
+	return b.Bytes(), "", nil
+}
+
+func (modelsCodec) usage(contentType string, body []byte) (usage, bool) {
+	return usage{}, json.Valid(body)
+}
+
+func (c modelsCodec) cacheTTL() time.Duration {
+	return c.ttl
+}
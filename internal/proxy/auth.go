@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/braw-dev/memex/pkg/types"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// proxyAuthRealm is announced in Proxy-Authenticate challenges
+const proxyAuthRealm = `Basic realm="memex"`
+
+// proxyAuth validates Proxy-Authorization credentials
+type proxyAuth struct {
+	// users maps user names to bcrypt password hashes
+	users  map[string][]byte
+	tokens []AuthToken
+	// verified caches checks of basic credentials, since bcrypt is deliberately slow
+	verified sync.Map
+}
+
+// loadUsersFile reads an htpasswd file of bcrypt hashes ("user:$2y$...")
+func loadUsersFile(path string) (map[string][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || !strings.HasPrefix(hash, "$2") {
+			return nil, fmt.Errorf("%s:%d: expected user:bcrypt-hash", path, n)
+		}
+		users[user] = []byte(hash)
+	}
+	return users, scanner.Err()
+}
+
+// authenticate returns the identity for a Proxy-Authorization header value
+func (a *proxyAuth) authenticate(header string) (*types.Identity, bool) {
+	scheme, credentials, _ := strings.Cut(header, " ")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		decoded, err := base64.StdEncoding.DecodeString(credentials)
+		if err != nil {
+			return nil, false
+		}
+		user, password, ok := strings.Cut(string(decoded), ":")
+		hash, known := a.users[user]
+		if !ok || !known {
+			return nil, false
+		}
+		sum := sha256.Sum256(decoded)
+		if cached, ok := a.verified.Load(user); !ok || cached != sum {
+			if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+				return nil, false
+			}
+			a.verified.Store(user, sum)
+		}
+		return &types.Identity{User: user, Method: "basic"}, true
+	case "bearer":
+		if credentials == "" {
+			return nil, false
+		}
+		for _, t := range a.tokens {
+			// A token left empty must not match an empty credential
+			if t.Token != "" && subtle.ConstantTimeCompare([]byte(credentials), []byte(t.Token)) == 1 {
+				return &types.Identity{User: t.User, Method: "bearer"}, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// isLoopback reports whether a listen address only accepts local connections
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// allowsAnonymous reports whether requests without credentials are accepted: only on
+// loopback listeners, unless configured otherwise
+func allowsAnonymous(config *ProxyConfig) bool {
+	if config.Auth.Anonymous != nil {
+		return *config.Auth.Anonymous
+	}
+	return isLoopback(config.ListenAddr)
+}
+
+// CheckAuth reports an unsafe or unusable auth configuration: a token without a value, or
+// a non-loopback listener without users, tokens or explicitly allowed anonymous access
+func CheckAuth(config *ProxyConfig) error {
+	for i, t := range config.Auth.Tokens {
+		if t.Token == "" {
+			return fmt.Errorf("proxy.auth.tokens[%d] (user %q) has no token", i, t.User)
+		}
+	}
+	configured := config.Auth.UsersFile != "" || len(config.Auth.Tokens) > 0
+	if configured || allowsAnonymous(config) {
+		return nil
+	}
+	return fmt.Errorf("proxy listens on non-loopback address %q without authentication: "+
+		"configure proxy.auth.users_file or proxy.auth.tokens, or set proxy.auth.anonymous to accept every client", config.ListenAddr)
+}
+
+// AuthMiddleware validates Proxy-Authorization and attaches the user's identity to the
+// request context. Requests without valid credentials are challenged with 407 unless
+// anonymous access is allowed. Health checks are always allowed.
+func AuthMiddleware(next http.Handler, config *ProxyConfig) http.Handler {
+	auth := &proxyAuth{tokens: config.Auth.Tokens}
+	if path := config.Auth.UsersFile; path != "" {
+		users, err := loadUsersFile(path)
+		if err != nil {
+			slog.Error("Failed to load proxy users file, basic auth disabled", "err", err)
+		}
+		auth.users = users
+	}
+
+	anonymous := allowsAnonymous(config)
+	if anonymous && !isLoopback(config.ListenAddr) {
+		slog.Warn("Proxy accepts unauthenticated clients on a non-loopback address", "addr", config.ListenAddr)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Host == "" && r.URL.Path == "/healthz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if header := r.Header.Get("Proxy-Authorization"); header != "" {
+			identity, ok := auth.authenticate(header)
+			if !ok {
+				proxyAuthRequired(w)
+				return
+			}
+			r = r.WithContext(WithIdentity(r.Context(), identity))
+		} else if !anonymous {
+			proxyAuthRequired(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// proxyAuthRequired challenges the client for proxy credentials
+func proxyAuthRequired(w http.ResponseWriter) {
+	w.Header().Set("Proxy-Authenticate", proxyAuthRealm)
+	http.Error(w, "Proxy Authentication Required", http.StatusProxyAuthRequired)
+}
+
+type identityContextKey struct{}
+
+// WithIdentity adds the authenticated user to the context
+func WithIdentity(ctx context.Context, identity *types.Identity) context.Context {
+	return context.WithValue(ctx, identityContextKey{}, identity)
+}
+
+// IdentityFromContext retrieves the authenticated user, or nil for anonymous requests
+func IdentityFromContext(ctx context.Context) *types.Identity {
+	if identity, ok := ctx.Value(identityContextKey{}).(*types.Identity); ok {
+		return identity
+	}
+	return nil
+}
@@ -0,0 +1,413 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/braw-dev/memex/internal/store"
+	"github.com/braw-dev/memex/pkg/types"
+)
+
+// batchesPath is the Anthropic Message Batches API path
+const batchesPath = "/v1/messages/batches"
+
+// localBatchPrefix marks batches answered entirely from the cache, which never reach upstream
+const localBatchPrefix = "msgbatch_memex_"
+
+// batchRequest is one request of a message batch
+type batchRequest struct {
+	CustomID string          `json:"custom_id"`
+	Params   json.RawMessage `json:"params"`
+}
+
+// batchResult is one line of a batch's results file
+type batchResult struct {
+	CustomID string `json:"custom_id"`
+	Result   struct {
+		Type    string          `json:"type"`
+		Message json.RawMessage `json:"message,omitempty"`
+	} `json:"result"`
+}
+
+// handleBatches splits message batches into individual requests: cached ones are answered
+// locally, only the remainder is submitted upstream, and results are merged when fetched.
+// It returns false for requests that should be proxied as usual (e.g. listing batches,
+// batches memex did not record, or new batches while the LLM cache is disabled).
+func (h *proxyHandler) handleBatches(w http.ResponseWriter, r *http.Request) bool {
+	scope := FromContext(r.Context())
+	if h.store == nil || scope == nil {
+		return false
+	}
+	_, rest, _ := strings.Cut(r.URL.Path, batchesPath)
+	parts := strings.Split(strings.Trim(rest, "/"), "/")
+
+	if r.Method == http.MethodPost && rest == "" {
+		return h.config.Cache.LLM.Enabled && h.createBatch(w, r, scope)
+	}
+	if parts[0] == "" || len(parts) > 2 {
+		return false
+	}
+	// Recorded batches are served even once the LLM cache is disabled: their cached
+	// items, and local batches altogether, exist nowhere upstream
+	id := parts[0]
+	record, items, ok := h.batchRecord(id)
+	if !ok {
+		return false
+	}
+	if record.ScopeID != scope.ID {
+		writeSchemaError(w, types.SchemaAnthropicBatches, http.StatusNotFound, errNotFound,
+			"message batch "+id+" was not found")
+		return true
+	}
+
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 1:
+		h.getBatch(w, r, record, items)
+	case r.Method == http.MethodGet && parts[1] == "results":
+		h.getBatchResults(w, r, record, items)
+	case r.Method == http.MethodPost && len(parts) == 2 && parts[1] == "cancel" && !record.Upstream:
+		// Local batches have already ended, so cancelling them changes nothing
+		h.getBatch(w, r, record, items)
+	case r.Method == http.MethodDelete && len(parts) == 1:
+		h.deleteBatch(w, r, record)
+	default:
+		return false
+	}
+	return true
+}
+
+// createBatch answers cached requests locally and submits the others upstream
+func (h *proxyHandler) createBatch(w http.ResponseWriter, r *http.Request, scope *types.ScopeContext) bool {
+	body, err := peekBody(r)
+	if err != nil {
+		return false
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(body, &m); err != nil {
+		return false
+	}
+	var requests []batchRequest
+	if err := json.Unmarshal(m["requests"], &requests); err != nil || len(requests) == 0 {
+		return false
+	}
+	start := time.Now()
+
+	codec := anthropicCodec{tools: toolPolicy{config: h.config.Cache}, prompts: h.prompts}
+	items := make([]store.MessageBatchItem, len(requests))
+	var missing []batchRequest
+	var cachedUsage usage
+	for i, req := range requests {
+		fp, _, err := codec.fingerprint(r, req.Params)
+		if err != nil {
+			return false
+		}
+		items[i] = store.MessageBatchItem{CustomID: req.CustomID, HashKey: CacheKey(scope, fp)}
+
+		if message, u, ok := h.cachedMessage(scope, fp); ok {
+			items[i].Cached = true
+			items[i].ResultBlob = message
+			cachedUsage.In += u.In
+			cachedUsage.Out += u.Out
+			continue
+		}
+		missing = append(missing, req)
+	}
+
+	var batch map[string]any
+	if len(missing) == 0 {
+		batch = localBatchObject(r, newLocalBatchID(), len(items), time.Now())
+	} else {
+		if !h.enforceBudgets(w, r, types.SchemaAnthropicBatches) {
+			return true
+		}
+		subset, err := json.Marshal(missing)
+		if err != nil {
+			return false
+		}
+		m["requests"] = subset
+		newBody, err := json.Marshal(m)
+		if err != nil {
+			return false
+		}
+		buf := h.forwardBuffered(r, newBody)
+		if buf.status != http.StatusOK || json.Unmarshal(buf.body.Bytes(), &batch) != nil {
+			buf.copyTo(w)
+			return true
+		}
+	}
+
+	id, _ := batch["id"].(string)
+	record := &store.MessageBatch{BatchID: id, ScopeID: scope.ID, Upstream: len(missing) > 0, Salt: scope.Salt}
+	if err := h.store.CreateBatch(record, items); err != nil {
+		slog.Error("Failed to record message batch", "err", err)
+	}
+	if cached := len(items) - len(missing); cached > 0 {
+		h.audit(r, scope, types.SchemaAnthropicBatches, cachedUsage, true, start)
+	}
+
+	status := cacheStatusPartial
+	switch len(missing) {
+	case 0:
+		status = cacheStatusHit
+	case len(items):
+		status = cacheStatusMiss
+	}
+	if len(missing) > 0 {
+		batch = addCachedCounts(batch, len(items)-len(missing))
+	}
+	writeBatchObject(w, r, batch, status)
+	return true
+}
+
+// getBatch returns a local batch, or the upstream batch with cached items counted in
+func (h *proxyHandler) getBatch(w http.ResponseWriter, r *http.Request, record *store.MessageBatch, items []store.MessageBatchItem) {
+	if !record.Upstream {
+		writeBatchObject(w, r, localBatchObject(r, record.BatchID, len(items), record.CreatedAt), cacheStatusHit)
+		return
+	}
+
+	buf := h.forwardBuffered(r, nil)
+	var batch map[string]any
+	if buf.status != http.StatusOK || json.Unmarshal(buf.body.Bytes(), &batch) != nil {
+		buf.copyTo(w)
+		return
+	}
+	writeBatchObject(w, r, addCachedCounts(batch, countCached(items)), cacheStatusPartial)
+}
+
+// getBatchResults merges upstream results with cached ones, caching each new success
+func (h *proxyHandler) getBatchResults(w http.ResponseWriter, r *http.Request, record *store.MessageBatch, items []store.MessageBatchItem) {
+	id := record.BatchID
+	start := time.Now()
+
+	upstream := make(map[string][]byte)
+	if record.Upstream {
+		buf := h.forwardBuffered(r, nil)
+		if buf.status != http.StatusOK {
+			buf.copyTo(w)
+			return
+		}
+		// Results are audited per model so that they are priced
+		fresh := make(map[string]usage)
+		scanner := bufio.NewScanner(bytes.NewReader(buf.body.Bytes()))
+		scanner.Buffer(make([]byte, 0, 64*1024), buf.body.Len()+1)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			var result batchResult
+			if len(line) == 0 || json.Unmarshal(line, &result) != nil {
+				continue
+			}
+			upstream[result.CustomID] = append([]byte(nil), line...)
+			if result.Result.Type != "succeeded" {
+				continue
+			}
+			// Results are fetched again by clients that poll or retry; record each once
+			claimed, err := h.store.ClaimBatchItem(id, result.CustomID)
+			if err != nil {
+				slog.Error("Failed to mark batch result as recorded", "err", err)
+			}
+			if !claimed {
+				continue
+			}
+			u := h.cacheBatchMessage(record.ScopeID, items, result.CustomID, result.Result.Message)
+			var message struct {
+				Model string `json:"model"`
+			}
+			json.Unmarshal(result.Result.Message, &message)
+			total := fresh[message.Model]
+			fresh[message.Model] = usage{In: total.In + u.In, Out: total.Out + u.Out}
+		}
+		details := auditFromContext(r.Context())
+		for model, u := range fresh {
+			details.model = model
+			h.audit(r, &types.ScopeContext{ID: record.ScopeID}, types.SchemaAnthropicBatches, u, false, start)
+		}
+	}
+
+	var out bytes.Buffer
+	for _, item := range items {
+		if item.Cached {
+			var result batchResult
+			result.CustomID = item.CustomID
+			result.Result.Type = "succeeded"
+			result.Result.Message = item.ResultBlob
+			line, err := json.Marshal(result)
+			if err != nil {
+				continue
+			}
+			out.Write(line)
+			out.WriteByte('\n')
+		} else if line, ok := upstream[item.CustomID]; ok {
+			out.Write(line)
+			out.WriteByte('\n')
+		}
+	}
+
+	status := cacheStatusHit
+	if record.Upstream {
+		status = cacheStatusPartial
+	}
+	w.Header().Set("Content-Type", "application/x-jsonl")
+	w.Header().Set(cacheStatusHeader, status)
+	w.WriteHeader(http.StatusOK)
+	w.Write(out.Bytes())
+}
+
+// deleteBatch forgets a batch, forwarding the deletion upstream for upstream batches
+func (h *proxyHandler) deleteBatch(w http.ResponseWriter, r *http.Request, record *store.MessageBatch) {
+	id := record.BatchID
+	if record.Upstream {
+		buf := h.forwardBuffered(r, nil)
+		buf.copyTo(w)
+		if buf.status != http.StatusOK {
+			return
+		}
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"` + id + `","type":"message_batch_deleted"}`))
+	}
+	if err := h.store.DeleteBatch(id); err != nil {
+		slog.Error("Failed to delete message batch", "err", err)
+	}
+}
+
+// batchRecord loads a batch recorded by the proxy
+func (h *proxyHandler) batchRecord(id string) (*store.MessageBatch, []store.MessageBatchItem, bool) {
+	record, err := h.store.GetBatch(id)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.Error("Failed to load message batch", "err", err)
+		}
+		return nil, nil, false
+	}
+	items, err := h.store.GetBatchItems(id, ScopeSalt(record.ScopeID))
+	if err != nil {
+		slog.Error("Failed to load message batch items", "err", err)
+		return nil, nil, false
+	}
+	return record, items, true
+}
+
+// cachedMessage returns the cached non-streamed message for a Messages API fingerprint
+func (h *proxyHandler) cachedMessage(scope *types.ScopeContext, fingerprint []byte) (json.RawMessage, usage, bool) {
+	entry, err := LookupCache(h.store, scope, fingerprint)
+	if err != nil {
+		return nil, usage{}, false
+	}
+	var cached cachedResponse
+	if err := json.Unmarshal(entry.ResponseBlob, &cached); err != nil || isEventStream(cached.ContentType) {
+		return nil, usage{}, false
+	}
+	return cached.Body, usage{In: cached.TokensIn, Out: cached.TokensOut}, true
+}
+
+// cacheBatchMessage stores a batch result as a regular Messages API cache entry,
+// so it also answers identical non-batched requests
+func (h *proxyHandler) cacheBatchMessage(scopeID string, items []store.MessageBatchItem, customID string, message json.RawMessage) usage {
+	for _, item := range items {
+		if item.CustomID != customID || item.Cached {
+			continue
+		}
+		u, ok := anthropicCodec{}.usage("application/json", message)
+		if !ok || !h.config.Cache.LLM.Enabled {
+			return u
+		}
+		message, found, cacheable := h.secrets.filter(message)
+		if !cacheable {
+			slog.Warn("Not caching batch result containing secrets", "custom_id", customID, "count", found)
+			return u
+		}
+		blob, err := json.Marshal(cachedResponse{
+			ContentType: "application/json",
+			Body:        message,
+			TokensIn:    u.In,
+			TokensOut:   u.Out,
+		})
+		if err != nil {
+			return usage{}
+		}
+		entry := &store.CacheEntry{
+			HashKey:      item.HashKey,
+			ScopeID:      scopeID,
+			ResponseBlob: blob,
+			Salt:         ScopeSalt(scopeID),
+		}
+		if ttl := h.config.Cache.LLM.TTL; ttl > 0 {
+			expires := time.Now().Add(ttl)
+			entry.ExpiresAt = &expires
+		}
+		if err := h.store.SetCache(entry); err != nil {
+			slog.Error("Failed to cache batch result", "err", err)
+		}
+		return u
+	}
+	return usage{}
+}
+
+// localBatchObject describes a batch answered entirely from the cache
+func localBatchObject(r *http.Request, id string, n int, created time.Time) map[string]any {
+	scheme := r.URL.Scheme
+	if scheme == "" {
+		scheme = "https"
+	}
+	return map[string]any{
+		"id":                  id,
+		"type":                "message_batch",
+		"processing_status":   "ended",
+		"request_counts":      map[string]any{"processing": 0, "succeeded": n, "errored": 0, "canceled": 0, "expired": 0},
+		"created_at":          created.UTC().Format(time.RFC3339),
+		"ended_at":            created.UTC().Format(time.RFC3339),
+		"expires_at":          created.Add(24 * time.Hour).UTC().Format(time.RFC3339),
+		"cancel_initiated_at": nil,
+		"archived_at":         nil,
+		"results_url":         scheme + "://" + r.Host + batchesPath + "/" + id + "/results",
+	}
+}
+
+// addCachedCounts counts cached items as succeeded in the batch's request_counts
+func addCachedCounts(batch map[string]any, cached int) map[string]any {
+	counts, ok := batch["request_counts"].(map[string]any)
+	if !ok {
+		return batch
+	}
+	succeeded, _ := counts["succeeded"].(float64)
+	counts["succeeded"] = int(succeeded) + cached
+	return batch
+}
+
+func countCached(items []store.MessageBatchItem) int {
+	n := 0
+	for _, item := range items {
+		if item.Cached {
+			n++
+		}
+	}
+	return n
+}
+
+func writeBatchObject(w http.ResponseWriter, r *http.Request, batch map[string]any, status string) {
+	data, err := json.Marshal(batch)
+	if err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(cacheStatusHeader, status)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func newLocalBatchID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return localBatchPrefix + hex.EncodeToString(b)
+}
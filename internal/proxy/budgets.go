@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/braw-dev/memex/internal/store"
+	"github.com/braw-dev/memex/pkg/types"
+)
+
+// budgetHeader warns clients that budgets are nearly used up (e.g. "team-daily=85%")
+const budgetHeader = "X-Memex-Budget"
+
+// defaultBudgetWarnAt is the fraction of a budget from which responses carry a warning
+const defaultBudgetWarnAt = 0.8
+
+// isCompletionSchema reports whether requests of the schema generate (and bill) tokens
+func isCompletionSchema(schema types.SchemaType) bool {
+	switch schema {
+	case types.SchemaAnthropic, types.SchemaOpenAI, types.SchemaOpenAIResponses, types.SchemaGemini, types.SchemaOllama:
+		return true
+	}
+	return false
+}
+
+// isBatchCreation reports whether the request creates a message batch, whose requests
+// are billed as they are processed
+func isBatchCreation(r *http.Request, schema types.SchemaType) bool {
+	_, rest, _ := strings.Cut(r.URL.Path, batchesPath)
+	return schema == types.SchemaAnthropicBatches && r.Method == http.MethodPost && rest == ""
+}
+
+// requestModel returns the model a completion request asks for
+func requestModel(r *http.Request, schema types.SchemaType) string {
+	if schema == types.SchemaGemini {
+		model, _, _ := strings.Cut(path.Base(r.URL.Path), ":")
+		return model
+	}
+	body, err := peekBody(r)
+	if err != nil {
+		return ""
+	}
+	var req struct {
+		Model string `json:"model"`
+	}
+	json.Unmarshal(body, &req)
+	return req.Model
+}
+
+// cost prices upstream usage with the first matching model price
+func (h *proxyHandler) cost(model string, u usage) float64 {
+	for _, p := range h.config.Prices {
+		if globMatch(p.Model, model) {
+			return (float64(u.In)*p.Input + float64(u.Out)*p.Output) / 1e6
+		}
+	}
+	return 0
+}
+
+// periodStart returns when the current budget period began
+func periodStart(period string, now time.Time) (time.Time, bool) {
+	y, m, d := now.Date()
+	switch period {
+	case "daily":
+		return time.Date(y, m, d, 0, 0, 0, 0, now.Location()), true
+	case "monthly":
+		return time.Date(y, m, 1, 0, 0, 0, 0, now.Location()), true
+	}
+	return time.Time{}, false
+}
+
+// budgetSelects matches a budget selector against a request value. A set selector also
+// narrows the usage filter to the value, so each value has its own budget.
+func budgetSelects(pattern, value string, field **string) bool {
+	if pattern == "" {
+		return true
+	}
+	if !globMatch(pattern, value) {
+		return false
+	}
+	*field = &value
+	return true
+}
+
+// enforceBudgets rejects a completion or batch creation that would go upstream once one
+// of its budgets is used up, and warns when one is nearly used up. Cache hits never reach
+// it. Usage that cannot be read lets the request through.
+func (h *proxyHandler) enforceBudgets(w http.ResponseWriter, r *http.Request, schema types.SchemaType) bool {
+	if len(h.config.Budgets) == 0 || h.store == nil || !(isCompletionSchema(schema) || isBatchCreation(r, schema)) {
+		return true
+	}
+	details := auditFromContext(r.Context())
+	scopeID := ""
+	if scope := FromContext(r.Context()); scope != nil {
+		scopeID = scope.ID
+	}
+
+	now := time.Now()
+	var warnings []string
+	for i, b := range h.config.Budgets {
+		name := b.Name
+		if name == "" {
+			name = fmt.Sprintf("budget-%d", i+1)
+		}
+		var filter store.UsageFilter
+		if !budgetSelects(b.User, details.user, &filter.UserID) ||
+			!budgetSelects(b.Scope, scopeID, &filter.ScopeID) ||
+			!budgetSelects(b.Model, details.model, &filter.Model) {
+			continue
+		}
+		since, ok := periodStart(b.Period, now)
+		if !ok {
+			slog.Warn("Ignoring budget with unknown period", "budget", name, "period", b.Period)
+			continue
+		}
+		tokens, dollars, err := h.store.Usage(since, filter)
+		if err != nil {
+			slog.Error("Failed to read budget usage", "budget", name, "err", err)
+			continue
+		}
+
+		used := 0.0
+		if b.Tokens > 0 {
+			used = float64(tokens) / float64(b.Tokens)
+		}
+		if b.Dollars > 0 {
+			used = max(used, dollars/b.Dollars)
+		}
+		if used >= 1 {
+			slog.Info("Budget exceeded", "budget", name, "user", details.user, "scope", scopeID, "model", details.model)
+			writeSchemaError(w, schema, http.StatusTooManyRequests, errBudgetExceeded, fmt.Sprintf(
+				"memex budget %q exceeded: %d tokens and $%.2f used since %s", name, tokens, dollars, since.Format(time.DateOnly)))
+			return false
+		}
+		warnAt := b.WarnAt
+		if warnAt <= 0 {
+			warnAt = defaultBudgetWarnAt
+		}
+		if used >= warnAt {
+			warnings = append(warnings, fmt.Sprintf("%s=%d%%", name, int(used*100)))
+		}
+	}
+	if len(warnings) > 0 {
+		w.Header().Set(budgetHeader, strings.Join(warnings, ", "))
+	}
+	return true
+}
+
+// forwardAudited forwards a request that is not cached, recording the usage of
+// completion requests so that budgets count it. Usage is recorded as far as the response
+// reports it, including answers cut short, failed over or returned with an error.
+func (h *proxyHandler) forwardAudited(w http.ResponseWriter, r *http.Request, schema types.SchemaType) {
+	codec, ok := h.codec(schema)
+	scope := FromContext(r.Context())
+	if !ok || h.store == nil || scope == nil || !isCompletionSchema(schema) {
+		h.forward(w, r, schema)
+		return
+	}
+	start := time.Now()
+	// Let the transport negotiate compression so the captured body is plain text
+	r.Header.Del("Accept-Encoding")
+	cw := &captureWriter{ResponseWriter: w}
+	h.forward(cw, r, schema)
+	u, _ := codec.usage(cw.Header().Get("Content-Type"), cw.observed())
+	h.auditObserved(r, scope, schema, u, start)
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+
+	"github.com/braw-dev/memex/internal/store"
+	"github.com/braw-dev/memex/pkg/types"
+)
+
+// CacheKey derives the cache key for a request fingerprint within a scope.
+// The scope salt is mixed in so identical requests never collide across scopes.
+func CacheKey(scope *types.ScopeContext, fingerprint []byte) string {
+	h := sha256.New()
+	if scope != nil {
+		h.Write(scope.Salt)
+	}
+	h.Write(fingerprint)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// LookupCache looks up the fingerprint in the scope first and then in each parent scope.
+// It returns sql.ErrNoRows when no scope in the chain has an entry.
+func LookupCache(s *store.Store, scope *types.ScopeContext, fingerprint []byte) (*store.CacheEntry, error) {
+	for _, sc := range scope.Chain() {
+		entry, err := s.GetCache(CacheKey(sc, fingerprint), sc.Salt)
+		if err == nil {
+			return entry, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// cacheStatusHeader tells clients whether a response was served by Memex
+const cacheStatusHeader = "X-Memex-Cache"
+
+const (
+	cacheStatusHit  = "hit"
+	cacheStatusMiss = "miss"
+	// cacheStatusPartial marks a response assembled from cached and upstream parts
+	cacheStatusPartial = "partial"
+	// cacheStatusStale marks a degraded answer served because the upstream is unavailable
+	cacheStatusStale = "stale"
+)
+
+// maxCaptureBytes bounds the response copy kept for caching; larger responses are not cached
+const maxCaptureBytes = 8 << 20
+
+// usageWindow is how much of the start and end of an overflowed response is kept, so the
+// usage reported by its first and last events can still be audited
+const usageWindow = 64 << 10
+
+// captureWriter forwards a response to the client while keeping a copy of it for the cache
+type captureWriter struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+	// tail is the end of an overflowed response, whose body only keeps the start
+	tail []byte
+}
+
+func (c *captureWriter) WriteHeader(code int) {
+	if c.status == 0 {
+		c.status = code
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *captureWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	if !c.overflow && c.body.Len()+len(p) > maxCaptureBytes {
+		c.overflow = true
+		c.body.Truncate(min(c.body.Len(), usageWindow))
+	}
+	if c.overflow {
+		c.tail = append(c.tail, p...)
+		if n := len(c.tail) - usageWindow; n > 0 {
+			c.tail = append(c.tail[:0], c.tail[n:]...)
+		}
+	} else {
+		c.body.Write(p)
+	}
+	return c.ResponseWriter.Write(p)
+}
+
+// observed returns the captured response, or the start and end kept of an overflowed one
+func (c *captureWriter) observed() []byte {
+	if !c.overflow {
+		return c.body.Bytes()
+	}
+	return slices.Concat(c.body.Bytes(), []byte("\n\n"), c.tail)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer (e.g. to flush SSE)
+func (c *captureWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// bufferWriter holds an upstream response in memory so it can be rewritten before
+// anything reaches the client
+type bufferWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferWriter() *bufferWriter {
+	return &bufferWriter{header: make(http.Header)}
+}
+
+func (b *bufferWriter) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferWriter) WriteHeader(code int) {
+	if b.status == 0 {
+		b.status = code
+	}
+}
+
+func (b *bufferWriter) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+// copyTo writes the buffered response unchanged
+func (b *bufferWriter) copyTo(w http.ResponseWriter) {
+	for k, v := range b.header {
+		w.Header()[k] = v
+	}
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	w.WriteHeader(b.status)
+	w.Write(b.body.Bytes())
+}
+
+// forwardBuffered sends the request upstream with a replacement body and buffers the response
+func (h *proxyHandler) forwardBuffered(r *http.Request, body []byte) *bufferWriter {
+	out := r.Clone(r.Context())
+	out.Body = io.NopCloser(bytes.NewReader(body))
+	out.ContentLength = int64(len(body))
+	// Let the transport negotiate compression so the buffered body is plain text
+	out.Header.Del("Accept-Encoding")
+
+	buf := newBufferWriter()
+	h.proxy.ServeHTTP(buf, out)
+	return buf
+}
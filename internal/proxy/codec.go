@@ -0,0 +1,436 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/braw-dev/memex/pkg/types"
+)
+
+// usage holds the token counts reported by a provider response
+type usage struct {
+	In  int
+	Out int
+}
+
+// schemaCodec adapts a provider schema to the response cache
+type schemaCodec interface {
+	// fingerprint returns the canonical request fingerprint and the system prompt text.
+	// Fields that do not influence the answer (e.g. user IDs) are left out.
+	fingerprint(r *http.Request, body []byte) ([]byte, string, error)
+	// usage extracts token counts from a JSON or streamed response body.
+	// It returns false when the response is incomplete and must not be cached.
+	usage(contentType string, body []byte) (usage, bool)
+}
+
+// expiringCodec is implemented by codecs whose cached responses must expire.
+// A TTL of 0 disables caching for the codec.
+type expiringCodec interface {
+	cacheTTL() time.Duration
+}
+
+// methodCodec is implemented by codecs of endpoints that are not called with POST
+type methodCodec interface {
+	method() string
+}
+
+// cacheObserver is implemented by codecs that need to see responses as they are cached
+type cacheObserver interface {
+	cached(scope *types.ScopeContext, fingerprint []byte, contentType string, body []byte)
+}
+
+// conversationCodec is implemented by codecs whose requests parse into a Conversation
+type conversationCodec interface {
+	// conversation parses the request as normalised for fingerprinting. A turn that must
+	// not be cached is returned along with the error.
+	conversation(body []byte) (*types.Conversation, error)
+	// conversationFingerprint fingerprints a request already parsed by conversation
+	conversationFingerprint(conv *types.Conversation) ([]byte, string, error)
+}
+
+// answerCodec is implemented by codecs that can read the answer of a JSON or streamed
+// response as text, so that answers can be compared
+type answerCodec interface {
+	// answer returns the text and tool calls of the response
+	answer(contentType string, body []byte) string
+}
+
+// codec returns the codec of a cacheable schema
+func (h *proxyHandler) codec(schema types.SchemaType) (schemaCodec, bool) {
+	switch schema {
+	case types.SchemaAnthropic:
+		return anthropicCodec{tools: toolPolicy{config: h.config.Cache}, prompts: h.prompts}, true
+	case types.SchemaOpenAI:
+		return openAICodec{tools: toolPolicy{config: h.config.Cache}, prompts: h.prompts}, true
+	case types.SchemaOpenAIResponses:
+		return responsesCodec{store: h.store}, true
+	case types.SchemaGemini:
+		return geminiCodec{}, true
+	case types.SchemaOllama:
+		return ollamaCodec{}, true
+	case types.SchemaAnthropicCountTokens:
+		return countTokensCodec{}, true
+	case types.SchemaModels:
+		return modelsCodec{ttl: h.config.Cache.ModelsTTL}, true
+	default:
+		return nil, false
+	}
+}
+
+// canonicalBody decodes a JSON object body and drops the given top-level fields
+func canonicalBody(body []byte, drop ...string) (map[string]any, error) {
+	var m map[string]any
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&m); err != nil {
+		return nil, err
+	}
+	for _, key := range drop {
+		delete(m, key)
+	}
+	return m, nil
+}
+
+// buildFingerprint joins a schema-specific prefix (e.g. model path) with the canonical body
+func buildFingerprint(schema types.SchemaType, prefix string, body map[string]any) ([]byte, error) {
+	canonical, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	b.WriteString(schema.String())
+	b.WriteByte(0)
+	b.WriteString(prefix)
+	b.WriteByte(0)
+	b.Write(canonical)
+	return b.Bytes(), nil
+}
+
+// contentText concatenates the text of a string or a list of content blocks/parts
+func contentText(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []any:
+		var parts []string
+		for _, item := range v {
+			if t := contentText(item); t != "" {
+				parts = append(parts, t)
+			}
+		}
+		return strings.Join(parts, "\n")
+	case map[string]any:
+		if text, ok := v["text"].(string); ok {
+			return text
+		}
+		if parts, ok := v["parts"]; ok {
+			return contentText(parts)
+		}
+	}
+	return ""
+}
+
+// isEventStream reports whether a content type is Server-Sent Events
+func isEventStream(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/event-stream")
+}
+
+// isNDJSON reports whether a content type is newline-delimited JSON
+func isNDJSON(contentType string) bool {
+	return strings.HasPrefix(contentType, "application/x-ndjson")
+}
+
+// forEachSSE calls fn with the event name and data of each event in an SSE body
+func forEachSSE(body []byte, fn func(event, data string)) {
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(body)+1)
+	var event string
+	var data []string
+	dispatch := func() {
+		if len(data) > 0 {
+			fn(event, strings.Join(data, "\n"))
+		}
+		event, data = "", nil
+	}
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			dispatch()
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	dispatch()
+}
+
+// jsonInt reads an integer field from a decoded JSON object
+func jsonInt(m map[string]any, key string) int {
+	if f, ok := m[key].(float64); ok {
+		return int(f)
+	}
+	return 0
+}
+
+// anthropicStopMaxTokens is the stop_reason of an Anthropic answer cut short
+const anthropicStopMaxTokens = "max_tokens"
+
+// anthropicCodec handles the Anthropic Messages API
+type anthropicCodec struct {
+	tools   toolPolicy
+	prompts *promptNormalizer
+}
+
+func (c anthropicCodec) conversation(body []byte) (*types.Conversation, error) {
+	conv, err := types.ParseAnthropic(body)
+	if err != nil {
+		return nil, err
+	}
+	c.prompts.normalize(conv)
+	return conv, c.tools.normalize(conv)
+}
+
+func (c anthropicCodec) fingerprint(r *http.Request, body []byte) ([]byte, string, error) {
+	conv, err := c.conversation(body)
+	if err != nil {
+		return nil, "", err
+	}
+	return c.conversationFingerprint(conv)
+}
+
+func (anthropicCodec) conversationFingerprint(conv *types.Conversation) ([]byte, string, error) {
+	body, err := conv.MarshalAnthropic()
+	if err != nil {
+		return nil, "", err
+	}
+	m, err := canonicalBody(body, "metadata")
+	if err != nil {
+		return nil, "", err
+	}
+	fp, err := buildFingerprint(types.SchemaAnthropic, "", m)
+	return fp, contentText(m["system"]), err
+}
+
+func (anthropicCodec) usage(contentType string, body []byte) (usage, bool) {
+	var u usage
+	if !isEventStream(contentType) {
+		var resp struct {
+			StopReason string         `json:"stop_reason"`
+			Usage      map[string]any `json:"usage"`
+		}
+		if err := json.Unmarshal(body, &resp); err != nil {
+			return u, false
+		}
+		u = usage{In: jsonInt(resp.Usage, "input_tokens"), Out: jsonInt(resp.Usage, "output_tokens")}
+		return u, resp.StopReason != anthropicStopMaxTokens
+	}
+
+	complete, truncated := false, false
+	forEachSSE(body, func(event, data string) {
+		var msg struct {
+			Type    string `json:"type"`
+			Message struct {
+				Usage map[string]any `json:"usage"`
+			} `json:"message"`
+			Delta struct {
+				StopReason string `json:"stop_reason"`
+			} `json:"delta"`
+			Usage map[string]any `json:"usage"`
+		}
+		if json.Unmarshal([]byte(data), &msg) != nil {
+			return
+		}
+		switch msg.Type {
+		case "message_start":
+			u.In = jsonInt(msg.Message.Usage, "input_tokens")
+		case "message_delta":
+			// Delta usage is cumulative and may restate the input tokens
+			if n := jsonInt(msg.Usage, "input_tokens"); n > 0 {
+				u.In = n
+			}
+			u.Out = jsonInt(msg.Usage, "output_tokens")
+			truncated = truncated || msg.Delta.StopReason == anthropicStopMaxTokens
+		case "message_stop":
+			complete = true
+		}
+	})
+	// Answers cut short by max_tokens are not cached
+	return u, complete && !truncated
+}
+
+func (anthropicCodec) answer(contentType string, body []byte) string {
+	var b strings.Builder
+	block := func(v map[string]any) {
+		if text, ok := v["text"].(string); ok {
+			b.WriteString(text)
+		}
+		if name, ok := v["name"].(string); ok {
+			b.WriteString(name + " ")
+		}
+		if input, ok := v["input"].(map[string]any); ok && len(input) > 0 {
+			raw, _ := json.Marshal(input)
+			b.Write(raw)
+		}
+		if partial, ok := v["partial_json"].(string); ok {
+			b.WriteString(partial)
+		}
+	}
+	if !isEventStream(contentType) {
+		var resp struct {
+			Content []map[string]any `json:"content"`
+		}
+		json.Unmarshal(body, &resp)
+		for _, c := range resp.Content {
+			block(c)
+			b.WriteByte('\n')
+		}
+		return b.String()
+	}
+	forEachSSE(body, func(event, data string) {
+		var msg struct {
+			ContentBlock map[string]any `json:"content_block"`
+			Delta        map[string]any `json:"delta"`
+		}
+		if json.Unmarshal([]byte(data), &msg) != nil {
+			return
+		}
+		block(msg.ContentBlock)
+		block(msg.Delta)
+	})
+	return b.String()
+}
+
+// openAICodec handles the OpenAI Chat Completions API
+type openAICodec struct {
+	tools   toolPolicy
+	prompts *promptNormalizer
+}
+
+func (c openAICodec) conversation(body []byte) (*types.Conversation, error) {
+	conv, err := types.ParseOpenAI(body)
+	if err != nil {
+		return nil, err
+	}
+	c.prompts.normalize(conv)
+	return conv, c.tools.normalize(conv)
+}
+
+func (c openAICodec) fingerprint(r *http.Request, body []byte) ([]byte, string, error) {
+	conv, err := c.conversation(body)
+	if err != nil {
+		return nil, "", err
+	}
+	return c.conversationFingerprint(conv)
+}
+
+func (openAICodec) conversationFingerprint(conv *types.Conversation) ([]byte, string, error) {
+	body, err := conv.MarshalOpenAI()
+	if err != nil {
+		return nil, "", err
+	}
+	m, err := canonicalBody(body, "user")
+	if err != nil {
+		return nil, "", err
+	}
+	var system []string
+	if messages, ok := m["messages"].([]any); ok {
+		for _, msg := range messages {
+			msg, ok := msg.(map[string]any)
+			if !ok {
+				continue
+			}
+			if role := msg["role"]; role == "system" || role == "developer" {
+				system = append(system, contentText(msg["content"]))
+			}
+		}
+	}
+	fp, err := buildFingerprint(types.SchemaOpenAI, "", m)
+	return fp, strings.Join(system, "\n"), err
+}
+
+func (openAICodec) usage(contentType string, body []byte) (usage, bool) {
+	var u usage
+	truncated := false
+	read := func(data []byte) bool {
+		var resp struct {
+			Choices []struct {
+				FinishReason string `json:"finish_reason"`
+			} `json:"choices"`
+			Usage map[string]any `json:"usage"`
+		}
+		if json.Unmarshal(data, &resp) != nil {
+			return false
+		}
+		if resp.Usage != nil {
+			u = usage{In: jsonInt(resp.Usage, "prompt_tokens"), Out: jsonInt(resp.Usage, "completion_tokens")}
+		}
+		// Answers cut short (length) or filtered (content_filter) are not cached
+		for _, c := range resp.Choices {
+			if c.FinishReason == "length" || c.FinishReason == "content_filter" {
+				truncated = true
+			}
+		}
+		return true
+	}
+	if !isEventStream(contentType) {
+		return u, read(body) && !truncated
+	}
+
+	complete := false
+	forEachSSE(body, func(event, data string) {
+		if data == "[DONE]" {
+			complete = true
+			return
+		}
+		read([]byte(data))
+	})
+	return u, complete && !truncated
+}
+
+func (openAICodec) answer(contentType string, body []byte) string {
+	var b strings.Builder
+	type message struct {
+		Content   string `json:"content"`
+		ToolCalls []struct {
+			Function struct {
+				Name      string `json:"name"`
+				Arguments string `json:"arguments"`
+			} `json:"function"`
+		} `json:"tool_calls"`
+	}
+	read := func(m message) {
+		b.WriteString(m.Content)
+		for _, call := range m.ToolCalls {
+			b.WriteString(call.Function.Name + " " + call.Function.Arguments)
+		}
+	}
+	var resp struct {
+		Choices []struct {
+			Message message `json:"message"`
+			Delta   message `json:"delta"`
+		} `json:"choices"`
+	}
+	if !isEventStream(contentType) {
+		json.Unmarshal(body, &resp)
+		for _, c := range resp.Choices {
+			read(c.Message)
+		}
+		return b.String()
+	}
+	forEachSSE(body, func(event, data string) {
+		resp.Choices = nil
+		if json.Unmarshal([]byte(data), &resp) != nil {
+			return
+		}
+		for _, c := range resp.Choices {
+			read(c.Delta)
+		}
+	})
+	return b.String()
+}
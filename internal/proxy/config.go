@@ -11,6 +11,8 @@ import (
 	"github.com/knadh/koanf/parsers/yaml"
 	"github.com/knadh/koanf/providers/fs"
 	"github.com/knadh/koanf/v2"
+
+	"github.com/braw-dev/memex/pkg/types"
 )
 
 // LogConfig represents the logging configuration
@@ -20,6 +22,261 @@ type LogConfig struct {
 	Path   string `koanf:"path"`
 }
 
+// SubScopeRule maps repository sub-directories matching Pattern to their own scope
+type SubScopeRule struct {
+	// Pattern is a slash-separated glob relative to the repository root (e.g. "services/*")
+	Pattern string `koanf:"pattern"`
+	// Parent is the directory whose scope is consulted on a miss ("." for the repository scope).
+	// Empty disables the fallback.
+	Parent string `koanf:"parent"`
+}
+
+// SharedRule marks requests that are safe to share across all scopes.
+// Every non-empty field must match for the rule to apply.
+type SharedRule struct {
+	// Host is a glob matched against the upstream host name (e.g. "*.context7.com")
+	Host string `koanf:"host"`
+	// Path is a glob matched against the request path (e.g. "/docs/*")
+	Path string `koanf:"path"`
+	// MCPTool is a glob matched against the tool name of an MCP tools/call request
+	MCPTool string `koanf:"mcp_tool"`
+}
+
+// ScopeConfig represents the scope detection configuration
+type ScopeConfig struct {
+	SubScopes []SubScopeRule `koanf:"subscopes"`
+	Shared    []SharedRule   `koanf:"shared"`
+}
+
+// MCPServerPolicy overrides MCP caching for servers whose ID matches Server.
+// Server IDs are host and path for HTTP servers and "stdio:<command line>" for wrapped ones.
+type MCPServerPolicy struct {
+	// Server is a glob matched against the server ID (e.g. "mcp.context7.com/*")
+	Server string `koanf:"server"`
+	// Allow are globs of tool names that may be cached regardless of annotations
+	Allow []string `koanf:"allow"`
+	// Deny are globs of tool names that are never cached
+	Deny []string `koanf:"deny"`
+	// TTL overrides the default TTL for this server
+	TTL time.Duration `koanf:"ttl"`
+	// Tools overrides the TTL of individual tools
+	Tools []MCPToolRule `koanf:"tools"`
+}
+
+// MCPToolRule sets the TTL of cached results for tools matching Name.
+// Without a TTL the server's (or the default) TTL applies.
+type MCPToolRule struct {
+	Name string        `koanf:"name"`
+	TTL  time.Duration `koanf:"ttl"`
+}
+
+// MCPConfig represents the MCP caching configuration.
+// Nothing is cached unless explicitly enabled here.
+type MCPConfig struct {
+	// IdempotentTools are globs of tool names whose tools/call results may be cached
+	IdempotentTools []string `koanf:"idempotent_tools"`
+	// DenyTools are globs of tool names that are never cached, on any server
+	DenyTools []string `koanf:"deny_tools"`
+	// TrustAnnotations caches tools that tools/list declares read-only, or idempotent and
+	// not destructive. Unset, annotations are trusted; false ignores them.
+	TrustAnnotations *bool `koanf:"trust_annotations"`
+	// CacheResources enables caching of resources/read results
+	CacheResources bool `koanf:"cache_resources"`
+	// CachePrompts enables caching of prompts/get results
+	CachePrompts bool `koanf:"cache_prompts"`
+	// TTL is how long results are served from the cache (0 keeps them until busted)
+	TTL time.Duration `koanf:"ttl"`
+	// Servers holds per-server overrides; the first matching entry applies
+	Servers []MCPServerPolicy `koanf:"servers"`
+}
+
+// FailoverRule sends requests to another provider when the primary upstream fails.
+// Requests are translated when the fallback speaks a different schema.
+type FailoverRule struct {
+	// Host is a glob matched against the primary upstream host (e.g. "api.anthropic.com")
+	Host string `koanf:"host"`
+	// Upstream is the base URL of the fallback provider (e.g. "https://api.openai.com")
+	Upstream string `koanf:"upstream"`
+	// Schema is the API the fallback speaks: "anthropic" or "openai"
+	Schema string `koanf:"schema"`
+	// Model replaces the requested model on the fallback; empty keeps it
+	Model string `koanf:"model"`
+	// APIKey authenticates with the fallback, replacing the client's credentials
+	APIKey types.SensitiveString `koanf:"api_key"`
+}
+
+// ToolRule controls caching of agent turns that carry results of tools matching Name
+type ToolRule struct {
+	// Name is a glob matched against the tool name (e.g. "mcp__github__*")
+	Name string `koanf:"name"`
+	// NeverCache bypasses the cache for turns carrying this tool's results
+	NeverCache bool `koanf:"never_cache"`
+}
+
+// NormalizeRule masks a volatile part of system prompts before they are hashed.
+// Either Pattern or Section must be set.
+type NormalizeRule struct {
+	// Name identifies the rule in the masked placeholder and in explain output
+	Name string `koanf:"name"`
+	// Pattern is a regular expression whose matches are masked
+	Pattern string `koanf:"pattern"`
+	// Section masks text starting with this literal marker, up to and including End
+	Section string `koanf:"section"`
+	// End closes a section; empty masks to the end of the text block
+	End string `koanf:"end"`
+}
+
+// NormalizeConfig selects the system prompt normalisation rules
+type NormalizeConfig struct {
+	// Presets are built-in rule sets for popular clients (e.g. "claude-code", "dates")
+	Presets []string        `koanf:"presets"`
+	Rules   []NormalizeRule `koanf:"rules"`
+}
+
+// SecretPattern is a user-defined secret detector
+type SecretPattern struct {
+	Name    string `koanf:"name"`
+	Pattern string `koanf:"pattern"`
+}
+
+// SecretsConfig controls the secret scrubbing applied before anything is cached
+type SecretsConfig struct {
+	// Mode is "refuse" (default) to skip caching responses that contain secrets, "redact"
+	// to replace them in the cached copy, or "off"
+	Mode string `koanf:"mode"`
+	// Entropy is the Shannon entropy (bits per character) above which values assigned to
+	// names like API_KEY or password count as secrets; 0 disables the heuristic
+	Entropy  float64         `koanf:"entropy"`
+	Patterns []SecretPattern `koanf:"patterns"`
+}
+
+// SemanticConfig controls matching of requests that miss the cache against similar
+// cached requests with the same system prompt and model
+type SemanticConfig struct {
+	// Mode is "off" (default) or "shadow", which looks up the most similar cached request
+	// on a miss and records how its answer compares with the fresh one, but never serves it
+	Mode string `koanf:"mode"`
+	// Threshold is the prompt similarity (0-1) from which a candidate counts as a hit
+	Threshold float64 `koanf:"threshold"`
+}
+
+// VerifyConfig controls background checks of cache hits against the upstream
+type VerifyConfig struct {
+	// SampleRate is the share (0-1) of LLM cache hits sent upstream again; 0 disables it
+	SampleRate float64 `koanf:"sample_rate"`
+	// Threshold is the answer similarity (0-1) below which a cached answer counts as
+	// diverged and its entry is evicted
+	Threshold float64 `koanf:"threshold"`
+}
+
+// StaleConfig controls degraded answers served from the cache when the upstream cannot
+// answer. Degraded answers are marked with X-Memex-Cache: stale.
+type StaleConfig struct {
+	// IfError serves the closest cached answer when the upstream is unreachable or fails
+	// with a 5xx, even if it has expired or its request was only similar
+	IfError bool `koanf:"if_error"`
+	// Offline never contacts the upstream and answers every miss that way
+	Offline bool `koanf:"offline"`
+	// MinSimilarity is the least prompt similarity (0-1) of a degraded answer
+	MinSimilarity float64 `koanf:"min_similarity"`
+	// Footer appends a note to degraded answers saying they may be out of date
+	Footer bool `koanf:"footer"`
+}
+
+// LLMCacheConfig controls caching of LLM completions (Anthropic, OpenAI, Gemini, Ollama
+// and OpenAI Responses requests, and Anthropic message batches)
+type LLMCacheConfig struct {
+	// Enabled serves repeated completion requests from the cache
+	Enabled bool `koanf:"enabled"`
+	// TTL is how long completions are served from the cache (0 keeps them until busted)
+	TTL time.Duration `koanf:"ttl"`
+}
+
+// CacheConfig represents the response cache configuration
+type CacheConfig struct {
+	// LLM controls caching of LLM completions, which is off unless enabled
+	LLM LLMCacheConfig `koanf:"llm"`
+	// ModelsTTL is how long model listings (/v1/models) are served from the cache
+	ModelsTTL time.Duration `koanf:"models_ttl"`
+	// SkipSideEffects bypasses the cache for turns carrying results of tools that change
+	// the workspace, such as Bash and Edit
+	SkipSideEffects bool `koanf:"skip_side_effects"`
+	// Tools holds per-tool rules; the first matching rule applies and overrides SkipSideEffects
+	Tools []ToolRule `koanf:"tools"`
+	// Normalize masks volatile system prompt sections (dates, git status) before hashing
+	Normalize NormalizeConfig `koanf:"normalize"`
+	// Secrets detects API keys, tokens and private keys in responses before they are stored
+	Secrets SecretsConfig `koanf:"secrets"`
+	// Semantic matches misses against similar cached requests
+	Semantic SemanticConfig `koanf:"semantic"`
+	// Verify samples cache hits and evicts entries whose answers went stale
+	Verify VerifyConfig `koanf:"verify"`
+	// Stale serves cached answers when the upstream is down or memex is offline
+	Stale StaleConfig `koanf:"stale"`
+	// EncryptionKey is the master secret cached responses are encrypted with (empty stores plaintext)
+	EncryptionKey types.SensitiveString `koanf:"encryption_key"`
+}
+
+// UpstreamKey is the real provider key injected for requests authenticated with a virtual key
+type UpstreamKey struct {
+	// Host is a glob matched against the upstream host (e.g. "api.anthropic.com")
+	Host   string                `koanf:"host"`
+	APIKey types.SensitiveString `koanf:"api_key"`
+}
+
+// VirtualKeysConfig controls memex-issued API keys
+type VirtualKeysConfig struct {
+	Enabled bool `koanf:"enabled"`
+	// Required rejects requests that present a provider key instead of a virtual key
+	Required bool `koanf:"required"`
+	// AdminToken authorises the key management API under /_memex/keys (empty disables it)
+	AdminToken types.SensitiveString `koanf:"admin_token"`
+	// Upstream holds the real keys; the first rule matching the upstream host applies
+	Upstream []UpstreamKey `koanf:"upstream"`
+}
+
+// AuthToken is a bearer token accepted in Proxy-Authorization for a user
+type AuthToken struct {
+	User  string                `koanf:"user"`
+	Token types.SensitiveString `koanf:"token"`
+}
+
+// AuthConfig controls authentication of proxy clients via Proxy-Authorization
+type AuthConfig struct {
+	// UsersFile is an htpasswd file of bcrypt hashed passwords for basic auth
+	UsersFile string      `koanf:"users_file"`
+	Tokens    []AuthToken `koanf:"tokens"`
+	// Anonymous allows requests without credentials. Unset, it is allowed only on
+	// loopback listeners.
+	Anonymous *bool `koanf:"anonymous"`
+}
+
+// Budget caps the upstream usage of the requests it selects over a period. Each selector
+// that is set counts usage separately per value: User "*" gives every user their own budget.
+type Budget struct {
+	// Name identifies the budget in warnings and errors
+	Name string `koanf:"name"`
+	// User, Scope and Model are globs selecting the requests the budget covers
+	User  string `koanf:"user"`
+	Scope string `koanf:"scope"`
+	Model string `koanf:"model"`
+	// Period is "daily" or "monthly" (server local time)
+	Period string `koanf:"period"`
+	// Tokens caps input plus output tokens and Dollars caps cost; 0 leaves them unlimited
+	Tokens  int64   `koanf:"tokens"`
+	Dollars float64 `koanf:"dollars"`
+	// WarnAt is the fraction of the budget from which responses carry a warning (default 0.8)
+	WarnAt float64 `koanf:"warn_at"`
+}
+
+// ModelPrice is the price of a model in dollars per million tokens, used to cost requests
+type ModelPrice struct {
+	// Model is a glob matched against the requested model
+	Model  string  `koanf:"model"`
+	Input  float64 `koanf:"input"`
+	Output float64 `koanf:"output"`
+}
+
 // ProxyConfig represents the proxy server configuration
 type ProxyConfig struct {
 	ListenAddr      string        `koanf:"listen"`
@@ -27,6 +284,17 @@ type ProxyConfig struct {
 	IdleTimeout     time.Duration `koanf:"idle_timeout"`
 	FlushInterval   time.Duration `koanf:"flush_interval"`
 	Log             LogConfig     `koanf:"log"`
+	StorePath       string        `koanf:"store_path"`
+	Cache           CacheConfig   `koanf:"cache"`
+	Scope           ScopeConfig   `koanf:"scope"`
+	MCP             MCPConfig     `koanf:"mcp"`
+	// Failover holds fallback providers; the first rule matching the upstream host applies
+	Failover    []FailoverRule    `koanf:"failover"`
+	VirtualKeys VirtualKeysConfig `koanf:"virtual_keys"`
+	Auth        AuthConfig        `koanf:"auth"`
+	Budgets     []Budget          `koanf:"budgets"`
+	// Prices cost upstream usage; the first rule matching the model applies
+	Prices []ModelPrice `koanf:"prices"`
 }
 
 // ConfigLoader loads configuration from various sources
@@ -57,6 +325,30 @@ func (l *DefaultConfigLoader) Load() (*ProxyConfig, error) {
 			"upstream_timeout": "60s",
 			"idle_timeout":     "90s",
 			"flush_interval":   "0s",
+			"store_path":       ".memex/brain.duckdb",
+			"cache": map[string]interface{}{
+				"llm": map[string]interface{}{
+					"enabled": false,
+					"ttl":     "24h",
+				},
+				"models_ttl": "5m",
+				"secrets": map[string]interface{}{
+					"mode":    "refuse",
+					"entropy": 3.5,
+				},
+				"semantic": map[string]interface{}{
+					"mode":      "off",
+					"threshold": 0.9,
+				},
+				"verify": map[string]interface{}{
+					"sample_rate": 0,
+					"threshold":   0.8,
+				},
+				"stale": map[string]interface{}{
+					"min_similarity": 0.8,
+					"footer":         true,
+				},
+			},
 			"log": map[string]interface{}{
 				"level":  "info",
 				"format": "text",
@@ -138,6 +430,22 @@ func (p *envProvider) Read() (map[string]interface{}, error) {
 	p.lookup(m, "proxy.upstream_timeout", "PROXY_UPSTREAM_TIMEOUT")
 	p.lookup(m, "proxy.idle_timeout", "PROXY_IDLE_TIMEOUT")
 	p.lookup(m, "proxy.flush_interval", "PROXY_FLUSH_INTERVAL")
+	p.lookup(m, "proxy.store_path", "PROXY_STORE_PATH")
+	p.lookup(m, "proxy.cache.llm.enabled", "PROXY_CACHE_LLM_ENABLED")
+	p.lookup(m, "proxy.cache.llm.ttl", "PROXY_CACHE_LLM_TTL")
+	p.lookup(m, "proxy.cache.models_ttl", "PROXY_CACHE_MODELS_TTL")
+	p.lookup(m, "proxy.cache.skip_side_effects", "PROXY_CACHE_SKIP_SIDE_EFFECTS")
+	p.lookup(m, "proxy.cache.secrets.mode", "PROXY_CACHE_SECRETS_MODE")
+	p.lookup(m, "proxy.cache.encryption_key", "PROXY_CACHE_ENCRYPTION_KEY")
+	p.lookup(m, "proxy.cache.semantic.mode", "PROXY_CACHE_SEMANTIC_MODE")
+	p.lookup(m, "proxy.cache.verify.sample_rate", "PROXY_CACHE_VERIFY_SAMPLE_RATE")
+	p.lookup(m, "proxy.cache.stale.if_error", "PROXY_CACHE_STALE_IF_ERROR")
+	p.lookup(m, "proxy.cache.stale.offline", "PROXY_CACHE_STALE_OFFLINE")
+	p.lookup(m, "proxy.virtual_keys.enabled", "PROXY_VIRTUAL_KEYS_ENABLED")
+	p.lookup(m, "proxy.virtual_keys.required", "PROXY_VIRTUAL_KEYS_REQUIRED")
+	p.lookup(m, "proxy.virtual_keys.admin_token", "PROXY_VIRTUAL_KEYS_ADMIN_TOKEN")
+	p.lookup(m, "proxy.auth.users_file", "PROXY_AUTH_USERS_FILE")
+	p.lookup(m, "proxy.auth.anonymous", "PROXY_AUTH_ANONYMOUS")
 	p.lookup(m, "proxy.log.level", "PROXY_LOG_LEVEL")
 	p.lookup(m, "proxy.log.format", "PROXY_LOG_FORMAT")
 	p.lookup(m, "proxy.log.path", "PROXY_LOG_PATH")
@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"testing"
+	"time"
 )
 
 func TestDefaultConfigLoader_Load(t *testing.T) {
@@ -44,4 +45,19 @@ func TestDefaults(t *testing.T) {
 	if config.Log.Format != "text" {
 		t.Errorf("expected default format 'text', got %s", config.Log.Format)
 	}
+	if config.Cache.LLM.Enabled || config.Cache.LLM.TTL != 24*time.Hour {
+		t.Errorf("expected LLM caching to be off with a 24h TTL by default, got %+v", config.Cache.LLM)
+	}
+	if config.Cache.Secrets.Mode != "refuse" || config.Cache.Secrets.Entropy != 3.5 {
+		t.Errorf("expected responses with secrets to be refused by default, got %+v", config.Cache.Secrets)
+	}
+	if config.Cache.Semantic.Mode != "off" || config.Cache.Semantic.Threshold != 0.9 {
+		t.Errorf("expected semantic matching to be off by default, got %+v", config.Cache.Semantic)
+	}
+	if config.Cache.Verify.SampleRate != 0 || config.Cache.Verify.Threshold != 0.8 {
+		t.Errorf("expected hit verification to be off by default, got %+v", config.Cache.Verify)
+	}
+	if config.Cache.Stale.IfError || config.Cache.Stale.Offline || !config.Cache.Stale.Footer || config.Cache.Stale.MinSimilarity != 0.8 {
+		t.Errorf("expected stale answers to be off and footed by default, got %+v", config.Cache.Stale)
+	}
 }
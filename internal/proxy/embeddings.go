@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/braw-dev/memex/internal/store"
+	"github.com/braw-dev/memex/pkg/types"
+)
+
+// embeddingsRequest is an OpenAI-compatible embeddings request.
+// Input is a string, a list of strings, a token array or a list of token arrays.
+type embeddingsRequest struct {
+	Model          string          `json:"model"`
+	Input          json.RawMessage `json:"input"`
+	EncodingFormat string          `json:"encoding_format"`
+	Dimensions     int             `json:"dimensions"`
+}
+
+// embeddingsResponse is the response to an embeddings request
+type embeddingsResponse struct {
+	Object string           `json:"object"`
+	Data   []embeddingsItem `json:"data"`
+	Model  string           `json:"model"`
+	Usage  map[string]any   `json:"usage"`
+}
+
+type embeddingsItem struct {
+	Object    string          `json:"object"`
+	Index     int             `json:"index"`
+	Embedding json.RawMessage `json:"embedding"`
+}
+
+// embeddingInputs splits the input into individually cacheable items
+func embeddingInputs(input json.RawMessage) ([]json.RawMessage, error) {
+	input = bytes.TrimSpace(input)
+	if len(input) == 0 {
+		return nil, errors.New("missing input")
+	}
+	if input[0] != '[' {
+		return []json.RawMessage{input}, nil
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(input, &items); err != nil {
+		return nil, err
+	}
+	// A flat array of numbers is a single tokenised input
+	if len(items) > 0 {
+		if first := bytes.TrimSpace(items[0]); first[0] != '"' && first[0] != '[' {
+			return []json.RawMessage{input}, nil
+		}
+	}
+	return items, nil
+}
+
+// embeddingFingerprint identifies one input item for a model and output format
+func embeddingFingerprint(req *embeddingsRequest, item json.RawMessage) ([]byte, error) {
+	canonical, err := canonicalJSON(item)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	for _, part := range []string{types.SchemaEmbeddings.String(), req.Model, req.EncodingFormat, strconv.Itoa(req.Dimensions)} {
+		b.WriteString(part)
+		b.WriteByte(0)
+	}
+	b.Write(canonical)
+	return b.Bytes(), nil
+}
+
+// handleEmbeddings caches embeddings per input item: only uncached items are sent upstream
+// and the response is reassembled in the original order.
+// It returns false when the request cannot be cached and should be proxied as usual.
+func (h *proxyHandler) handleEmbeddings(w http.ResponseWriter, r *http.Request) bool {
+	scope := FromContext(r.Context())
+	if h.store == nil || scope == nil || r.Method != http.MethodPost {
+		return false
+	}
+	body, err := peekBody(r)
+	if err != nil {
+		return false
+	}
+	var req embeddingsRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return false
+	}
+	inputs, err := embeddingInputs(req.Input)
+	if err != nil || len(inputs) == 0 {
+		return false
+	}
+	start := time.Now()
+
+	embeddings := make([]json.RawMessage, len(inputs))
+	fingerprints := make([][]byte, len(inputs))
+	var missing []int
+	for i, item := range inputs {
+		fp, err := embeddingFingerprint(&req, item)
+		if err != nil {
+			return false
+		}
+		fingerprints[i] = fp
+		entry, err := LookupCache(h.store, scope, fp)
+		switch {
+		case err == nil:
+			embeddings[i] = entry.ResponseBlob
+		case errors.Is(err, sql.ErrNoRows):
+			missing = append(missing, i)
+		default:
+			slog.Error("Embeddings cache lookup failed", "err", err)
+			missing = append(missing, i)
+		}
+	}
+
+	model := req.Model
+	var u usage
+	status := cacheStatusHit
+	if len(missing) > 0 {
+		status = cacheStatusPartial
+		if len(missing) == len(inputs) {
+			status = cacheStatusMiss
+		}
+
+		resp, ok := h.fetchEmbeddings(w, r, body, inputs, missing)
+		if !ok {
+			return true
+		}
+		for j, item := range resp.Data {
+			if item.Index < 0 || item.Index >= len(missing) {
+				continue
+			}
+			i := missing[item.Index]
+			embeddings[i] = item.Embedding
+			err := h.store.SetCache(&store.CacheEntry{
+				HashKey:      CacheKey(scope, fingerprints[i]),
+				ScopeID:      scope.ID,
+				ResponseBlob: item.Embedding,
+				Salt:         scope.Salt,
+			})
+			if err != nil {
+				slog.Error("Failed to cache embedding", "index", j, "err", err)
+			}
+		}
+		if resp.Model != "" {
+			model = resp.Model
+		}
+		u = usage{In: jsonInt(resp.Usage, "prompt_tokens")}
+	}
+
+	out := embeddingsResponse{Object: "list", Model: model, Data: make([]embeddingsItem, len(inputs))}
+	for i, embedding := range embeddings {
+		if embedding == nil {
+			writeUpstreamError(w, r, fmt.Errorf("upstream returned no embedding for input %d", i))
+			return true
+		}
+		out.Data[i] = embeddingsItem{Object: "embedding", Index: i, Embedding: embedding}
+	}
+	out.Usage = map[string]any{"prompt_tokens": u.In, "total_tokens": u.In}
+
+	data, err := json.Marshal(out)
+	if err != nil {
+		writeUpstreamError(w, r, err)
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(cacheStatusHeader, status)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+
+	h.audit(r, scope, types.SchemaEmbeddings, u, status == cacheStatusHit, start)
+	return true
+}
+
+// fetchEmbeddings sends only the missing inputs upstream. Error responses are relayed to
+// the client as-is and reported as not ok.
+func (h *proxyHandler) fetchEmbeddings(w http.ResponseWriter, r *http.Request, body []byte, inputs []json.RawMessage, missing []int) (*embeddingsResponse, bool) {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(body, &m); err != nil {
+		writeUpstreamError(w, r, err)
+		return nil, false
+	}
+	subset := make([]json.RawMessage, len(missing))
+	for j, i := range missing {
+		subset[j] = inputs[i]
+	}
+	input, err := json.Marshal(subset)
+	if err != nil {
+		writeUpstreamError(w, r, err)
+		return nil, false
+	}
+	m["input"] = input
+	newBody, err := json.Marshal(m)
+	if err != nil {
+		writeUpstreamError(w, r, err)
+		return nil, false
+	}
+
+	buf := h.forwardBuffered(r, newBody)
+	if buf.status != http.StatusOK {
+		buf.copyTo(w)
+		return nil, false
+	}
+	var resp embeddingsResponse
+	if err := json.Unmarshal(buf.body.Bytes(), &resp); err != nil {
+		buf.copyTo(w)
+		return nil, false
+	}
+	return &resp, true
+}
@@ -0,0 +1,225 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/braw-dev/memex/pkg/types"
+)
+
+// errorKind classifies errors raised by the proxy itself, so they can be reported in
+// the shape each provider's SDKs understand
+type errorKind int
+
+const (
+	errBudgetExceeded errorKind = iota
+	// errUnavailable means no answer could be obtained: the upstream failed or memex is offline
+	errUnavailable
+	errTimeout
+	errUnauthorized
+	errForbidden
+	errInvalidRequest
+	errRateLimited
+	errOverloaded
+	errNotFound
+)
+
+// providerError names an error kind in one provider's vocabulary
+type providerError struct {
+	anthropic string
+	openAI    string
+	gemini    string
+}
+
+var errorNames = map[errorKind]providerError{
+	errBudgetExceeded: {anthropic: "rate_limit_error", openAI: "insufficient_quota", gemini: "RESOURCE_EXHAUSTED"},
+	errUnavailable:    {anthropic: "api_error", openAI: "server_error", gemini: "UNAVAILABLE"},
+	errTimeout:        {anthropic: "timeout_error", openAI: "timeout", gemini: "DEADLINE_EXCEEDED"},
+	errUnauthorized:   {anthropic: "authentication_error", openAI: "invalid_api_key", gemini: "UNAUTHENTICATED"},
+	errForbidden:      {anthropic: "permission_error", openAI: "permission_denied", gemini: "PERMISSION_DENIED"},
+	errInvalidRequest: {anthropic: "invalid_request_error", openAI: "invalid_request_error", gemini: "INVALID_ARGUMENT"},
+	errRateLimited:    {anthropic: "rate_limit_error", openAI: "rate_limit_exceeded", gemini: "RESOURCE_EXHAUSTED"},
+	errOverloaded:     {anthropic: "overloaded_error", openAI: "server_error", gemini: "UNAVAILABLE"},
+	errNotFound:       {anthropic: "not_found_error", openAI: "not_found", gemini: "NOT_FOUND"},
+}
+
+// maxErrorBytes caps how much of an upstream error body is read to report it
+const maxErrorBytes = 64 << 10
+
+// statusErrorKind classifies an upstream error by its status
+func statusErrorKind(status int) errorKind {
+	switch {
+	case status == http.StatusUnauthorized:
+		return errUnauthorized
+	case status == http.StatusForbidden:
+		return errForbidden
+	case status == http.StatusNotFound:
+		return errNotFound
+	case status == http.StatusTooManyRequests:
+		return errRateLimited
+	case status == http.StatusGatewayTimeout || status == http.StatusRequestTimeout:
+		return errTimeout
+	case status == 529:
+		return errOverloaded
+	case status < http.StatusInternalServerError:
+		return errInvalidRequest
+	default:
+		return errUnavailable
+	}
+}
+
+// upstreamErrorMessage extracts the message of an upstream error body in any provider's
+// format, falling back to the body itself or the status text
+func upstreamErrorMessage(status int, body []byte) string {
+	var shaped struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if json.Unmarshal(body, &shaped) == nil && shaped.Error != nil {
+		var nested struct {
+			Message string `json:"message"`
+		}
+		var flat string
+		if json.Unmarshal(shaped.Error, &nested) == nil && nested.Message != "" {
+			return nested.Message
+		}
+		if json.Unmarshal(shaped.Error, &flat) == nil && flat != "" {
+			return flat
+		}
+	}
+	if text := strings.TrimSpace(string(body)); text != "" {
+		return text
+	}
+	return http.StatusText(status)
+}
+
+// errorBody returns the error in the request schema's JSON format, or false for schemas
+// without a JSON error shape
+func errorBody(schema types.SchemaType, status int, kind errorKind, message string) (map[string]any, bool) {
+	names := errorNames[kind]
+	switch schema {
+	case types.SchemaAnthropic, types.SchemaAnthropicCountTokens, types.SchemaAnthropicBatches:
+		return map[string]any{
+			"type":  "error",
+			"error": map[string]any{"type": names.anthropic, "message": message},
+		}, true
+	case types.SchemaOpenAI, types.SchemaOpenAIResponses, types.SchemaEmbeddings:
+		return map[string]any{
+			"error": map[string]any{"message": message, "type": names.openAI, "param": nil, "code": names.openAI},
+		}, true
+	case types.SchemaGemini:
+		return map[string]any{
+			"error": map[string]any{"code": status, "message": message, "status": names.gemini},
+		}, true
+	case types.SchemaOllama:
+		return map[string]any{"error": message}, true
+	}
+	return nil, false
+}
+
+// writeSchemaError writes an error in the request schema's format, falling back to
+// plain text for schemas without a JSON error shape
+func writeSchemaError(w http.ResponseWriter, schema types.SchemaType, status int, kind errorKind, message string) {
+	if body, ok := errorBody(schema, status, kind, message); ok {
+		writeJSON(w, status, body)
+		return
+	}
+	http.Error(w, message, status)
+}
+
+// writeUpstreamError reports an upstream response that could not be used
+func writeUpstreamError(w http.ResponseWriter, r *http.Request, err error) {
+	slog.Error("Failed to assemble response", "err", err)
+	writeSchemaError(w, schemaFromContext(r.Context()), http.StatusBadGateway, errUnavailable,
+		"memex could not use the upstream response: "+err.Error())
+}
+
+// schemaFromContext returns the schema detected for the request
+func schemaFromContext(ctx context.Context) types.SchemaType {
+	if schema, ok := ctx.Value(schemaContextKey).(types.SchemaType); ok {
+		return schema
+	}
+	return types.SchemaUnknown
+}
+
+// isTimeout reports whether an upstream request failed because it took too long
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// streamErrorEvent formats an error as the event the schema's streams report errors with
+func streamErrorEvent(schema types.SchemaType, kind errorKind, message string) ([]byte, bool) {
+	body, ok := errorBody(schema, http.StatusBadGateway, kind, message)
+	if !ok {
+		return nil, false
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, false
+	}
+	var b bytes.Buffer
+	// Terminate an event the upstream left half written
+	b.WriteString("\n\n")
+	if schema == types.SchemaAnthropic {
+		b.WriteString("event: error\n")
+	}
+	b.WriteString("data: " + string(data) + "\n\n")
+	return b.Bytes(), true
+}
+
+// streamErrorBody ends an upstream event stream that breaks mid-flight with an error
+// event, so clients report the failure instead of a truncated answer
+type streamErrorBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	schema types.SchemaType
+	// tail is what remains of the error event once the upstream broke
+	tail  []byte
+	broke bool
+}
+
+func (s *streamErrorBody) Read(p []byte) (int, error) {
+	if s.broke {
+		if len(s.tail) == 0 {
+			return 0, io.EOF
+		}
+		n := copy(p, s.tail)
+		s.tail = s.tail[n:]
+		return n, nil
+	}
+	n, err := s.ReadCloser.Read(p)
+	// A client that went away needs no error event
+	if err == nil || err == io.EOF || s.ctx.Err() == context.Canceled {
+		return n, err
+	}
+	kind := errUnavailable
+	if isTimeout(err) {
+		kind = errTimeout
+	}
+	event, ok := streamErrorEvent(s.schema, kind, "the upstream stream broke: "+err.Error())
+	if !ok {
+		return n, err
+	}
+	slog.Error("Upstream stream broke", "err", err, "schema", s.schema)
+	s.tail, s.broke = event, true
+	return n, nil
+}
+
+// modifyResponse lets upstream event streams end with an error event if they break
+func modifyResponse(res *http.Response) error {
+	if isEventStream(res.Header.Get("Content-Type")) {
+		res.Body = &streamErrorBody{
+			ReadCloser: res.Body,
+			ctx:        res.Request.Context(),
+			schema:     schemaFromContext(res.Request.Context()),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/braw-dev/memex/pkg/types"
+)
+
+// explainSnippetLen bounds how much of each masked section Explain prints
+const explainSnippetLen = 80
+
+// Explain prints how the cache sees an Anthropic or OpenAI request body: the system
+// prompt sections the normalisation rules mask and the hashes before and after.
+func Explain(config *ProxyConfig, body []byte, w io.Writer) error {
+	prompts, err := newPromptNormalizer(config.Cache.Normalize)
+	if err != nil {
+		fmt.Fprintf(w, "warning: %v\n", err)
+	}
+
+	schema := requestSchema(body)
+	parse := types.ParseAnthropic
+	var codec schemaCodec = anthropicCodec{tools: toolPolicy{config: config.Cache}, prompts: prompts}
+	if schema == types.SchemaOpenAI {
+		parse = types.ParseOpenAI
+		codec = openAICodec{tools: toolPolicy{config: config.Cache}, prompts: prompts}
+	}
+
+	conv, err := parse(body)
+	if err != nil {
+		return fmt.Errorf("invalid %s request: %w", schema, err)
+	}
+	before := conv.SystemText()
+	masked := prompts.normalize(conv)
+
+	fmt.Fprintf(w, "Schema:        %s\n", schema)
+	fmt.Fprintf(w, "Rules:         %d\n", len(prompts.rules))
+	fmt.Fprintf(w, "System hash:   %s\n", orNone(hashText(before)))
+	fmt.Fprintf(w, "Normalised:    %s\n", orNone(hashText(conv.SystemText())))
+
+	fingerprint, _, err := codec.fingerprint(nil, body)
+	if err != nil {
+		fmt.Fprintf(w, "Fingerprint:   not cacheable (%v)\n", err)
+	} else {
+		fmt.Fprintf(w, "Fingerprint:   %s\n", hashText(string(fingerprint)))
+	}
+
+	fmt.Fprintf(w, "Masked:        %d section(s)\n", len(masked))
+	for _, m := range masked {
+		fmt.Fprintf(w, "  [%s] %s\n", m.Rule, snippet(m.Text))
+	}
+	return nil
+}
+
+// requestSchema tells Anthropic and OpenAI chat requests apart by their shape.
+// Requests that are valid in both default to Anthropic.
+func requestSchema(body []byte) types.SchemaType {
+	var req struct {
+		System   json.RawMessage `json:"system"`
+		Messages []struct {
+			Role string `json:"role"`
+		} `json:"messages"`
+		MaxCompletionTokens json.RawMessage `json:"max_completion_tokens"`
+	}
+	if json.Unmarshal(body, &req) != nil || req.System != nil {
+		return types.SchemaAnthropic
+	}
+	if req.MaxCompletionTokens != nil {
+		return types.SchemaOpenAI
+	}
+	for _, m := range req.Messages {
+		switch types.Role(m.Role) {
+		case types.RoleSystem, types.RoleDeveloper, types.RoleTool:
+			return types.SchemaOpenAI
+		}
+	}
+	return types.SchemaAnthropic
+}
+
+// snippet returns the first line of a masked section, truncated for display
+func snippet(text string) string {
+	line, _, multiline := strings.Cut(text, "\n")
+	if len(line) > explainSnippetLen {
+		line, multiline = line[:explainSnippetLen], true
+	}
+	if multiline {
+		return fmt.Sprintf("%q… (%d bytes)", line, len(text))
+	}
+	return fmt.Sprintf("%q", line)
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return s
+}
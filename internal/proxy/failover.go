@@ -0,0 +1,281 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/braw-dev/memex/pkg/types"
+)
+
+// failoverHeader names the fallback provider that answered a request
+const failoverHeader = "X-Memex-Failover"
+
+// failoverSchema parses the schema of a failover rule
+func failoverSchema(name string) (types.SchemaType, bool) {
+	switch strings.ToLower(name) {
+	case "anthropic":
+		return types.SchemaAnthropic, true
+	case "openai":
+		return types.SchemaOpenAI, true
+	default:
+		return types.SchemaUnknown, false
+	}
+}
+
+// failoverRule returns the first failover rule for the request's upstream host, if any.
+// Only Anthropic Messages and OpenAI Chat Completions requests can fail over.
+func (h *proxyHandler) failoverRule(r *http.Request, schema types.SchemaType) (*FailoverRule, types.SchemaType, bool) {
+	if schema != types.SchemaAnthropic && schema != types.SchemaOpenAI {
+		return nil, types.SchemaUnknown, false
+	}
+	host := upstreamHost(r)
+	for i := range h.config.Failover {
+		rule := &h.config.Failover[i]
+		if rule.Host != "" && !globMatch(rule.Host, host) {
+			continue
+		}
+		target, ok := failoverSchema(rule.Schema)
+		if !ok {
+			slog.Warn("Ignoring failover rule with unknown schema", "schema", rule.Schema)
+			continue
+		}
+		return rule, target, true
+	}
+	return nil, types.SchemaUnknown, false
+}
+
+// forward proxies the request upstream. When the primary upstream fails (5xx, 529 or
+// unreachable) and a failover rule applies, the request is sent to the fallback provider
+// instead and the translated answer is written. It reports whether failover happened.
+func (h *proxyHandler) forward(w http.ResponseWriter, r *http.Request, schema types.SchemaType) bool {
+	rule, target, ok := h.failoverRule(r, schema)
+	if !ok {
+		h.proxy.ServeHTTP(w, r)
+		return false
+	}
+	body, err := peekBody(r)
+	if err != nil {
+		h.proxy.ServeHTTP(w, r)
+		return false
+	}
+
+	fw := &failoverWriter{ResponseWriter: w, header: make(http.Header)}
+	h.proxy.ServeHTTP(fw, r)
+	if !fw.failed || r.Context().Err() != nil {
+		return false
+	}
+	slog.Warn("Primary upstream failed, failing over", "status", fw.status, "upstream", rule.Upstream)
+	if !h.failover(w, r, rule, schema, target, body) {
+		// The primary's own error says more than a failover that never started
+		fw.release()
+		return false
+	}
+	return true
+}
+
+// failover sends the request to the fallback provider, translating the request and its
+// response between schemas. It reports false, without writing anything, when the request
+// cannot be sent to the fallback.
+func (h *proxyHandler) failover(w http.ResponseWriter, r *http.Request, rule *FailoverRule, from, to types.SchemaType, body []byte) bool {
+	translated, err := translateRequest(from, to, body, rule.Model)
+	if err != nil {
+		slog.Error("Failed to translate request for failover", "err", err)
+		return false
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost,
+		strings.TrimSuffix(rule.Upstream, "/")+schemaPath(to), bytes.NewReader(translated))
+	if err != nil {
+		slog.Error("Failed to build failover request", "err", err)
+		return false
+	}
+	if rule.Model != "" {
+		// The fallback's usage is billed, and priced, as its model
+		auditFromContext(r.Context()).model = rule.Model
+	}
+	// The client's credentials belong to the primary provider and are never forwarded
+	req.Header.Set("Content-Type", "application/json")
+	if to == types.SchemaAnthropic {
+		req.Header.Set("x-api-key", string(rule.APIKey))
+		req.Header.Set("anthropic-version", "2023-06-01")
+	} else {
+		req.Header.Set("Authorization", "Bearer "+string(rule.APIKey))
+	}
+
+	resp, err := h.proxy.Transport.RoundTrip(req)
+	if err != nil {
+		h.proxy.ErrorHandler(w, r, err)
+		return true
+	}
+	defer resp.Body.Close()
+
+	if u, err := url.Parse(rule.Upstream); err == nil {
+		w.Header().Set(failoverHeader, u.Host)
+	}
+	if resp.StatusCode != http.StatusOK {
+		// The fallback's error is reported in the client's schema
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBytes))
+		writeSchemaError(w, from, resp.StatusCode, statusErrorKind(resp.StatusCode), upstreamErrorMessage(resp.StatusCode, data))
+		return true
+	}
+
+	if !isEventStream(resp.Header.Get("Content-Type")) {
+		data, err := io.ReadAll(resp.Body)
+		if err == nil {
+			data, err = translateResponse(to, from, data)
+		}
+		if err != nil {
+			writeUpstreamError(w, r, err)
+			return true
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
+		return true
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	translator := newStreamTranslator(to, from, body)
+	rc := http.NewResponseController(w)
+	write := func(events []sseEvent) error {
+		for _, e := range events {
+			if e.name != "" {
+				io.WriteString(w, "event: "+e.name+"\n")
+			}
+			if _, err := io.WriteString(w, "data: "+e.data+"\n\n"); err != nil {
+				return err
+			}
+		}
+		if len(events) > 0 {
+			rc.Flush()
+		}
+		return nil
+	}
+	err = readSSE(resp.Body, func(event, data string) error {
+		return write(translator.translate(event, data))
+	})
+	if err == nil && translator.finished() || r.Context().Err() == context.Canceled {
+		return true
+	}
+	// A stream that broke or ended early ends with an error event, so the client
+	// does not take the cut-off answer for a complete one
+	kind, message := errUnavailable, "the fallback stream ended before the answer was complete"
+	if err != nil {
+		message = "the fallback stream broke: " + err.Error()
+		if isTimeout(err) {
+			kind = errTimeout
+		}
+	}
+	slog.Error("Failover stream broke", "err", err, "upstream", rule.Upstream)
+	if event, ok := streamErrorEvent(from, kind, message); ok {
+		w.Write(event)
+		rc.Flush()
+	}
+	return true
+}
+
+// readSSE calls fn for each event of an SSE stream as it arrives
+func readSSE(r io.Reader, fn func(event, data string) error) error {
+	reader := bufio.NewReader(r)
+	var event string
+	var data []string
+	for {
+		line, err := reader.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "":
+			if len(data) > 0 {
+				if err := fn(event, strings.Join(data, "\n")); err != nil {
+					return err
+				}
+			}
+			event, data = "", nil
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+		if err == io.EOF {
+			if len(data) > 0 {
+				return fn(event, strings.Join(data, "\n"))
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// failoverWriter holds back 5xx responses of the primary upstream so the request can be
+// retried elsewhere, or answered from the cache. Any other response passes through untouched.
+type failoverWriter struct {
+	http.ResponseWriter
+	header http.Header
+	status int
+	failed bool
+	// body keeps a held back response so it can be released after all
+	body bytes.Buffer
+}
+
+func (f *failoverWriter) Header() http.Header {
+	if f.status != 0 && !f.failed {
+		return f.ResponseWriter.Header()
+	}
+	return f.header
+}
+
+func (f *failoverWriter) WriteHeader(code int) {
+	if f.status != 0 {
+		return
+	}
+	f.status = code
+	if code >= http.StatusInternalServerError {
+		f.failed = true
+		return
+	}
+	for k, v := range f.header {
+		f.ResponseWriter.Header()[k] = v
+	}
+	f.ResponseWriter.WriteHeader(code)
+}
+
+func (f *failoverWriter) Write(p []byte) (int, error) {
+	if f.status == 0 {
+		f.WriteHeader(http.StatusOK)
+	}
+	if f.failed {
+		return f.body.Write(p)
+	}
+	return f.ResponseWriter.Write(p)
+}
+
+// release writes a held back response when nothing better can be sent
+func (f *failoverWriter) release() {
+	for k, v := range f.header {
+		f.ResponseWriter.Header()[k] = v
+	}
+	f.ResponseWriter.WriteHeader(f.status)
+	f.ResponseWriter.Write(f.body.Bytes())
+}
+
+// Flush passes flushes through, except for a held back response
+func (f *failoverWriter) Flush() {
+	if f.status != 0 && !f.failed {
+		http.NewResponseController(f.ResponseWriter).Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (f *failoverWriter) Unwrap() http.ResponseWriter {
+	return f.ResponseWriter
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/braw-dev/memex/pkg/types"
+)
+
+// geminiCodec handles the Gemini generateContent and streamGenerateContent APIs.
+// The model and method live in the path (e.g. models/gemini-2.0-flash:generateContent).
+type geminiCodec struct{}
+
+// geminiFinishStop is the finish reason of an answer that ended naturally
+const geminiFinishStop = "STOP"
+
+// geminiChunk is a generateContent response, or one chunk of a streamed response
+type geminiChunk struct {
+	Candidates []struct {
+		Content struct {
+			Parts []struct {
+				Text         string `json:"text"`
+				FunctionCall *struct {
+					Name string          `json:"name"`
+					Args json.RawMessage `json:"args"`
+				} `json:"functionCall"`
+			} `json:"parts"`
+		} `json:"content"`
+		FinishReason string `json:"finishReason"`
+	} `json:"candidates"`
+	UsageMetadata map[string]any `json:"usageMetadata"`
+}
+
+func (geminiCodec) fingerprint(r *http.Request, body []byte) ([]byte, string, error) {
+	m, err := canonicalBody(body)
+	if err != nil {
+		return nil, "", err
+	}
+	// Streams are framed as SSE with alt=sse and as a JSON array otherwise; the API key
+	// (key=...) is deliberately left out
+	prefix := path.Base(r.URL.Path) + "?alt=" + r.URL.Query().Get("alt")
+	fp, err := buildFingerprint(types.SchemaGemini, prefix, m)
+	return fp, contentText(m["systemInstruction"]), err
+}
+
+func (geminiCodec) usage(contentType string, body []byte) (usage, bool) {
+	chunks, ok := geminiChunks(contentType, body)
+	if !ok {
+		return usage{}, false
+	}
+
+	// Usage is cumulative, so the last chunk carrying it wins
+	var u usage
+	complete := false
+	for _, chunk := range chunks {
+		if chunk.UsageMetadata != nil {
+			u = usage{
+				In:  jsonInt(chunk.UsageMetadata, "promptTokenCount"),
+				Out: jsonInt(chunk.UsageMetadata, "candidatesTokenCount"),
+			}
+		}
+		// Answers cut short (MAX_TOKENS) or blocked (SAFETY, RECITATION, ...) are not cached
+		for _, c := range chunk.Candidates {
+			if c.FinishReason == geminiFinishStop {
+				complete = true
+			}
+		}
+	}
+	return u, complete
+}
+
+func (geminiCodec) answer(contentType string, body []byte) string {
+	chunks, _ := geminiChunks(contentType, body)
+	var b strings.Builder
+	for _, chunk := range chunks {
+		for _, c := range chunk.Candidates {
+			for _, part := range c.Content.Parts {
+				b.WriteString(part.Text)
+				if fn := part.FunctionCall; fn != nil {
+					b.WriteString(fn.Name + " ")
+					b.Write(fn.Args)
+				}
+			}
+		}
+	}
+	return b.String()
+}
+
+// geminiChunks parses a response: a single JSON object, or a stream framed as SSE
+// (alt=sse) or as a JSON array
+func geminiChunks(contentType string, body []byte) ([]geminiChunk, bool) {
+	var chunks []geminiChunk
+	switch {
+	case isEventStream(contentType):
+		forEachSSE(body, func(event, data string) {
+			var chunk geminiChunk
+			if json.Unmarshal([]byte(data), &chunk) == nil {
+				chunks = append(chunks, chunk)
+			}
+		})
+	case bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")):
+		if err := json.Unmarshal(body, &chunks); err != nil {
+			return nil, false
+		}
+	default:
+		var chunk geminiChunk
+		if err := json.Unmarshal(body, &chunk); err != nil {
+			return nil, false
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks, true
+}
@@ -2,27 +2,49 @@ package proxy
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"time"
+
+	"github.com/braw-dev/memex/internal/store"
+	"github.com/braw-dev/memex/pkg/types"
 )
 
 type contextKey string
 
-const schemaContextKey contextKey = "schema"
+const (
+	schemaContextKey contextKey = "schema"
+	auditContextKey  contextKey = "audit"
+)
 
 // proxyHandler handles HTTP requests and forwards them to upstream servers
 type proxyHandler struct {
-	config   *ProxyConfig
-	proxy    *httputil.ReverseProxy
-	detector *SchemaDetector
+	config    *ProxyConfig
+	proxy     *httputil.ReverseProxy
+	detector  *SchemaDetector
+	store     *store.Store
+	mcpPolicy *mcpPolicy
+	prompts   *promptNormalizer
+	secrets   *secretScanner
+}
+
+// ServerOption configures optional dependencies of the proxy server
+type ServerOption func(*proxyHandler)
+
+// WithStore enables caching backed by the given store
+func WithStore(s *store.Store) ServerOption {
+	return func(h *proxyHandler) {
+		h.store = s
+	}
 }
 
 // NewServer creates a new proxy server handler
 // Returns http.Handler that can be used with http.Server
-func NewServer(config *ProxyConfig) http.Handler {
+func NewServer(config *ProxyConfig, opts ...ServerOption) http.Handler {
 	mux := http.NewServeMux()
 
 	// Initialize proxy handler components
@@ -40,26 +62,46 @@ func NewServer(config *ProxyConfig) http.Handler {
 		IdleConnTimeout:       config.IdleTimeout,
 		TLSHandshakeTimeout:   5 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
+		// Report upstreams that do not answer in time as timeouts (0 waits indefinitely)
+		ResponseHeaderTimeout: config.UpstreamTimeout,
 	}
 
 	// Create reverse proxy
 	reverseProxy := &httputil.ReverseProxy{
-		Director:      makeDirector(detector, config),
-		Transport:     transport,
-		FlushInterval: config.FlushInterval, // 0 for immediate flushing (SSE)
-		ErrorLog:      slog.NewLogLogger(slog.Default().Handler(), slog.LevelError),
-		ErrorHandler:  makeErrorHandler(config),
+		Director:       makeDirector(detector, config),
+		Transport:      transport,
+		FlushInterval:  config.FlushInterval, // 0 for immediate flushing (SSE)
+		ErrorLog:       slog.NewLogLogger(slog.Default().Handler(), slog.LevelError),
+		ErrorHandler:   makeErrorHandler(config),
+		ModifyResponse: modifyResponse,
+	}
+
+	prompts, err := newPromptNormalizer(config.Cache.Normalize)
+	if err != nil {
+		slog.Error("Ignoring invalid system prompt normalisation rules", "err", err)
+	}
+	secrets, err := newSecretScanner(config.Cache.Secrets)
+	if err != nil {
+		slog.Error("Ignoring invalid secret scrubbing settings", "err", err)
 	}
 
 	// Create proxy handler instance
 	handler := &proxyHandler{
-		config:   config,
-		proxy:    reverseProxy,
-		detector: detector,
+		config:    config,
+		proxy:     reverseProxy,
+		detector:  detector,
+		mcpPolicy: newMCPPolicy(config.MCP),
+		prompts:   prompts,
+		secrets:   secrets,
+	}
+	for _, opt := range opts {
+		opt(handler)
 	}
 
 	// Register routes
 	mux.HandleFunc("GET /healthz", handleHealthz())
+	mux.HandleFunc("/_memex/keys", handler.handleKeys)
+	mux.HandleFunc("/_memex/keys/{id}", handler.handleKeys)
 	mux.HandleFunc("/", handler.handleProxy)
 
 	// Apply middleware
@@ -68,6 +110,7 @@ func NewServer(config *ProxyConfig) http.Handler {
 
 	// ScopeMiddleware (Principle V: Auth/Scope is first)
 	h = ScopeMiddleware(h, config)
+	h = AuthMiddleware(h, config)
 
 	return h
 }
@@ -86,14 +129,50 @@ func (h *proxyHandler) handleProxy(w http.ResponseWriter, r *http.Request) {
 	// Track request start
 	startTime := time.Now()
 
-	// Detect schema
-	schema := h.detector.Detect(r)
-
-	// Store schema in context
+	// Reuse the schema ScopeMiddleware detected, detecting it for requests that bypassed it
+	schema, ok := r.Context().Value(schemaContextKey).(types.SchemaType)
+	if !ok {
+		schema = h.detector.Detect(r)
+	}
 	ctx := context.WithValue(r.Context(), schemaContextKey, schema)
+	details := &auditDetails{}
+	if identity := IdentityFromContext(r.Context()); identity != nil {
+		details.user = identity.User
+	}
+	// The conversation is parsed once here; turns that bypass the cache still track their
+	// prefixes, but only cacheable ones reach the LLM cache
+	var conv *types.Conversation
+	if isCompletionSchema(schema) {
+		parsed, err := h.requestConversation(r, schema)
+		if parsed != nil {
+			details.model = parsed.Model
+			details.prefixes = prefixHashes(parsed)
+		} else {
+			details.model = requestModel(r, schema)
+		}
+		if err != nil {
+			slog.Debug("Request not cacheable", "schema", schema, "err", err)
+		} else {
+			conv = parsed
+		}
+	}
+	ctx = context.WithValue(ctx, auditContextKey, details)
+	r = r.WithContext(ctx)
 
-	// Forward request
-	h.proxy.ServeHTTP(w, r.WithContext(ctx))
+	if !h.authenticateVirtualKey(w, r) {
+		return
+	}
+
+	switch {
+	case schema == types.SchemaMCP && h.handleMCP(w, r):
+	case schema == types.SchemaEmbeddings && h.handleEmbeddings(w, r):
+	case schema == types.SchemaAnthropicBatches && h.handleBatches(w, r):
+	case h.handleLLM(w, r, schema, conv):
+	case !h.enforceBudgets(w, r, schema):
+	default:
+		// Forward request
+		h.forwardAudited(w, r, schema)
+	}
 
 	duration := time.Since(startTime)
 	slog.Debug("Completed request", "method", r.Method, "path", r.URL.Path, "duration", duration, "schema", schema)
@@ -117,15 +196,26 @@ func makeDirector(detector *SchemaDetector, config *ProxyConfig) func(*http.Requ
 	}
 }
 
-// makeErrorHandler creates an error handler for ReverseProxy
+// makeErrorHandler creates an error handler for ReverseProxy. Errors are written in the
+// request schema's format: 504 when the upstream timed out, 502 when it could not be reached.
 func makeErrorHandler(config *ProxyConfig) func(http.ResponseWriter, *http.Request, error) {
 	return func(w http.ResponseWriter, r *http.Request, err error) {
-		if err != nil {
-			slog.Error("Proxy error", "err", err, "path", r.URL.Path)
-			w.WriteHeader(http.StatusBadGateway)
-			// Minimal error response
-			w.Write([]byte("Bad Gateway"))
+		if err == nil {
+			return
+		}
+		if errors.Is(err, context.Canceled) && r.Context().Err() != nil {
+			slog.Debug("Client went away", "path", r.URL.Path)
+			return
+		}
+		slog.Error("Proxy error", "err", err, "path", r.URL.Path)
+		schema := schemaFromContext(r.Context())
+		if isTimeout(err) {
+			writeSchemaError(w, schema, http.StatusGatewayTimeout, errTimeout,
+				fmt.Sprintf("memex: the upstream did not respond within %s", config.UpstreamTimeout))
+			return
 		}
+		writeSchemaError(w, schema, http.StatusBadGateway, errUnavailable,
+			"memex could not reach the upstream: "+err.Error())
 	}
 }
 
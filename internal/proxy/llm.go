@@ -0,0 +1,300 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/braw-dev/memex/internal/store"
+	"github.com/braw-dev/memex/pkg/types"
+)
+
+// cachedResponse is the response_blob of an LLM cache entry.
+// Streams are stored verbatim so they can be replayed event by event.
+type cachedResponse struct {
+	ContentType string `json:"content_type"`
+	Body        []byte `json:"body"`
+	TokensIn    int    `json:"tokens_in"`
+	TokensOut   int    `json:"tokens_out"`
+}
+
+// handleLLM serves LLM requests from the cache and records successful upstream responses.
+// conv is the request's conversation for codecs that parse one, nil when it could not be
+// parsed or must not be cached. It returns false when the request cannot be cached and
+// should be proxied as usual.
+func (h *proxyHandler) handleLLM(w http.ResponseWriter, r *http.Request, schema types.SchemaType, conv *types.Conversation) bool {
+	codec, ok := h.codec(schema)
+	scope := FromContext(r.Context())
+	if !ok || h.store == nil || scope == nil || r.Method != codecMethod(codec) {
+		return false
+	}
+	if isCompletionSchema(schema) && !h.config.Cache.LLM.Enabled {
+		return false
+	}
+	if ec, ok := codec.(expiringCodec); ok && ec.cacheTTL() <= 0 {
+		return false
+	}
+	var fingerprint []byte
+	var system string
+	var err error
+	if cc, ok := codec.(conversationCodec); ok {
+		if conv == nil {
+			return false
+		}
+		fingerprint, system, err = cc.conversationFingerprint(conv)
+	} else {
+		var body []byte
+		if body, err = peekBody(r); err == nil {
+			fingerprint, system, err = codec.fingerprint(r, body)
+		}
+	}
+	if err != nil {
+		slog.Debug("Request not cacheable", "schema", schema, "err", err)
+		return false
+	}
+	start := time.Now()
+
+	entry, err := LookupCache(h.store, scope, fingerprint)
+	if err == nil {
+		var cached cachedResponse
+		if err := json.Unmarshal(entry.ResponseBlob, &cached); err == nil {
+			replayResponse(w, &cached, cacheStatusHit)
+			h.audit(r, scope, schema, usage{In: cached.TokensIn, Out: cached.TokensOut}, true, start)
+			h.verifyHit(r, scope, schema, codec, entry, &cached)
+			slog.Debug("LLM cache hit", "schema", schema, "scope", entry.ScopeID)
+			return true
+		}
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		slog.Error("LLM cache lookup failed", "err", err)
+	}
+
+	if h.config.Cache.Stale.Offline {
+		if conv == nil || !h.serveStale(w, r, schema, conv, system, staleOffline, start) {
+			writeSchemaError(w, schema, http.StatusServiceUnavailable, errUnavailable,
+				"memex is in offline mode and has no cached answer for this request")
+		}
+		return true
+	}
+	if !h.enforceBudgets(w, r, schema) {
+		return true
+	}
+	var shadow *shadowLookup
+	if h.config.Cache.Semantic.Mode == semanticShadow && conv != nil {
+		shadow = h.shadowCandidate(scope, conv, system)
+	}
+
+	// Let the transport negotiate compression so the captured body is plain text
+	r.Header.Del("Accept-Encoding")
+	w.Header().Set(cacheStatusHeader, cacheStatusMiss)
+	cw := &captureWriter{ResponseWriter: w}
+	var out http.ResponseWriter = cw
+	var held *failoverWriter
+	if h.config.Cache.Stale.IfError && conv != nil {
+		// Hold back upstream failures, which are answered from the cache if possible
+		held = &failoverWriter{ResponseWriter: cw, header: make(http.Header)}
+		out = held
+	}
+	// Answers from a fallback provider come from a different model and are not cached
+	failedOver := h.forward(out, r, schema)
+	if held != nil && held.failed {
+		if r.Context().Err() != nil || !h.serveStale(w, r, schema, conv, system, staleUpstreamError, start) {
+			held.release()
+		}
+		return true
+	}
+	contentType := cw.Header().Get("Content-Type")
+	u, complete := codec.usage(contentType, cw.observed())
+	if failedOver || cw.status != http.StatusOK || cw.overflow || r.Context().Err() != nil || !complete {
+		h.auditObserved(r, scope, schema, u, start)
+		return true
+	}
+	respBody, secrets, cacheable := h.secrets.filter(cw.body.Bytes())
+	if ac, ok := codec.(answerCodec); ok && cacheable {
+		// Streams split the answer across events, so a secret can survive the scan of the
+		// raw body. It cannot be redacted in place; the response is not cached.
+		if found := h.secrets.detect(ac.answer(contentType, respBody)); found > 0 {
+			secrets += found
+			cacheable = false
+		}
+	}
+	auditFromContext(r.Context()).secrets = secrets
+	h.audit(r, scope, schema, u, false, start)
+	if shadow != nil {
+		h.recordShadow(shadow, codec, contentType, respBody)
+	}
+	if !cacheable {
+		slog.Warn("Not caching LLM response containing secrets", "schema", schema, "count", secrets)
+		return true
+	}
+
+	blob, err := json.Marshal(cachedResponse{
+		ContentType: contentType,
+		Body:        respBody,
+		TokensIn:    u.In,
+		TokensOut:   u.Out,
+	})
+	if err != nil {
+		return true
+	}
+	entry = &store.CacheEntry{
+		HashKey:      CacheKey(scope, fingerprint),
+		ScopeID:      scope.ID,
+		SystemHash:   hashText(system),
+		ResponseBlob: blob,
+		Salt:         scope.Salt,
+	}
+	if conv != nil {
+		entry.Model = conv.Model
+		// Vectors are stored in plaintext to be searchable, so they are only kept when a
+		// feature looks them up
+		if h.similarLookups() {
+			entry.ContextHash = contextHash(conv)
+			entry.PromptVector = promptVector(conv)
+		}
+	}
+	if ttl := h.cacheTTL(schema, codec); ttl > 0 {
+		expires := time.Now().Add(ttl)
+		entry.ExpiresAt = &expires
+	}
+	if err := h.store.SetCache(entry); err != nil {
+		slog.Error("Failed to cache LLM response", "err", err)
+		return true
+	}
+	if co, ok := codec.(cacheObserver); ok {
+		co.cached(scope, fingerprint, contentType, respBody)
+	}
+	return true
+}
+
+// cacheTTL returns how long a response of the schema is served from the cache (0 never
+// expires): the LLM cache TTL for completions, or the codec's own TTL when shorter
+func (h *proxyHandler) cacheTTL(schema types.SchemaType, codec schemaCodec) time.Duration {
+	var ttl time.Duration
+	if isCompletionSchema(schema) {
+		ttl = h.config.Cache.LLM.TTL
+	}
+	if ec, ok := codec.(expiringCodec); ok && (ttl == 0 || ec.cacheTTL() < ttl) {
+		ttl = ec.cacheTTL()
+	}
+	return ttl
+}
+
+// codecMethod returns the HTTP method of the endpoint a codec handles
+func codecMethod(codec schemaCodec) string {
+	if mc, ok := codec.(methodCodec); ok {
+		return mc.method()
+	}
+	return http.MethodPost
+}
+
+// replayResponse writes a cached response with the given cache status, flushing streams
+// one event (or line) at a time
+func replayResponse(w http.ResponseWriter, cached *cachedResponse, status string) {
+	w.Header().Set("Content-Type", cached.ContentType)
+	w.Header().Set(cacheStatusHeader, status)
+
+	sep := []byte(nil)
+	switch {
+	case isEventStream(cached.ContentType):
+		sep = []byte("\n\n")
+		w.Header().Set("Cache-Control", "no-cache")
+	case isNDJSON(cached.ContentType):
+		sep = []byte("\n")
+	default:
+		w.Header().Set("Content-Length", strconv.Itoa(len(cached.Body)))
+	}
+	w.WriteHeader(http.StatusOK)
+
+	if sep == nil {
+		w.Write(cached.Body)
+		return
+	}
+	rc := http.NewResponseController(w)
+	rest := cached.Body
+	for len(rest) > 0 {
+		chunk := rest
+		if i := bytes.Index(rest, sep); i >= 0 {
+			chunk = rest[:i+len(sep)]
+		}
+		rest = rest[len(chunk):]
+		if _, err := w.Write(chunk); err != nil {
+			return
+		}
+		rc.Flush()
+	}
+}
+
+// auditDetails collects facts about a request, gathered along the way, that are
+// recorded with its audit log
+type auditDetails struct {
+	// prefixes are the conversation's cumulative prefix hashes (see prefixHashes)
+	prefixes []string
+	// secrets is the number of secrets found in the response before caching it
+	secrets int
+	// user is the user the request is attributed to: the proxy identity, or the owner
+	// of the virtual key it presented
+	user string
+	// model is the model a completion request asks for
+	model string
+}
+
+// auditFromContext returns the request's audit details
+func auditFromContext(ctx context.Context) *auditDetails {
+	if details, ok := ctx.Value(auditContextKey).(*auditDetails); ok {
+		return details
+	}
+	return &auditDetails{}
+}
+
+// audit records the request in audit_logs without blocking the response
+func (h *proxyHandler) audit(r *http.Request, scope *types.ScopeContext, schema types.SchemaType, u usage, hit bool, start time.Time) {
+	log := &store.AuditLog{
+		Timestamp: time.Now(),
+		ScopeID:   scope.ID,
+		TokensIn:  u.In,
+		TokensOut: u.Out,
+		Latency:   int(time.Since(start).Milliseconds()),
+		Schema:    schema.String(),
+		CacheHit:  hit,
+	}
+	details := *auditFromContext(r.Context())
+	log.SecretsFound = details.secrets
+	log.UserID = details.user
+	log.Model = details.model
+	if !hit {
+		log.Cost = h.cost(details.model, u)
+	}
+	go func() {
+		if len(details.prefixes) > 0 {
+			h.trackPrefix(log, details.prefixes)
+		}
+		if err := h.store.WriteLog(log); err != nil {
+			slog.Error("Failed to write audit log", "err", err)
+		}
+	}()
+}
+
+// auditObserved records the usage seen in a response that is not cached: failed over,
+// cut short, too large to keep or an error. Whatever the upstream reported was billed.
+func (h *proxyHandler) auditObserved(r *http.Request, scope *types.ScopeContext, schema types.SchemaType, u usage, start time.Time) {
+	if u.In > 0 || u.Out > 0 {
+		h.audit(r, scope, schema, u, false, start)
+	}
+}
+
+// hashText returns the hex SHA-256 of s, or "" for an empty string
+func hashText(s string) string {
+	if s == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,273 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/braw-dev/memex/internal/store"
+	"github.com/braw-dev/memex/pkg/types"
+)
+
+// MCP JSON-RPC methods whose results may be cached
+const (
+	mcpMethodToolsCall     = "tools/call"
+	mcpMethodResourcesRead = "resources/read"
+	mcpMethodPromptsGet    = "prompts/get"
+)
+
+// mcpSessionHeader is the Streamable HTTP session header, passed through untouched
+const mcpSessionHeader = "Mcp-Session-Id"
+
+// mcpRequest is a single JSON-RPC request sent over MCP's Streamable HTTP transport
+type mcpRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// mcpParams holds the parameters of the cacheable methods
+type mcpParams struct {
+	// Name is the tool (tools/call) or prompt (prompts/get) name
+	Name string `json:"name"`
+	// URI is the resource URI (resources/read)
+	URI       string          `json:"uri"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// mcpResponse is a JSON-RPC response message
+type mcpResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   json.RawMessage `json:"error,omitempty"`
+}
+
+// parseMCPRequest parses a JSON-RPC request body.
+// It returns false for anything that is not a single JSON-RPC 2.0 request (including batches).
+func parseMCPRequest(body []byte) (*mcpRequest, bool) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 || body[0] != '{' {
+		return nil, false
+	}
+	var req mcpRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, false
+	}
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		return nil, false
+	}
+	return &req, true
+}
+
+// params decodes the request parameters of a cacheable method
+func (m *mcpRequest) params() (*mcpParams, error) {
+	var p mcpParams
+	if len(m.Params) == 0 {
+		return &p, nil
+	}
+	if err := json.Unmarshal(m.Params, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// isNotification reports whether the request expects no response
+func (m *mcpRequest) isNotification() bool {
+	return len(m.ID) == 0 || string(m.ID) == "null"
+}
+
+// mcpFingerprint identifies a cacheable request by server, method, name and canonical arguments.
+// The JSON-RPC id and session headers are deliberately excluded.
+func mcpFingerprint(server string, req *mcpRequest) ([]byte, error) {
+	p, err := req.params()
+	if err != nil {
+		return nil, err
+	}
+	args, err := canonicalJSON(p.Arguments)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	for _, part := range []string{"mcp", server, req.Method, p.Name, p.URI} {
+		b.WriteString(part)
+		b.WriteByte(0)
+	}
+	b.Write(args)
+	return b.Bytes(), nil
+}
+
+// canonicalJSON re-encodes JSON with sorted object keys and no insignificant whitespace
+func canonicalJSON(raw json.RawMessage) ([]byte, error) {
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return []byte("null"), nil
+	}
+	var v any
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// mcpServerID identifies the upstream MCP server of a request
+func mcpServerID(r *http.Request) string {
+	host := r.URL.Host
+	if host == "" {
+		host = r.Host
+	}
+	return host + r.URL.Path
+}
+
+// extractMCPResult finds the successful result for the request id in an upstream response body,
+// which is either a single JSON object or an SSE stream of JSON-RPC messages.
+func extractMCPResult(contentType string, body []byte, id json.RawMessage) (json.RawMessage, bool) {
+	if strings.HasPrefix(contentType, "text/event-stream") {
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		scanner.Buffer(make([]byte, 0, 64*1024), len(body)+1)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data:")
+			if !ok {
+				continue
+			}
+			if result, ok := mcpResult([]byte(strings.TrimSpace(data)), id); ok {
+				return result, true
+			}
+		}
+		return nil, false
+	}
+	return mcpResult(body, id)
+}
+
+func mcpResult(msg []byte, id json.RawMessage) (json.RawMessage, bool) {
+	var resp mcpResponse
+	if err := json.Unmarshal(msg, &resp); err != nil {
+		return nil, false
+	}
+	if !bytes.Equal(resp.ID, id) || len(resp.Error) > 0 || len(resp.Result) == 0 {
+		return nil, false
+	}
+	// Tool execution failures are reported in-band and must not be cached
+	var status struct {
+		IsError bool `json:"isError"`
+	}
+	if err := json.Unmarshal(resp.Result, &status); err == nil && status.IsError {
+		return nil, false
+	}
+	return resp.Result, true
+}
+
+// mcpResultResponse wraps a cached result in a JSON-RPC response for the given request id
+func mcpResultResponse(id, result json.RawMessage) ([]byte, error) {
+	return json.Marshal(mcpResponse{JSONRPC: "2.0", ID: id, Result: result})
+}
+
+// handleMCP serves cacheable MCP requests from the cache and records the results of misses.
+// It returns false when the request is not cacheable and should be proxied as usual.
+func (h *proxyHandler) handleMCP(w http.ResponseWriter, r *http.Request) bool {
+	scope := FromContext(r.Context())
+	if h.store == nil || scope == nil {
+		return false
+	}
+	body, err := peekBody(r)
+	if err != nil {
+		return false
+	}
+	req, ok := parseMCPRequest(body)
+	if !ok {
+		return false
+	}
+	server := mcpServerID(r)
+	// Let the transport negotiate compression so captured bodies are plain text
+	r.Header.Del("Accept-Encoding")
+
+	if req.Method == mcpMethodToolsList && !req.isNotification() {
+		cw := &captureWriter{ResponseWriter: w}
+		h.proxy.ServeHTTP(cw, r)
+		if result, ok := extractMCPResult(cw.Header().Get("Content-Type"), cw.body.Bytes(), req.ID); ok && cw.status == http.StatusOK && !cw.overflow {
+			h.mcpPolicy.observeToolsList(server, result)
+		}
+		return true
+	}
+	cacheable, ttl := h.mcpPolicy.cacheable(server, req)
+	if !cacheable {
+		return false
+	}
+	fingerprint, err := mcpFingerprint(server, req)
+	if err != nil {
+		return false
+	}
+
+	if resp, ok := lookupMCP(h.store, scope, fingerprint, req); ok {
+		if sid := r.Header.Get(mcpSessionHeader); sid != "" {
+			w.Header().Set(mcpSessionHeader, sid)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set(cacheStatusHeader, cacheStatusHit)
+		w.WriteHeader(http.StatusOK)
+		w.Write(resp)
+		return true
+	}
+
+	w.Header().Set(cacheStatusHeader, cacheStatusMiss)
+	cw := &captureWriter{ResponseWriter: w}
+	h.proxy.ServeHTTP(cw, r)
+	if cw.status != http.StatusOK || cw.overflow {
+		return true
+	}
+
+	if result, ok := extractMCPResult(cw.Header().Get("Content-Type"), cw.body.Bytes(), req.ID); ok {
+		storeMCP(h.store, h.secrets, scope, fingerprint, result, ttl)
+	}
+	return true
+}
+
+// lookupMCP returns a JSON-RPC response for req built from a cached result, if there is one
+func lookupMCP(st *store.Store, scope *types.ScopeContext, fingerprint []byte, req *mcpRequest) ([]byte, bool) {
+	entry, err := LookupCache(st, scope, fingerprint)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.Error("MCP cache lookup failed", "err", err)
+		}
+		return nil, false
+	}
+	resp, err := mcpResultResponse(req.ID, entry.ResponseBlob)
+	if err != nil {
+		return nil, false
+	}
+	slog.Debug("MCP cache hit", "method", req.Method, "scope", entry.ScopeID)
+	return resp, true
+}
+
+// storeMCP records a successful result in the scope, expiring after ttl when it is positive.
+// Secrets in the result are redacted, or the result is not stored, as the scanner decides.
+func storeMCP(st *store.Store, secrets *secretScanner, scope *types.ScopeContext, fingerprint []byte, result json.RawMessage, ttl time.Duration) {
+	result, found, cacheable := secrets.filter(result)
+	if !cacheable {
+		slog.Warn("Not caching MCP result containing secrets", "count", found)
+		return
+	}
+	entry := &store.CacheEntry{
+		HashKey:      CacheKey(scope, fingerprint),
+		ScopeID:      scope.ID,
+		ResponseBlob: result,
+		Salt:         scope.Salt,
+	}
+	if ttl > 0 {
+		expires := time.Now().Add(ttl)
+		entry.ExpiresAt = &expires
+	}
+	err := st.SetCache(entry)
+	if err != nil {
+		slog.Error("Failed to cache MCP result", "err", err)
+	}
+}
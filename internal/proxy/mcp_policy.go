@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// mcpMethodToolsList lists a server's tools along with their annotations
+const mcpMethodToolsList = "tools/list"
+
+// mcpToolAnnotations are the behaviour hints a server declares for a tool
+type mcpToolAnnotations struct {
+	ReadOnlyHint    *bool `json:"readOnlyHint"`
+	DestructiveHint *bool `json:"destructiveHint"`
+	IdempotentHint  *bool `json:"idempotentHint"`
+}
+
+// cacheable reports whether the hints allow a tool's results to be reused.
+// Read-only tools are safe; idempotent tools only when they are not also destructive.
+func (a mcpToolAnnotations) cacheable() bool {
+	if a.ReadOnlyHint != nil && *a.ReadOnlyHint {
+		return true
+	}
+	if a.IdempotentHint != nil && *a.IdempotentHint {
+		return a.DestructiveHint != nil && !*a.DestructiveHint
+	}
+	return false
+}
+
+// mcpPolicy decides which MCP requests are cached and for how long.
+// It combines the configuration with annotations observed in tools/list responses.
+type mcpPolicy struct {
+	config MCPConfig
+
+	mu    sync.RWMutex
+	tools map[string]map[string]mcpToolAnnotations // server ID -> tool name -> annotations
+}
+
+func newMCPPolicy(config MCPConfig) *mcpPolicy {
+	return &mcpPolicy{
+		config: config,
+		tools:  make(map[string]map[string]mcpToolAnnotations),
+	}
+}
+
+// cacheable reports whether the request's result may be served from the cache,
+// and the TTL to store it with (0 never expires)
+func (p *mcpPolicy) cacheable(server string, req *mcpRequest) (bool, time.Duration) {
+	if req.isNotification() {
+		return false, 0
+	}
+	srv := p.server(server)
+	ttl := p.config.TTL
+	if srv != nil && srv.TTL > 0 {
+		ttl = srv.TTL
+	}
+
+	switch req.Method {
+	case mcpMethodToolsCall:
+		params, err := req.params()
+		if err != nil || params.Name == "" {
+			return false, 0
+		}
+		if !p.toolCacheable(server, srv, params.Name) {
+			return false, 0
+		}
+		if srv != nil {
+			for _, rule := range srv.Tools {
+				if globMatch(rule.Name, params.Name) {
+					if rule.TTL > 0 {
+						ttl = rule.TTL
+					}
+					break
+				}
+			}
+		}
+		return true, ttl
+	case mcpMethodResourcesRead:
+		return p.config.CacheResources, ttl
+	case mcpMethodPromptsGet:
+		return p.config.CachePrompts, ttl
+	default:
+		return false, 0
+	}
+}
+
+// toolCacheable applies deny lists, then allow lists, then the server's annotations
+func (p *mcpPolicy) toolCacheable(server string, srv *MCPServerPolicy, tool string) bool {
+	if srv != nil && matchesAny(srv.Deny, tool) {
+		return false
+	}
+	if matchesAny(p.config.DenyTools, tool) {
+		return false
+	}
+	if srv != nil && matchesAny(srv.Allow, tool) {
+		return true
+	}
+	if matchesAny(p.config.IdempotentTools, tool) {
+		return true
+	}
+	if trust := p.config.TrustAnnotations; trust != nil && !*trust {
+		return false
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	annotations, ok := p.tools[server][tool]
+	return ok && annotations.cacheable()
+}
+
+// server returns the first per-server override matching the server ID
+func (p *mcpPolicy) server(server string) *MCPServerPolicy {
+	for i := range p.config.Servers {
+		if globMatch(p.config.Servers[i].Server, server) {
+			return &p.config.Servers[i]
+		}
+	}
+	return nil
+}
+
+// observeToolsList records the tool annotations from a tools/list result
+func (p *mcpPolicy) observeToolsList(server string, result json.RawMessage) {
+	var list struct {
+		Tools []struct {
+			Name        string             `json:"name"`
+			Annotations mcpToolAnnotations `json:"annotations"`
+		} `json:"tools"`
+	}
+	if err := json.Unmarshal(result, &list); err != nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	tools, ok := p.tools[server]
+	if !ok {
+		tools = make(map[string]mcpToolAnnotations)
+		p.tools[server] = tools
+	}
+	for _, tool := range list.Tools {
+		tools[tool.Name] = tool.Annotations
+	}
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if globMatch(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
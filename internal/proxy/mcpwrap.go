@@ -0,0 +1,226 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/braw-dev/memex/internal/store"
+	"github.com/braw-dev/memex/pkg/types"
+)
+
+// MCPWrapper runs a stdio MCP server as a child process and relays newline-delimited
+// JSON-RPC between it and the client, answering cacheable requests from the store.
+type MCPWrapper struct {
+	config  *ProxyConfig
+	store   *store.Store
+	policy  *mcpPolicy
+	secrets *secretScanner
+	command []string
+	stderr  io.Writer
+}
+
+// NewMCPWrapper creates a wrapper for the server started by command.
+// A nil store relays every message without caching.
+func NewMCPWrapper(config *ProxyConfig, st *store.Store, command []string) *MCPWrapper {
+	secrets, err := newSecretScanner(config.Cache.Secrets)
+	if err != nil {
+		slog.Error("Ignoring invalid secret scrubbing settings", "err", err)
+	}
+	return &MCPWrapper{
+		config:  config,
+		store:   st,
+		policy:  newMCPPolicy(config.MCP),
+		secrets: secrets,
+		command: command,
+		stderr:  os.Stderr,
+	}
+}
+
+// pendingCall is a forwarded request whose response the wrapper needs to see
+type pendingCall struct {
+	// toolsList marks a tools/list request, whose annotations feed the cache policy
+	toolsList   bool
+	scope       *types.ScopeContext
+	fingerprint []byte
+	ttl         time.Duration
+}
+
+// Run starts the server and relays messages until the server's output ends
+func (m *MCPWrapper) Run(ctx context.Context, stdin io.Reader, stdout io.Writer) error {
+	if len(m.command) == 0 {
+		return errors.New("no MCP server command given")
+	}
+
+	var scope *types.ScopeContext
+	if m.store != nil {
+		cwd, err := os.Getwd()
+		if err != nil {
+			cwd = "."
+		}
+		scope, err = DetectScopeWithRules(cwd, m.config.Scope.SubScopes)
+		if err != nil {
+			slog.Debug("Error detecting scope", "err", err)
+		}
+	}
+
+	cmd := exec.CommandContext(ctx, m.command[0], m.command[1:]...)
+	cmd.Stderr = m.stderr
+	serverIn, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("failed to open server stdin: %w", err)
+	}
+	serverOut, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to open server stdout: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start MCP server: %w", err)
+	}
+
+	serverID := "stdio:" + strings.Join(m.command, " ")
+	out := &lineWriter{w: stdout}
+	var mu sync.Mutex
+	pending := make(map[string]pendingCall)
+
+	// Server -> client
+	relayed := make(chan struct{})
+	go func() {
+		defer close(relayed)
+		r := bufio.NewReader(serverOut)
+		for {
+			line, err := r.ReadBytes('\n')
+			if len(line) > 0 {
+				var resp mcpResponse
+				if json.Unmarshal(line, &resp) == nil && len(resp.ID) > 0 {
+					mu.Lock()
+					call, ok := pending[string(resp.ID)]
+					delete(pending, string(resp.ID))
+					mu.Unlock()
+					if result, found := mcpResult(line, resp.ID); ok && found {
+						if call.toolsList {
+							m.policy.observeToolsList(serverID, result)
+						} else {
+							storeMCP(m.store, m.secrets, call.scope, call.fingerprint, result, call.ttl)
+						}
+					}
+				}
+				if err := out.writeLine(line); err != nil {
+					slog.Error("Failed to write to MCP client", "err", err)
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// Client -> server
+	go func() {
+		defer serverIn.Close()
+		r := bufio.NewReader(stdin)
+		for {
+			line, err := r.ReadBytes('\n')
+			if len(bytes.TrimSpace(line)) > 0 {
+				if resp, call, ok := m.lookup(scope, serverID, line); ok {
+					if err := out.writeLine(resp); err != nil {
+						slog.Error("Failed to write to MCP client", "err", err)
+					}
+				} else {
+					if call != nil {
+						mu.Lock()
+						pending[call.id] = call.pendingCall
+						mu.Unlock()
+					}
+					if _, err := serverIn.Write(line); err != nil {
+						slog.Error("Failed to write to MCP server", "err", err)
+						return
+					}
+				}
+			}
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					slog.Error("Failed to read from MCP client", "err", err)
+				}
+				return
+			}
+		}
+	}()
+
+	// The server exits once the client closes stdin (or on its own); either way we are done
+	// when its output ends.
+	<-relayed
+	return cmd.Wait()
+}
+
+// trackedCall is a cacheable request identified by its JSON-RPC id
+type trackedCall struct {
+	pendingCall
+	id string
+}
+
+// lookup answers a client message from the cache. Otherwise it returns the call to track
+// when the wrapper needs the server's response: to record a result or observe tools/list.
+func (m *MCPWrapper) lookup(scope *types.ScopeContext, serverID string, line []byte) ([]byte, *trackedCall, bool) {
+	if m.store == nil || scope == nil {
+		return nil, nil, false
+	}
+	req, ok := parseMCPRequest(line)
+	if !ok {
+		return nil, nil, false
+	}
+	if req.Method == mcpMethodToolsList && !req.isNotification() {
+		return nil, &trackedCall{pendingCall: pendingCall{toolsList: true}, id: string(req.ID)}, false
+	}
+	cacheable, ttl := m.policy.cacheable(serverID, req)
+	if !cacheable {
+		return nil, nil, false
+	}
+	fingerprint, err := mcpFingerprint(serverID, req)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	if req.Method == mcpMethodToolsCall {
+		if p, err := req.params(); err == nil && IsSharedTool(p.Name, m.config.Scope.Shared) {
+			scope = GlobalScope
+		}
+	}
+
+	if resp, ok := lookupMCP(m.store, scope, fingerprint, req); ok {
+		return resp, nil, true
+	}
+	return nil, &trackedCall{
+		pendingCall: pendingCall{scope: scope, fingerprint: fingerprint, ttl: ttl},
+		id:          string(req.ID),
+	}, false
+}
+
+// lineWriter serialises newline-terminated messages from concurrent relays
+type lineWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lineWriter) writeLine(line []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(line); err != nil {
+		return err
+	}
+	if !bytes.HasSuffix(line, []byte("\n")) {
+		_, err := l.w.Write([]byte("\n"))
+		return err
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"log/slog"
 	"net/http"
 	"os"
@@ -16,18 +17,28 @@ func ScopeMiddleware(next http.Handler, config *ProxyConfig) http.Handler {
 		cwd = "."
 	}
 
-	scope, err := DetectScope(cwd)
+	scope, err := DetectScopeWithRules(cwd, config.Scope.SubScopes)
 	if err != nil {
 		slog.Debug("Error detecting scope", "err", err)
 	} else {
 		slog.Debug("Initialized Scope", "scope", scope)
 	}
 
+	detector := NewSchemaDetector()
+	shared := config.Scope.Shared
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if scope != nil {
-			ctx := WithScope(r.Context(), scope)
-			r = r.WithContext(ctx)
+		// The schema is detected once per request and kept for the handlers downstream
+		schema := detector.Detect(r)
+		ctx := context.WithValue(r.Context(), schemaContextKey, schema)
+		reqScope := scope
+		if IsShared(r, schema, shared) {
+			reqScope = GlobalScope
+			slog.Debug("Using global scope for shared request", "path", r.URL.Path)
+		}
+		if reqScope != nil {
+			ctx = WithScope(ctx, reqScope)
 		}
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/braw-dev/memex/pkg/types"
+)
+
+// normalizePresets are built-in rules for the volatile parts of popular clients' system prompts
+var normalizePresets = map[string][]NormalizeRule{
+	// Claude Code embeds the date and a git status snapshot (branch, status, recent commits)
+	"claude-code": {
+		{Name: "date", Pattern: `(?m)^Today's date: .*$`},
+		{Name: "git-status", Section: "gitStatus: "},
+	},
+	// dates masks calendar dates and timestamps anywhere in the system prompt
+	"dates": {
+		{Name: "timestamp", Pattern: `\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}(:\d{2}(\.\d+)?)?(Z|[+-]\d{2}:?\d{2})?`},
+		{Name: "date", Pattern: `\b\d{4}-\d{2}-\d{2}\b`},
+	},
+}
+
+// maskedSection is a part of a system prompt replaced before hashing
+type maskedSection struct {
+	Rule string
+	Text string
+}
+
+// promptRule is a compiled NormalizeRule
+type promptRule struct {
+	name  string
+	re    *regexp.Regexp
+	start string
+	end   string
+}
+
+// promptNormalizer masks volatile sections of system prompts so that prompts whose
+// instructions are identical hash the same
+type promptNormalizer struct {
+	rules []promptRule
+}
+
+// newPromptNormalizer compiles the configured presets and rules. Invalid rules are
+// reported in the error and left out of the returned normalizer.
+func newPromptNormalizer(config NormalizeConfig) (*promptNormalizer, error) {
+	n := &promptNormalizer{}
+	var errs []error
+	add := func(prefix string, rule NormalizeRule) {
+		name := prefix + rule.Name
+		switch {
+		case rule.Pattern != "":
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("normalize rule %s: %w", name, err))
+				return
+			}
+			n.rules = append(n.rules, promptRule{name: name, re: re})
+		case rule.Section != "":
+			n.rules = append(n.rules, promptRule{name: name, start: rule.Section, end: rule.End})
+		default:
+			errs = append(errs, fmt.Errorf("normalize rule %s: needs a pattern or a section", name))
+		}
+	}
+	for _, preset := range config.Presets {
+		rules, ok := normalizePresets[preset]
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown normalize preset %q", preset))
+			continue
+		}
+		for _, rule := range rules {
+			add(preset+":", rule)
+		}
+	}
+	for _, rule := range config.Rules {
+		add("", rule)
+	}
+	return n, errors.Join(errs...)
+}
+
+// mask replaces the volatile sections of text with a placeholder naming the rule
+func (n *promptNormalizer) mask(text string) (string, []maskedSection) {
+	var masked []maskedSection
+	for _, rule := range n.rules {
+		placeholder := "[masked:" + rule.name + "]"
+		if rule.re != nil {
+			text = rule.re.ReplaceAllStringFunc(text, func(match string) string {
+				masked = append(masked, maskedSection{Rule: rule.name, Text: match})
+				return placeholder
+			})
+			continue
+		}
+		text = maskSections(text, rule.start, rule.end, func(section string) string {
+			masked = append(masked, maskedSection{Rule: rule.name, Text: section})
+			return placeholder
+		})
+	}
+	return text, masked
+}
+
+// maskSections replaces each section running from start up to and including end
+// (or to the end of the text when end is empty or missing)
+func maskSections(text, start, end string, replace func(string) string) string {
+	var b strings.Builder
+	for {
+		i := strings.Index(text, start)
+		if i < 0 {
+			b.WriteString(text)
+			return b.String()
+		}
+		b.WriteString(text[:i])
+		rest := text[i:]
+		j := len(rest)
+		if end != "" {
+			if k := strings.Index(rest[len(start):], end); k >= 0 {
+				j = len(start) + k + len(end)
+			}
+		}
+		b.WriteString(replace(rest[:j]))
+		text = rest[j:]
+	}
+}
+
+// normalize masks the system prompt of a conversation, including OpenAI system and
+// developer messages, and returns what was masked
+func (n *promptNormalizer) normalize(c *types.Conversation) []maskedSection {
+	if n == nil || len(n.rules) == 0 {
+		return nil
+	}
+	var masked []maskedSection
+	maskBlocks := func(blocks []types.ContentBlock) {
+		for i := range blocks {
+			if blocks[i].Type != types.BlockText {
+				continue
+			}
+			var m []maskedSection
+			blocks[i].Text, m = n.mask(blocks[i].Text)
+			masked = append(masked, m...)
+		}
+	}
+	maskBlocks(c.System)
+	for i := range c.Messages {
+		if c.Messages[i].Role == types.RoleSystem || c.Messages[i].Role == types.RoleDeveloper {
+			maskBlocks(c.Messages[i].Content)
+		}
+	}
+	return masked
+}
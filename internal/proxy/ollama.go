@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/braw-dev/memex/pkg/types"
+)
+
+// ollamaCodec handles Ollama's native /api/chat and /api/generate endpoints.
+// Ollama streams by default, as newline-delimited JSON rather than SSE.
+type ollamaCodec struct{}
+
+// ollamaRecord is a complete response, or one record of a streamed response.
+// /api/chat answers in message and /api/generate in response.
+type ollamaRecord struct {
+	Message struct {
+		Content   string `json:"content"`
+		ToolCalls []struct {
+			Function struct {
+				Name      string          `json:"name"`
+				Arguments json.RawMessage `json:"arguments"`
+			} `json:"function"`
+		} `json:"tool_calls"`
+	} `json:"message"`
+	Response        string `json:"response"`
+	Done            bool   `json:"done"`
+	DoneReason      string `json:"done_reason"`
+	PromptEvalCount int    `json:"prompt_eval_count"`
+	EvalCount       int    `json:"eval_count"`
+}
+
+func (ollamaCodec) fingerprint(r *http.Request, body []byte) ([]byte, string, error) {
+	// keep_alive only controls how long the model stays loaded
+	m, err := canonicalBody(body, "keep_alive")
+	if err != nil {
+		return nil, "", err
+	}
+	system := []string{contentText(m["system"])}
+	if messages, ok := m["messages"].([]any); ok {
+		for _, msg := range messages {
+			if msg, ok := msg.(map[string]any); ok && msg["role"] == "system" {
+				system = append(system, contentText(msg["content"]))
+			}
+		}
+	}
+	// /api/chat and /api/generate take different bodies for the same model
+	fp, err := buildFingerprint(types.SchemaOllama, path.Base(r.URL.Path), m)
+	return fp, strings.TrimSpace(strings.Join(system, "\n")), err
+}
+
+func (ollamaCodec) usage(contentType string, body []byte) (usage, bool) {
+	for _, record := range ollamaRecords(body) {
+		if record.Done {
+			// Answers cut short by num_predict or the context window are not cached
+			return usage{In: record.PromptEvalCount, Out: record.EvalCount}, record.DoneReason != "length"
+		}
+	}
+	return usage{}, false
+}
+
+func (ollamaCodec) answer(contentType string, body []byte) string {
+	var b strings.Builder
+	for _, record := range ollamaRecords(body) {
+		b.WriteString(record.Message.Content)
+		b.WriteString(record.Response)
+		for _, call := range record.Message.ToolCalls {
+			b.WriteString(call.Function.Name + " ")
+			b.Write(call.Function.Arguments)
+		}
+	}
+	return b.String()
+}
+
+// ollamaRecords parses the records of a response; a complete response is a single record
+func ollamaRecords(body []byte) []ollamaRecord {
+	var records []ollamaRecord
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(body)+1)
+	for scanner.Scan() {
+		var record ollamaRecord
+		if json.Unmarshal(scanner.Bytes(), &record) == nil {
+			records = append(records, record)
+		}
+	}
+	return records
+}
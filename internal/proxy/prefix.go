@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/braw-dev/memex/internal/store"
+	"github.com/braw-dev/memex/pkg/types"
+)
+
+// prefixRoot hashes the setup of a conversation: its model, system prompt and tools
+func prefixRoot(c *types.Conversation) []byte {
+	root := sha256.New()
+	root.Write([]byte(c.Model))
+	root.Write([]byte{0})
+	root.Write([]byte(c.SystemText()))
+	root.Write([]byte{0})
+	if tools, err := json.Marshal(c.Tools); err == nil {
+		root.Write(tools)
+	}
+	return root.Sum(nil)
+}
+
+// prefixHashes returns the cumulative hash of each leading run of messages of a
+// conversation, shortest first. The chain is rooted at the model, system prompt and
+// tools, so conversations only share prefixes when their setup is identical.
+func prefixHashes(c *types.Conversation) []string {
+	prev := prefixRoot(c)
+
+	hashes := make([]string, 0, len(c.Messages))
+	for _, msg := range c.Messages {
+		if msg.Role == types.RoleSystem || msg.Role == types.RoleDeveloper {
+			continue
+		}
+		data, err := json.Marshal(struct {
+			Role    types.Role
+			Content []types.ContentBlock
+		}{msg.Role, resultContent(msg.Content)})
+		if err != nil {
+			break
+		}
+		h := sha256.New()
+		h.Write(prev)
+		h.Write(data)
+		prev = h.Sum(nil)
+		hashes = append(hashes, hex.EncodeToString(prev))
+	}
+	return hashes
+}
+
+// contextHash returns the prefix hash of the history a conversation's final user turn
+// continues, or the hash of its setup for a first turn. Answers to similar prompts only
+// fit a request that continues the same history.
+func contextHash(c *types.Conversation) string {
+	history := *c
+	history.Messages = c.Messages[:finalUserTurn(c.Messages)]
+	if hashes := prefixHashes(&history); len(hashes) > 0 {
+		return hashes[len(hashes)-1]
+	}
+	return hex.EncodeToString(prefixRoot(c))
+}
+
+// requestConversation parses a completion request into a Conversation, once per request.
+// A turn that must not be cached is returned along with the error, so its prefixes are
+// still tracked.
+func (h *proxyHandler) requestConversation(r *http.Request, schema types.SchemaType) (*types.Conversation, error) {
+	codec, ok := h.codec(schema)
+	if !ok {
+		return nil, nil
+	}
+	cc, ok := codec.(conversationCodec)
+	if !ok {
+		return nil, nil
+	}
+	body, err := peekBody(r)
+	if err != nil {
+		return nil, err
+	}
+	return cc.conversation(body)
+}
+
+// trackPrefix matches a conversation against the scope's prefix trie, records its new
+// prefixes and fills in the audit log's message count and prefix depth
+func (h *proxyHandler) trackPrefix(log *store.AuditLog, hashes []string) {
+	depth, err := h.store.MatchPrefix(log.ScopeID, hashes)
+	if err != nil {
+		slog.Error("Failed to match conversation prefix", "err", err)
+		return
+	}
+	log.MessageCount, log.PrefixDepth = len(hashes), depth
+	if depth > 0 {
+		slog.Debug("Conversation shares a cached prefix", "scope", log.ScopeID, "depth", depth, "messages", len(hashes))
+	}
+	if err := h.store.RecordPrefixes(log.ScopeID, hashes, depth); err != nil {
+		slog.Error("Failed to record conversation prefix", "err", err)
+	}
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/braw-dev/memex/internal/store"
+	"github.com/braw-dev/memex/pkg/types"
+)
+
+// responsesRetention is how long OpenAI keeps stored responses. Cached responses expire with
+// it so a replayed response id is still valid upstream when the client chains onto it.
+const responsesRetention = 30 * 24 * time.Hour
+
+// responsesCodec handles the OpenAI Responses API.
+//
+// previous_response_id references server-side state memex never saw, so a chained request
+// is only cacheable when the referenced response was itself recorded by memex. The id is
+// then replaced by that response's content key, making the fingerprint cover the whole chain.
+type responsesCodec struct {
+	store *store.Store
+}
+
+// responsesObject is a Responses API response, or the response carried by a stream event
+type responsesObject struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Output []struct {
+		Type      string `json:"type"`
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+		Content   []struct {
+			Text string `json:"text"`
+		} `json:"content"`
+	} `json:"output"`
+	Usage map[string]any `json:"usage"`
+}
+
+func (c responsesCodec) fingerprint(r *http.Request, body []byte) ([]byte, string, error) {
+	m, err := canonicalBody(body, "user", "metadata")
+	if err != nil {
+		return nil, "", err
+	}
+
+	if prev, ok := m["previous_response_id"].(string); ok && prev != "" {
+		scope := FromContext(r.Context())
+		if scope == nil {
+			return nil, "", fmt.Errorf("previous response %s cannot be resolved without a scope", prev)
+		}
+		key, err := c.store.GetResponseChain(scope.ID, prev)
+		if err != nil {
+			return nil, "", fmt.Errorf("previous response %s was not recorded by memex: %w", prev, err)
+		}
+		m["previous_response_id"] = "memex:" + key
+	}
+
+	system := []string{contentText(m["instructions"])}
+	if items, ok := m["input"].([]any); ok {
+		for _, item := range items {
+			item, ok := item.(map[string]any)
+			if !ok {
+				continue
+			}
+			if role := item["role"]; role == "system" || role == "developer" {
+				system = append(system, contentText(item["content"]))
+			}
+		}
+	}
+
+	fp, err := buildFingerprint(types.SchemaOpenAIResponses, "", m)
+	return fp, strings.TrimSpace(strings.Join(system, "\n")), err
+}
+
+func (c responsesCodec) usage(contentType string, body []byte) (usage, bool) {
+	resp, ok := responsesFinal(contentType, body)
+	if !ok {
+		return usage{}, false
+	}
+	return usage{In: jsonInt(resp.Usage, "input_tokens"), Out: jsonInt(resp.Usage, "output_tokens")}, true
+}
+
+func (c responsesCodec) cacheTTL() time.Duration {
+	return responsesRetention
+}
+
+// answer reads JSON responses from their output items and streams from their text and
+// function call argument deltas
+func (c responsesCodec) answer(contentType string, body []byte) string {
+	var b strings.Builder
+	if !isEventStream(contentType) {
+		var resp responsesObject
+		json.Unmarshal(body, &resp)
+		for _, item := range resp.Output {
+			for _, part := range item.Content {
+				b.WriteString(part.Text)
+			}
+			if item.Type == "function_call" {
+				b.WriteString(item.Name + " " + item.Arguments)
+			}
+		}
+		return b.String()
+	}
+	forEachSSE(body, func(event, data string) {
+		var msg struct {
+			Type  string `json:"type"`
+			Delta string `json:"delta"`
+		}
+		if json.Unmarshal([]byte(data), &msg) != nil {
+			return
+		}
+		switch msg.Type {
+		case "response.output_text.delta", "response.function_call_arguments.delta":
+			b.WriteString(msg.Delta)
+		}
+	})
+	return b.String()
+}
+
+// cached records the response id so later requests of the scope can chain onto it
+func (c responsesCodec) cached(scope *types.ScopeContext, fingerprint []byte, contentType string, body []byte) {
+	resp, ok := responsesFinal(contentType, body)
+	if !ok || resp.ID == "" {
+		return
+	}
+	sum := sha256.Sum256(fingerprint)
+	if err := c.store.SetResponseChain(scope.ID, resp.ID, hex.EncodeToString(sum[:])); err != nil {
+		slog.Error("Failed to record response chain", "err", err)
+	}
+}
+
+// responsesFinal returns the completed response from a JSON body or the
+// response.completed event of a stream. Failed and incomplete responses are rejected.
+func responsesFinal(contentType string, body []byte) (*responsesObject, bool) {
+	if !isEventStream(contentType) {
+		var resp responsesObject
+		if err := json.Unmarshal(body, &resp); err != nil || resp.Status != "completed" {
+			return nil, false
+		}
+		return &resp, true
+	}
+
+	var final *responsesObject
+	forEachSSE(body, func(event, data string) {
+		var msg struct {
+			Type     string          `json:"type"`
+			Response responsesObject `json:"response"`
+		}
+		if json.Unmarshal([]byte(data), &msg) != nil {
+			return
+		}
+		if msg.Type == "response.completed" {
+			final = &msg.Response
+		}
+	})
+	return final, final != nil
+}
@@ -15,7 +15,8 @@ func NewSchemaDetector() *SchemaDetector {
 	return &SchemaDetector{}
 }
 
-// Detect identifies the schema type based on the request URL path
+// Detect identifies the schema type based on the request URL path,
+// falling back to the body for JSON-RPC messages of MCP's Streamable HTTP transport
 func (d *SchemaDetector) Detect(r *http.Request) types.SchemaType {
 	path := r.URL.Path
 
@@ -24,10 +25,54 @@ func (d *SchemaDetector) Detect(r *http.Request) types.SchemaType {
 		return types.SchemaAnthropic
 	}
 
+	// Detect Anthropic token counting
+	if strings.HasSuffix(path, "/v1/messages/count_tokens") {
+		return types.SchemaAnthropicCountTokens
+	}
+
+	// Detect Anthropic Message Batches (creation, retrieval and results)
+	if strings.Contains(path, batchesPath) {
+		return types.SchemaAnthropicBatches
+	}
+
+	// Detect model listing (Anthropic and OpenAI share the path)
+	if strings.HasSuffix(path, "/v1/models") && r.Method == http.MethodGet {
+		return types.SchemaModels
+	}
+
 	// Detect OpenAI
 	if strings.HasSuffix(path, "/v1/chat/completions") {
 		return types.SchemaOpenAI
 	}
 
+	// Detect OpenAI-compatible embeddings
+	if strings.HasSuffix(path, "/v1/embeddings") {
+		return types.SchemaEmbeddings
+	}
+
+	// Detect OpenAI Responses
+	if strings.HasSuffix(path, "/v1/responses") {
+		return types.SchemaOpenAIResponses
+	}
+
+	// Detect Gemini (e.g. /v1beta/models/gemini-2.0-flash:streamGenerateContent)
+	if strings.HasSuffix(path, ":generateContent") || strings.HasSuffix(path, ":streamGenerateContent") {
+		return types.SchemaGemini
+	}
+
+	// Detect Ollama
+	if strings.HasSuffix(path, "/api/chat") || strings.HasSuffix(path, "/api/generate") {
+		return types.SchemaOllama
+	}
+
+	// Detect MCP (Streamable HTTP posts JSON-RPC to a single endpoint of any path)
+	if r.Method == http.MethodPost {
+		if body, err := peekBodyLimit(r, maxMCPPeekBytes); err == nil {
+			if _, ok := parseMCPRequest(body); ok {
+				return types.SchemaMCP
+			}
+		}
+	}
+
 	return types.SchemaUnknown
 }
@@ -5,7 +5,9 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"path"
 	"path/filepath"
+	"strings"
 
 	"github.com/braw-dev/memex/pkg/types"
 	"github.com/go-git/go-git/v5"
@@ -18,56 +20,138 @@ func DetectScope(path string) (*types.ScopeContext, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to get absolute path: %w", err)
 	}
+	// Only a repository root is recognised, so a sub-directory gets its own path hash
+	if r, err := git.PlainOpen(absPath); err == nil {
+		if scope := remoteScope(r); scope != nil {
+			return scope, nil
+		}
+	}
+	return pathHashScope(absPath), nil
+}
 
-	// Try to open git repo
-	// We use PlainOpen which searches for .git in the path
-	r, err := git.PlainOpen(absPath)
-	if err == nil {
-		// Repo found, check remotes
-		remotes, err := r.Remotes()
-		if err == nil {
-			// Find 'origin'
-			for _, remote := range remotes {
-				if remote.Config().Name == "origin" {
-					urls := remote.Config().URLs
-					if len(urls) > 0 {
-						return &types.ScopeContext{
-							ID:   urls[0],
-							Type: types.ScopeTypeGitRemote,
-							Salt: generateSalt(urls[0]),
-						}, nil
-					}
-				}
-			}
-			// If no origin, try upstream
-			for _, remote := range remotes {
-				if remote.Config().Name == "upstream" {
-					urls := remote.Config().URLs
-					if len(urls) > 0 {
-						return &types.ScopeContext{
-							ID:   urls[0],
-							Type: types.ScopeTypeGitRemote,
-							Salt: generateSalt(urls[0]),
-						}, nil
+// DetectScopeWithRules determines the scope context like DetectScope, unless the path lies
+// under a repository directory matching one of rules: then it is that directory's
+// sub-scope. Paths no rule matches keep the scope DetectScope derives, so configuring
+// rules never changes the scope, or the cache keys, of other directories.
+func DetectScopeWithRules(path string, rules []SubScopeRule) (*types.ScopeContext, error) {
+	scope, err := DetectScope(path)
+	if err != nil || len(rules) == 0 {
+		return scope, err
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute path: %w", err)
+	}
+
+	// DetectDotGit walks up from path so sub-directories resolve to the repository root
+	r, err := git.PlainOpenWithOptions(absPath, &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return scope, nil
+	}
+	root := absPath
+	if wt, err := r.Worktree(); err == nil {
+		root = wt.Filesystem.Root()
+	}
+	rel, err := filepath.Rel(root, absPath)
+	if err != nil {
+		return scope, nil
+	}
+
+	repo := remoteScope(r)
+	if repo == nil {
+		repo = pathHashScope(root)
+	}
+	if sub := applySubScopeRules(repo, filepath.ToSlash(rel), rules); sub.Type == types.ScopeTypeSubdir {
+		return sub, nil
+	}
+	return scope, nil
+}
+
+// remoteScope returns the scope for the origin (or upstream) remote, or nil if neither exists.
+func remoteScope(r *git.Repository) *types.ScopeContext {
+	remotes, err := r.Remotes()
+	if err != nil {
+		return nil
+	}
+
+	// Find 'origin', then 'upstream'
+	for _, name := range []string{"origin", "upstream"} {
+		for _, remote := range remotes {
+			if remote.Config().Name == name {
+				urls := remote.Config().URLs
+				if len(urls) > 0 {
+					return &types.ScopeContext{
+						ID:   urls[0],
+						Type: types.ScopeTypeGitRemote,
+						Salt: ScopeSalt(urls[0]),
 					}
 				}
 			}
 		}
 	}
+	return nil
+}
 
-	// Fallback to path hash
+func pathHashScope(absPath string) *types.ScopeContext {
 	hash := sha256.Sum256([]byte(absPath))
 	hashStr := hex.EncodeToString(hash[:])
 
 	return &types.ScopeContext{
 		ID:   hashStr,
 		Type: types.ScopeTypePathHash,
-		Salt: hash[:], // Use raw hash bytes as salt
-	}, nil
+		Salt: ScopeSalt(hashStr),
+	}
 }
 
-func generateSalt(input string) []byte {
-	hash := sha256.Sum256([]byte(input))
+// applySubScopeRules returns the sub-directory scope of the first rule matching rel,
+// or base unchanged when none match.
+func applySubScopeRules(base *types.ScopeContext, rel string, rules []SubScopeRule) *types.ScopeContext {
+	if rel == "." || strings.HasPrefix(rel, "../") {
+		return base
+	}
+	segments := strings.Split(rel, "/")
+
+	for _, rule := range rules {
+		pattern := strings.Trim(rule.Pattern, "/")
+		n := len(strings.Split(pattern, "/"))
+		if pattern == "" || len(segments) < n {
+			continue
+		}
+		dir := strings.Join(segments[:n], "/")
+		if ok, err := path.Match(pattern, dir); err != nil || !ok {
+			continue
+		}
+
+		scope := subdirScope(base, dir)
+		switch parent := strings.Trim(rule.Parent, "/"); parent {
+		case "":
+		case ".":
+			scope.Parent = base
+		default:
+			scope.Parent = subdirScope(base, parent)
+		}
+		return scope
+	}
+	return base
+}
+
+func subdirScope(base *types.ScopeContext, dir string) *types.ScopeContext {
+	id := base.ID + "#" + dir
+	return &types.ScopeContext{
+		ID:   id,
+		Type: types.ScopeTypeSubdir,
+		Salt: ScopeSalt(id),
+	}
+}
+
+// ScopeSalt derives the salt of a scope from its ID. Every scope gets its salt from it,
+// so the salt of a stored scope ID can always be recomputed. A path hash ID is a SHA-256
+// already and is used as is; other IDs are hashed.
+func ScopeSalt(id string) []byte {
+	if salt, err := hex.DecodeString(id); err == nil && len(salt) == sha256.Size {
+		return salt
+	}
+	hash := sha256.Sum256([]byte(id))
 	return hash[:]
 }
 
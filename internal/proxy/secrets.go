@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+)
+
+// Secret scrubbing modes
+const (
+	secretsRedact = "redact"
+	secretsRefuse = "refuse"
+	secretsOff    = "off"
+)
+
+// entropyMinLen is the shortest value the entropy heuristic considers
+const entropyMinLen = 20
+
+// secretPatterns detect common credential formats. The JSON escapes around them
+// (e.g. "\nAKIA...") rule out word boundaries on the left.
+var secretPatterns = []SecretPattern{
+	{Name: "private-key", Pattern: `-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`},
+	{Name: "anthropic-key", Pattern: `sk-ant-[a-z]+[0-9]{2}-[A-Za-z0-9_-]{40,}`},
+	{Name: "openai-key", Pattern: `sk-((proj|svcacct|admin)-[A-Za-z0-9_-]{40,}|[A-Za-z0-9]{40,})`},
+	{Name: "aws-access-key", Pattern: `(AKIA|ASIA)[0-9A-Z]{16}\b`},
+	{Name: "github-token", Pattern: `(gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})`},
+	{Name: "gitlab-token", Pattern: `glpat-[A-Za-z0-9_-]{20,}`},
+	{Name: "slack-token", Pattern: `xox[abposr]-[A-Za-z0-9-]{10,}`},
+	{Name: "google-api-key", Pattern: `AIza[0-9A-Za-z_-]{35}`},
+	{Name: "stripe-key", Pattern: `[rs]k_live_[0-9A-Za-z]{24,}`},
+	{Name: "jwt", Pattern: `eyJ[A-Za-z0-9_-]{10,}\.eyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}`},
+}
+
+// assignment matches values assigned to credential-like names (API_KEY=..., "token": "...")
+// in text or in JSON-escaped text. Only these values are checked for entropy, since IDs
+// generated by providers (chatcmpl-..., toolu_...) look as random as keys do.
+var assignment = regexp.MustCompile(fmt.Sprintf(
+	`(?i)(?:key|token|secret|passw(?:or)?d|credential)[a-z0-9_-]*[\\"' ]*[:=][\\"' ]*([A-Za-z0-9+/_=.-]{%d,})`,
+	entropyMinLen))
+
+type secretRule struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// secretScanner finds credentials in data about to be cached
+type secretScanner struct {
+	mode    string
+	entropy float64
+	rules   []secretRule
+}
+
+// newSecretScanner compiles the built-in and configured detectors. Invalid patterns and
+// modes are reported in the error; the returned scanner still refuses to cache responses
+// the valid rules find secrets in.
+func newSecretScanner(config SecretsConfig) (*secretScanner, error) {
+	s := &secretScanner{mode: config.Mode, entropy: config.Entropy}
+	var errs []error
+	switch s.mode {
+	case secretsRedact, secretsRefuse, secretsOff:
+	case "":
+		s.mode = secretsRefuse
+	default:
+		errs = append(errs, fmt.Errorf("unknown secrets mode %q", s.mode))
+		s.mode = secretsRefuse
+	}
+	for _, p := range append(append([]SecretPattern(nil), secretPatterns...), config.Patterns...) {
+		re, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("secret pattern %s: %w", p.Name, err))
+			continue
+		}
+		s.rules = append(s.rules, secretRule{name: p.Name, re: re})
+	}
+	return s, errors.Join(errs...)
+}
+
+// scrub replaces the secrets in data with a placeholder naming the detector and
+// returns how many it found
+func (s *secretScanner) scrub(data []byte) ([]byte, int) {
+	found := 0
+	for _, rule := range s.rules {
+		placeholder := []byte("[REDACTED:" + rule.name + "]")
+		data = rule.re.ReplaceAllFunc(data, func([]byte) []byte {
+			found++
+			return placeholder
+		})
+	}
+	if s.entropy > 0 {
+		var out []byte
+		last := 0
+		for _, m := range assignment.FindAllSubmatchIndex(data, -1) {
+			value := data[m[2]:m[3]]
+			if !mixedToken(value) || shannonEntropy(value) < s.entropy {
+				continue
+			}
+			found++
+			out = append(out, data[last:m[2]]...)
+			out = append(out, "[REDACTED:high-entropy]"...)
+			last = m[3]
+		}
+		if out != nil {
+			data = append(out, data[last:]...)
+		}
+	}
+	return data, found
+}
+
+// filter prepares data for the cache. It returns the data to store, the number of
+// secrets found and whether the data may be cached at all.
+func (s *secretScanner) filter(data []byte) ([]byte, int, bool) {
+	if s == nil || s.mode == secretsOff {
+		return data, 0, true
+	}
+	scrubbed, found := s.scrub(data)
+	if found == 0 {
+		return data, 0, true
+	}
+	if s.mode == secretsRefuse {
+		return nil, found, false
+	}
+	return scrubbed, found, true
+}
+
+// mixedToken reports whether a token has both letters and digits, as generated keys do
+func mixedToken(token []byte) bool {
+	var letter, digit bool
+	for _, c := range token {
+		switch {
+		case c >= '0' && c <= '9':
+			digit = true
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+			letter = true
+		}
+	}
+	return letter && digit
+}
+
+// shannonEntropy returns the entropy of a token in bits per character
+func shannonEntropy(token []byte) float64 {
+	var counts [256]int
+	for _, c := range token {
+		counts[c]++
+	}
+	n := float64(len(token))
+	var h float64
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / n
+			h -= p * math.Log2(p)
+		}
+	}
+	return h
+}
+
+// detect returns how many secrets text contains, unless scanning is off
+func (s *secretScanner) detect(text string) int {
+	if s == nil || s.mode == secretsOff {
+		return 0
+	}
+	_, found := s.scrub([]byte(text))
+	return found
+}
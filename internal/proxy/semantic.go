@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"strings"
+	"unicode"
+
+	"github.com/braw-dev/memex/internal/store"
+	"github.com/braw-dev/memex/pkg/types"
+)
+
+// vectorDims is the size of prompt and answer vectors
+const vectorDims = 256
+
+// textVector embeds text as the L2-normalised counts of its hashed words and word pairs.
+// It needs no model, so similarity is lexical: rephrasings with other words score low.
+// Text without words has no vector.
+func textVector(text string) store.Vector {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) == 0 {
+		return nil
+	}
+	v := make(store.Vector, vectorDims)
+	add := func(feature string) {
+		h := fnv.New32a()
+		h.Write([]byte(feature))
+		v[h.Sum32()%vectorDims]++
+	}
+	for i, word := range words {
+		add(word)
+		if i > 0 {
+			add(words[i-1] + " " + word)
+		}
+	}
+	var norm float64
+	for _, f := range v {
+		norm += float64(f * f)
+	}
+	norm = math.Sqrt(norm)
+	for i := range v {
+		v[i] = float32(float64(v[i]) / norm)
+	}
+	return v
+}
+
+// textSimilarity is the cosine similarity of two texts' vectors. Identical texts,
+// including two without words, are fully similar.
+func textSimilarity(a, b string) float64 {
+	if a == b {
+		return 1
+	}
+	va, vb := textVector(a), textVector(b)
+	if va == nil || vb == nil {
+		return 0
+	}
+	var dot float64
+	for i := range va {
+		dot += float64(va[i] * vb[i])
+	}
+	return min(dot, 1)
+}
+
+// promptVector embeds the final user turn of a conversation, which is what the answer
+// responds to; earlier history would make every long session look alike. System prompts
+// are not part of it since similar requests must have the same system prompt.
+func promptVector(conv *types.Conversation) store.Vector {
+	var parts []string
+	for _, msg := range conv.Messages[finalUserTurn(conv.Messages):] {
+		if msg.Role != types.RoleSystem && msg.Role != types.RoleDeveloper {
+			parts = append(parts, msg.Text())
+		}
+	}
+	return textVector(strings.Join(parts, "\n"))
+}
+
+// similarLookups reports whether a feature looks up cached entries by prompt vector
+func (h *proxyHandler) similarLookups() bool {
+	return h.config.Cache.Semantic.Mode == semanticShadow || h.config.Cache.Stale.IfError || h.config.Cache.Stale.Offline
+}
+
+// similarCandidates is how many of the most similar entries of each scope are considered,
+// since some may not fit the request (e.g. a JSON answer to a streaming request)
+const similarCandidates = 5
+
+// similarAnswer is a cached answer to a request similar to the current one
+type similarAnswer struct {
+	entry      *store.CacheEntry
+	response   cachedResponse
+	similarity float64
+}
+
+// nearestCached returns the cached answer in the scope chain whose request is most similar
+// to the conversation, with the same system prompt, model, history and streaming mode.
+// Expired entries are included when expired is set.
+func (h *proxyHandler) nearestCached(scope *types.ScopeContext, conv *types.Conversation, system string, expired bool) (*similarAnswer, bool) {
+	v := promptVector(conv)
+	if v == nil {
+		return nil, false
+	}
+	history := contextHash(conv)
+	var best *similarAnswer
+	for _, sc := range scope.Chain() {
+		entries, err := h.store.SimilarCache(store.SimilarQuery{
+			ScopeID:     sc.ID,
+			SystemHash:  hashText(system),
+			Model:       conv.Model,
+			ContextHash: history,
+			Vector:      v,
+			Expired:     expired,
+			Limit:       similarCandidates,
+		}, sc.Salt)
+		if err != nil {
+			slog.Error("Similar cache lookup failed", "scope", sc.ID, "err", err)
+			continue
+		}
+		for i := range entries {
+			var cached cachedResponse
+			if json.Unmarshal(entries[i].ResponseBlob, &cached) != nil || isEventStream(cached.ContentType) != conv.Stream {
+				continue
+			}
+			if best == nil || entries[i].Similarity > best.similarity {
+				best = &similarAnswer{entry: &entries[i].CacheEntry, response: cached, similarity: entries[i].Similarity}
+			}
+			break
+		}
+	}
+	return best, best != nil
+}
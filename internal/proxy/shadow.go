@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"text/tabwriter"
+	"time"
+
+	"github.com/braw-dev/memex/internal/store"
+	"github.com/braw-dev/memex/pkg/types"
+)
+
+// semanticShadow looks up similar cached requests on a miss without serving them
+const semanticShadow = "shadow"
+
+// shadowAgreement is the answer similarity from which a cached answer counts as
+// equivalent to the fresh one
+const shadowAgreement = 0.8
+
+// shadowMaxDrift is the share of would-be hits with diverging answers that a suggested
+// threshold may accept
+const shadowMaxDrift = 0.05
+
+// shadowLookup is the candidate found for a shadowed cache miss (nil when there is none)
+type shadowLookup struct {
+	scopeID   string
+	candidate *similarAnswer
+}
+
+// shadowCandidate finds the cached answer a similarity match would serve for a miss,
+// and logs it
+func (h *proxyHandler) shadowCandidate(scope *types.ScopeContext, conv *types.Conversation, system string) *shadowLookup {
+	lookup := &shadowLookup{scopeID: scope.ID}
+	candidate, ok := h.nearestCached(scope, conv, system, false)
+	if !ok {
+		slog.Debug("Shadow lookup found no candidate", "scope", scope.ID)
+		return lookup
+	}
+	lookup.candidate = candidate
+	slog.Info("Shadow semantic candidate", "scope", scope.ID, "candidate", candidate.entry.HashKey,
+		"similarity", candidate.similarity, "would_hit", candidate.similarity >= h.config.Cache.Semantic.Threshold)
+	return lookup
+}
+
+// recordShadow compares the candidate's cached answer with the fresh upstream answer
+// and stores the comparison without blocking the response
+func (h *proxyHandler) recordShadow(lookup *shadowLookup, codec schemaCodec, contentType string, body []byte) {
+	ac, ok := codec.(answerCodec)
+	if !ok {
+		return
+	}
+	comparison := &store.ShadowComparison{ScopeID: lookup.scopeID}
+	if c := lookup.candidate; c != nil {
+		comparison.CandidateKey = c.entry.HashKey
+		comparison.PromptSimilarity = c.similarity
+		comparison.AnswerSimilarity = textSimilarity(ac.answer(c.response.ContentType, c.response.Body), ac.answer(contentType, body))
+	}
+	go func() {
+		if err := h.store.RecordShadow(comparison); err != nil {
+			slog.Error("Failed to record shadow comparison", "err", err)
+		}
+	}()
+}
+
+// thresholdStats summarises the shadowed misses a similarity threshold would have served
+type thresholdStats struct {
+	threshold float64
+	// hitRate is the share of shadowed misses that would have been hits
+	hitRate float64
+	// drift is the share of those hits whose answer diverged from the fresh one
+	drift float64
+}
+
+// shadowThresholds evaluates candidate thresholds from 0.50 to 1.00 against the comparisons
+func shadowThresholds(comparisons []store.ShadowComparison) []thresholdStats {
+	var stats []thresholdStats
+	for step := 50; step <= 100; step += 5 {
+		s := thresholdStats{threshold: float64(step) / 100}
+		hits, diverged := 0, 0
+		for _, c := range comparisons {
+			if c.CandidateKey == "" || c.PromptSimilarity < s.threshold-1e-9 {
+				continue
+			}
+			hits++
+			if c.AnswerSimilarity < shadowAgreement {
+				diverged++
+			}
+		}
+		if len(comparisons) > 0 {
+			s.hitRate = float64(hits) / float64(len(comparisons))
+		}
+		if hits > 0 {
+			s.drift = float64(diverged) / float64(hits)
+		}
+		stats = append(stats, s)
+	}
+	return stats
+}
+
+// ShadowReport prints the hit rate and answer drift that similarity thresholds would have
+// produced for the misses shadowed since a time, and suggests the threshold with the most
+// hits whose drift stays acceptable
+func ShadowReport(config *ProxyConfig, st *store.Store, since time.Time, w io.Writer) error {
+	comparisons, err := st.ShadowComparisons(since)
+	if err != nil {
+		return fmt.Errorf("failed to read shadow comparisons: %w", err)
+	}
+	if len(comparisons) == 0 {
+		fmt.Fprintln(w, "No shadow comparisons recorded yet; set cache.semantic.mode to \"shadow\" first.")
+		return nil
+	}
+
+	fmt.Fprintf(w, "Shadowed misses: %d (answers agree from %.0f%% similarity)\n\n", len(comparisons), shadowAgreement*100)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "threshold\twould hit\tdrift\t")
+	var suggested *thresholdStats
+	stats := shadowThresholds(comparisons)
+	for i, s := range stats {
+		current := ""
+		if s.threshold == config.Cache.Semantic.Threshold {
+			current = "(current)"
+		}
+		fmt.Fprintf(tw, "%.2f\t%.1f%%\t%.1f%%\t%s\n", s.threshold, s.hitRate*100, s.drift*100, current)
+		if suggested == nil && s.hitRate > 0 && s.drift <= shadowMaxDrift {
+			suggested = &stats[i]
+		}
+	}
+	tw.Flush()
+
+	if suggested == nil {
+		fmt.Fprintf(w, "\nNo threshold keeps drift at or below %.0f%%; keep serving exact matches only.\n", shadowMaxDrift*100)
+		return nil
+	}
+	fmt.Fprintf(w, "\nSuggested threshold: %.2f (%.1f%% of misses would hit, %.1f%% drift)\n",
+		suggested.threshold, suggested.hitRate*100, suggested.drift*100)
+	return nil
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"path"
+
+	"github.com/braw-dev/memex/pkg/types"
+)
+
+// GlobalScope is the scope for scope-independent traffic shared by every project
+var GlobalScope = &types.ScopeContext{
+	ID:   "global",
+	Type: types.ScopeTypeGlobal,
+	Salt: ScopeSalt("global"),
+}
+
+// IsShared reports whether the request matches one of the shared rules.
+// LLM completions are never shared: their answers depend on the repository being worked on.
+func IsShared(r *http.Request, schema types.SchemaType, rules []SharedRule) bool {
+	if len(rules) == 0 || isCompletionSchema(schema) {
+		return false
+	}
+
+	host := upstreamHost(r)
+	var tool string
+	var toolParsed bool
+
+	for _, rule := range rules {
+		if rule.Host == "" && rule.Path == "" && rule.MCPTool == "" {
+			continue
+		}
+		if rule.Host != "" && !globMatch(rule.Host, host) {
+			continue
+		}
+		if rule.Path != "" && !globMatch(rule.Path, r.URL.Path) {
+			continue
+		}
+		if rule.MCPTool != "" {
+			if schema != types.SchemaMCP {
+				continue
+			}
+			if !toolParsed {
+				tool = mcpToolName(r)
+				toolParsed = true
+			}
+			if tool == "" || !globMatch(rule.MCPTool, tool) {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// upstreamHost returns the host name the request is destined for, without port
+func upstreamHost(r *http.Request) string {
+	host := r.URL.Host
+	if host == "" {
+		host = r.Host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+func globMatch(pattern, name string) bool {
+	ok, err := path.Match(pattern, name)
+	return err == nil && ok
+}
+
+// mcpToolName returns the tool name of a JSON-RPC tools/call request, or "" for anything else
+func mcpToolName(r *http.Request) string {
+	body, err := peekBodyLimit(r, maxMCPPeekBytes)
+	if err != nil {
+		return ""
+	}
+	req, ok := parseMCPRequest(body)
+	if !ok || req.Method != mcpMethodToolsCall {
+		return ""
+	}
+	p, err := req.params()
+	if err != nil {
+		return ""
+	}
+	return p.Name
+}
+
+// maxPeekBytes bounds the request body held in memory to inspect it; larger requests
+// (e.g. uploads) are proxied without being inspected or cached
+const maxPeekBytes = 32 << 20
+
+// maxMCPPeekBytes bounds the body read to recognise a JSON-RPC message of unknown
+// traffic, which is sniffed on every POST the proxy sees
+const maxMCPPeekBytes = 1 << 20
+
+// errBodyTooLarge is returned by peekBody for bodies over maxPeekBytes
+var errBodyTooLarge = errors.New("request body too large to inspect")
+
+// peekBody reads the request body and replaces it so it can be read again downstream.
+// Bodies over maxPeekBytes are left to stream through and reported as errBodyTooLarge.
+func peekBody(r *http.Request) ([]byte, error) {
+	return peekBodyLimit(r, maxPeekBytes)
+}
+
+// peekBodyLimit is peekBody for bodies of at most limit bytes
+func peekBodyLimit(r *http.Request, limit int64) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	if r.ContentLength > limit {
+		return nil, errBodyTooLarge
+	}
+	rest := r.Body
+	body, err := io.ReadAll(io.LimitReader(rest, limit+1))
+	if err != nil {
+		rest.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), rest), rest}
+		return nil, errBodyTooLarge
+	}
+	rest.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// IsSharedTool reports whether an MCP tool reached outside HTTP (e.g. over stdio) is shared.
+// Only rules that constrain nothing but the tool name can apply.
+func IsSharedTool(tool string, rules []SharedRule) bool {
+	for _, rule := range rules {
+		if rule.Host == "" && rule.Path == "" && rule.MCPTool != "" && globMatch(rule.MCPTool, tool) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/braw-dev/memex/pkg/types"
+)
+
+// staleHeader describes a degraded answer: why it was served, how similar the cached
+// request was and when it was cached
+const staleHeader = "X-Memex-Stale"
+
+// Reasons for serving a degraded answer
+const (
+	staleOffline       = "offline"
+	staleUpstreamError = "upstream-error"
+)
+
+// serveStale answers from the cached response closest to the request, even an expired
+// one, when the upstream cannot be used. It reports whether an answer was written.
+func (h *proxyHandler) serveStale(w http.ResponseWriter, r *http.Request, schema types.SchemaType, conv *types.Conversation, system, reason string, start time.Time) bool {
+	config := h.config.Cache.Stale
+	scope := FromContext(r.Context())
+	answer, ok := h.nearestCached(scope, conv, system, true)
+	if !ok || answer.similarity < config.MinSimilarity {
+		return false
+	}
+	entry, cached, similarity := answer.entry, answer.response, answer.similarity
+	if config.Footer {
+		cached.Body = appendFooter(schema, cached.ContentType, cached.Body, staleFooter(reason, entry.CreatedAt, similarity))
+	}
+
+	w.Header().Set(staleHeader, fmt.Sprintf("%s; similarity=%.2f; cached=%s",
+		reason, similarity, entry.CreatedAt.UTC().Format(time.RFC3339)))
+	replayResponse(w, &cached, cacheStatusStale)
+	h.audit(r, scope, schema, usage{In: cached.TokensIn, Out: cached.TokensOut}, true, start)
+	slog.Warn("Served stale answer", "reason", reason, "scope", entry.ScopeID, "similarity", similarity)
+	return true
+}
+
+// staleFooter is the note appended to degraded answers
+func staleFooter(reason string, cachedAt time.Time, similarity float64) string {
+	why := "the upstream is unavailable"
+	if reason == staleOffline {
+		why = "memex is in offline mode"
+	}
+	return fmt.Sprintf("\n\n---\n[memex] %s. This answer was cached on %s for a request %.0f%% similar to yours and may be out of date.",
+		why, cachedAt.Format(time.DateOnly), similarity*100)
+}
+
+// appendFooter adds text to the end of an Anthropic or OpenAI answer, streamed or not.
+// Other responses are returned unchanged.
+func appendFooter(schema types.SchemaType, contentType string, body []byte, footer string) []byte {
+	if isEventStream(contentType) {
+		return appendStreamFooter(schema, body, footer)
+	}
+	m, err := canonicalBody(body)
+	if err != nil {
+		return body
+	}
+	switch schema {
+	case types.SchemaAnthropic:
+		content, _ := m["content"].([]any)
+		m["content"] = append(content, map[string]any{"type": "text", "text": footer})
+	case types.SchemaOpenAI:
+		choices, _ := m["choices"].([]any)
+		if len(choices) == 0 {
+			return body
+		}
+		choice, _ := choices[0].(map[string]any)
+		message, _ := choice["message"].(map[string]any)
+		if text, ok := message["content"].(string); ok {
+			message["content"] = text + footer
+		}
+	default:
+		return body
+	}
+	out, err := json.Marshal(m)
+	if err != nil {
+		return body
+	}
+	return out
+}
+
+// appendStreamFooter inserts the footer as a final text block (Anthropic) or content
+// chunk (OpenAI) before the stream reports why it stopped
+func appendStreamFooter(schema types.SchemaType, body []byte, footer string) []byte {
+	var events []sseEvent
+	blocks, inserted := 0, false
+	forEachSSE(body, func(event, data string) {
+		if !inserted {
+			switch schema {
+			case types.SchemaAnthropic:
+				if event == "content_block_start" {
+					blocks++
+				}
+				if event == "message_delta" {
+					events = append(events,
+						anthropicEvent(map[string]any{"type": "content_block_start", "index": blocks,
+							"content_block": map[string]any{"type": "text", "text": ""}}),
+						anthropicEvent(map[string]any{"type": "content_block_delta", "index": blocks,
+							"delta": map[string]any{"type": "text_delta", "text": footer}}),
+						anthropicEvent(map[string]any{"type": "content_block_stop", "index": blocks}))
+					inserted = true
+				}
+			case types.SchemaOpenAI:
+				var chunk map[string]any
+				if data == "[DONE]" || json.Unmarshal([]byte(data), &chunk) == nil && finishes(chunk) {
+					if chunk == nil {
+						chunk = map[string]any{"object": "chat.completion.chunk"}
+					}
+					chunk["choices"] = []any{map[string]any{"index": 0, "delta": map[string]any{"content": footer}, "finish_reason": nil}}
+					delete(chunk, "usage")
+					out, _ := json.Marshal(chunk)
+					events = append(events, sseEvent{data: string(out)})
+					inserted = true
+				}
+			}
+		}
+		events = append(events, sseEvent{name: event, data: data})
+	})
+	if !inserted {
+		return body
+	}
+
+	var b bytes.Buffer
+	for _, e := range events {
+		if e.name != "" {
+			b.WriteString("event: " + e.name + "\n")
+		}
+		b.WriteString("data: " + e.data + "\n\n")
+	}
+	return b.Bytes()
+}
+
+// finishes reports whether a chat completion chunk carries a finish reason
+func finishes(chunk map[string]any) bool {
+	choices, _ := chunk["choices"].([]any)
+	for _, c := range choices {
+		if c, ok := c.(map[string]any); ok && c["finish_reason"] != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/braw-dev/memex/pkg/types"
+)
+
+func TestAppendFooter(t *testing.T) {
+	const footer = "[memex] stale"
+	tests := []struct {
+		name        string
+		schema      types.SchemaType
+		contentType string
+		body        string
+		// before is a part of the body the footer must precede ("" when it ends the answer)
+		before   string
+		expected string
+	}{
+		{"Anthropic JSON", types.SchemaAnthropic, "application/json",
+			`{"content":[{"type":"text","text":"Hello"}],"usage":{"input_tokens":12}}`, "",
+			`{"text":"Hello","type":"text"},{"text":"[memex] stale","type":"text"}`},
+		{"Anthropic stream", types.SchemaAnthropic, "text/event-stream",
+			"event: content_block_start\ndata: {\"type\":\"content_block_start\",\"index\":0}\n\n" +
+				"event: message_delta\ndata: {\"type\":\"message_delta\"}\n\n",
+			"event: message_delta", `{"delta":{"text":"[memex] stale","type":"text_delta"},"index":1,"type":"content_block_delta"}`},
+		{"OpenAI JSON", types.SchemaOpenAI, "application/json",
+			`{"choices":[{"message":{"role":"assistant","content":"Hello"}}]}`, "",
+			`"content":"Hello[memex] stale"`},
+		{"OpenAI stream", types.SchemaOpenAI, "text/event-stream",
+			"data: {\"id\":\"c1\",\"choices\":[{\"delta\":{\"content\":\"Hello\"}}]}\n\n" +
+				"data: {\"id\":\"c1\",\"choices\":[{\"delta\":{},\"finish_reason\":\"stop\"}]}\n\n" +
+				"data: [DONE]\n\n",
+			`"finish_reason":"stop"`, `"delta":{"content":"[memex] stale"}`},
+		{"Other schemas are unchanged", types.SchemaGemini, "application/json", `{"candidates":[]}`, "", `{"candidates":[]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := string(appendFooter(tt.schema, tt.contentType, []byte(tt.body), footer))
+			if !strings.Contains(out, tt.expected) {
+				t.Fatalf("expected %s in %s", tt.expected, out)
+			}
+			if tt.before != "" && strings.Index(out, tt.expected) > strings.Index(out, tt.before) {
+				t.Errorf("expected the footer before %s, got %s", tt.before, out)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/braw-dev/memex/pkg/types"
+)
+
+// sideEffectTools are agent tools that change the workspace or run arbitrary commands
+// (Claude Code and Codex names). Their results describe the world at one point in time.
+var sideEffectTools = []string{"Bash", "Edit", "MultiEdit", "Write", "NotebookEdit", "shell", "apply_patch"}
+
+// toolPolicy decides which agent turns are cached based on the tools whose results they carry
+type toolPolicy struct {
+	config CacheConfig
+}
+
+// neverCache reports whether turns carrying results of the tool must bypass the cache
+func (p toolPolicy) neverCache(tool string) bool {
+	for _, rule := range p.config.Tools {
+		if globMatch(rule.Name, tool) {
+			return rule.NeverCache
+		}
+	}
+	return p.config.SkipSideEffects && matchesAny(sideEffectTools, tool)
+}
+
+// normalize rewrites a conversation for fingerprinting. Tool call IDs, which providers
+// generate randomly, are replaced by their position so identical agent loops share keys,
+// and tool results are replaced by a hash of their content so a changed file changes the key.
+// It fails when the final user turn carries results of a tool that is never cached; results
+// earlier in the history no longer describe the current state of the workspace. The
+// conversation is normalised in full either way.
+func (p toolPolicy) normalize(c *types.Conversation) error {
+	var skip error
+	ids := make(map[string]string)
+	names := make(map[string]string)
+	final := finalUserTurn(c.Messages)
+	for i := range c.Messages {
+		content := c.Messages[i].Content
+		for j := range content {
+			b := &content[j]
+			switch b.Type {
+			case types.BlockToolUse:
+				names[b.ToolUseID] = b.ToolName
+				ids[b.ToolUseID] = fmt.Sprintf("tool_%d", len(ids))
+				b.ToolUseID = ids[b.ToolUseID]
+			case types.BlockToolResult:
+				if name, ok := names[b.ToolUseID]; ok && skip == nil && i >= final && p.neverCache(name) {
+					skip = fmt.Errorf("turn carries results of %s, which is never cached", name)
+				}
+				if id, ok := ids[b.ToolUseID]; ok {
+					b.ToolUseID = id
+				}
+				data, err := json.Marshal(resultContent(b.Content))
+				if err != nil {
+					return err
+				}
+				sum := sha256.Sum256(data)
+				b.Content = []types.ContentBlock{types.TextBlock("sha256:" + hex.EncodeToString(sum[:]))}
+			}
+		}
+	}
+	return skip
+}
+
+// finalUserTurn returns the index of the first message after the last assistant message.
+// OpenAI sends each tool result as its own message, so the turn can span several.
+func finalUserTurn(messages []types.Message) int {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == types.RoleAssistant {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// resultContent returns tool result content without provider annotations such as
+// cache_control, which clients move between turns
+func resultContent(blocks []types.ContentBlock) []types.ContentBlock {
+	out := make([]types.ContentBlock, len(blocks))
+	for i, b := range blocks {
+		b.Extra = nil
+		out[i] = b
+	}
+	return out
+}
@@ -0,0 +1,482 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/braw-dev/memex/pkg/types"
+)
+
+// schemaPath returns the upstream path of a translatable schema
+func schemaPath(schema types.SchemaType) string {
+	if schema == types.SchemaAnthropic {
+		return "/v1/messages"
+	}
+	return "/v1/chat/completions"
+}
+
+// translateRequest converts a request body from one schema to another, replacing the model
+// when one is given. Bodies of the same schema only have their model replaced.
+func translateRequest(from, to types.SchemaType, body []byte, model string) ([]byte, error) {
+	var c *types.Conversation
+	var err error
+	switch from {
+	case types.SchemaAnthropic:
+		c, err = types.ParseAnthropic(body)
+	case types.SchemaOpenAI:
+		c, err = types.ParseOpenAI(body)
+	default:
+		err = fmt.Errorf("cannot translate %s requests", from)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if model != "" {
+		c.Model = model
+	}
+	switch to {
+	case types.SchemaAnthropic:
+		return c.MarshalAnthropic()
+	case types.SchemaOpenAI:
+		return c.MarshalOpenAI()
+	default:
+		return nil, fmt.Errorf("cannot translate requests to %s", to)
+	}
+}
+
+// translateResponse converts a JSON response body from one schema to another. The
+// assistant message goes through the Conversation model like requests do; only the
+// response envelope (ids, stop reason and usage) is mapped here.
+func translateResponse(from, to types.SchemaType, body []byte) ([]byte, error) {
+	if from == to {
+		return body, nil
+	}
+	var m map[string]any
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, err
+	}
+	var err error
+	switch {
+	case from == types.SchemaOpenAI && to == types.SchemaAnthropic:
+		m, err = openAIToAnthropicResponse(m)
+	case from == types.SchemaAnthropic && to == types.SchemaOpenAI:
+		m, err = anthropicToOpenAIResponse(m)
+	default:
+		err = fmt.Errorf("cannot translate %s responses to %s", from, to)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(m)
+}
+
+// translateMessage converts one assistant message between schemas by translating it as
+// a single-turn conversation
+func translateMessage(from, to types.SchemaType, msg map[string]any) (map[string]any, error) {
+	body, err := json.Marshal(map[string]any{"messages": []any{msg}})
+	if err != nil {
+		return nil, err
+	}
+	body, err = translateRequest(from, to, body, "")
+	if err != nil {
+		return nil, err
+	}
+	var req struct {
+		Messages []map[string]any `json:"messages"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, err
+	}
+	if len(req.Messages) != 1 {
+		return nil, fmt.Errorf("translated assistant message into %d messages", len(req.Messages))
+	}
+	return req.Messages[0], nil
+}
+
+// openAIToAnthropicResponse converts a chat completion to a Messages API response
+func openAIToAnthropicResponse(m map[string]any) (map[string]any, error) {
+	content := []any{}
+	finish := ""
+	if choices, ok := m["choices"].([]any); ok && len(choices) > 0 {
+		choice, _ := choices[0].(map[string]any)
+		finish, _ = choice["finish_reason"].(string)
+		if msg, ok := choice["message"].(map[string]any); ok {
+			msg, err := translateMessage(types.SchemaOpenAI, types.SchemaAnthropic, msg)
+			if err != nil {
+				return nil, err
+			}
+			switch c := msg["content"].(type) {
+			case string:
+				content = []any{map[string]any{"type": "text", "text": c}}
+			case []any:
+				content = c
+			}
+		}
+	}
+	u, _ := m["usage"].(map[string]any)
+	id, _ := m["id"].(string)
+	return map[string]any{
+		"id":            "msg_" + id,
+		"type":          "message",
+		"role":          "assistant",
+		"model":         m["model"],
+		"content":       content,
+		"stop_reason":   anthropicStopReason(finish),
+		"stop_sequence": nil,
+		"usage": map[string]any{
+			"input_tokens":  jsonInt(u, "prompt_tokens"),
+			"output_tokens": jsonInt(u, "completion_tokens"),
+		},
+	}, nil
+}
+
+// anthropicToOpenAIResponse converts a Messages API response to a chat completion.
+// Thinking blocks are dropped; they are only meaningful to the model that produced them.
+func anthropicToOpenAIResponse(m map[string]any) (map[string]any, error) {
+	blocks, _ := m["content"].([]any)
+	if blocks == nil {
+		blocks = []any{}
+	}
+	msg, err := translateMessage(types.SchemaAnthropic, types.SchemaOpenAI, map[string]any{"role": "assistant", "content": blocks})
+	if err != nil {
+		return nil, err
+	}
+	stop, _ := m["stop_reason"].(string)
+	u, _ := m["usage"].(map[string]any)
+	in, out := jsonInt(u, "input_tokens"), jsonInt(u, "output_tokens")
+	id, _ := m["id"].(string)
+	return map[string]any{
+		"id":      "chatcmpl-" + id,
+		"object":  "chat.completion",
+		"created": time.Now().Unix(),
+		"model":   m["model"],
+		"choices": []any{map[string]any{
+			"index":         0,
+			"message":       msg,
+			"finish_reason": openAIFinishReason(stop),
+		}},
+		"usage": map[string]any{
+			"prompt_tokens":     in,
+			"completion_tokens": out,
+			"total_tokens":      in + out,
+		},
+	}, nil
+}
+
+// anthropicStopReason maps an OpenAI finish_reason to an Anthropic stop_reason
+func anthropicStopReason(finish string) string {
+	switch finish {
+	case "length":
+		return "max_tokens"
+	case "tool_calls", "function_call":
+		return "tool_use"
+	default:
+		return "end_turn"
+	}
+}
+
+// openAIFinishReason maps an Anthropic stop_reason to an OpenAI finish_reason
+func openAIFinishReason(stop string) string {
+	switch stop {
+	case "max_tokens":
+		return "length"
+	case "tool_use":
+		return "tool_calls"
+	default:
+		return "stop"
+	}
+}
+
+// sseEvent is one Server-Sent Event; an empty name sends a data-only event
+type sseEvent struct {
+	name string
+	data string
+}
+
+// streamTranslator converts a provider's stream events into another schema's events
+type streamTranslator interface {
+	// translate converts one upstream event
+	translate(event, data string) []sseEvent
+	// finished reports whether the upstream stream has ended its answer
+	finished() bool
+}
+
+// newStreamTranslator returns a translator of streams from one schema to another
+func newStreamTranslator(from, to types.SchemaType, request []byte) streamTranslator {
+	switch {
+	case from == types.SchemaOpenAI && to == types.SchemaAnthropic:
+		return &openAIToAnthropicStream{}
+	case from == types.SchemaAnthropic && to == types.SchemaOpenAI:
+		var req struct {
+			StreamOptions struct {
+				IncludeUsage bool `json:"include_usage"`
+			} `json:"stream_options"`
+		}
+		json.Unmarshal(request, &req)
+		return &anthropicToOpenAIStream{includeUsage: req.StreamOptions.IncludeUsage}
+	default:
+		return &passthroughStream{}
+	}
+}
+
+// passthroughStream relays events of a stream that needs no translation
+type passthroughStream struct {
+	done bool
+}
+
+func (s *passthroughStream) translate(event, data string) []sseEvent {
+	if data == "[DONE]" || event == "message_stop" {
+		s.done = true
+	}
+	return []sseEvent{{name: event, data: data}}
+}
+
+func (s *passthroughStream) finished() bool {
+	return s.done
+}
+
+// anthropicEvent builds an Anthropic stream event, which repeats its type as the event name
+func anthropicEvent(v map[string]any) sseEvent {
+	data, _ := json.Marshal(v)
+	name, _ := v["type"].(string)
+	return sseEvent{name: name, data: string(data)}
+}
+
+// openAIToAnthropicStream turns chat completion chunks into Messages API stream events
+type openAIToAnthropicStream struct {
+	started   bool
+	done      bool
+	block     int    // index of the open content block, -1 when none is open
+	blockType string // "text" or "tool_use"
+	tools     map[int]int
+	finish    string
+	usage     map[string]any
+}
+
+func (s *openAIToAnthropicStream) translate(event, data string) []sseEvent {
+	if s.done {
+		return nil
+	}
+	if data == "[DONE]" {
+		return s.close()
+	}
+	var chunk struct {
+		ID      string `json:"id"`
+		Model   string `json:"model"`
+		Choices []struct {
+			Delta struct {
+				Content   string `json:"content"`
+				ToolCalls []struct {
+					Index    int    `json:"index"`
+					ID       string `json:"id"`
+					Function struct {
+						Name      string `json:"name"`
+						Arguments string `json:"arguments"`
+					} `json:"function"`
+				} `json:"tool_calls"`
+			} `json:"delta"`
+			FinishReason string `json:"finish_reason"`
+		} `json:"choices"`
+		Usage map[string]any `json:"usage"`
+	}
+	if json.Unmarshal([]byte(data), &chunk) != nil {
+		return nil
+	}
+
+	var out []sseEvent
+	if !s.started {
+		s.started = true
+		s.block = -1
+		s.tools = make(map[int]int)
+		out = append(out, anthropicEvent(map[string]any{
+			"type": "message_start",
+			"message": map[string]any{
+				"id": "msg_" + chunk.ID, "type": "message", "role": "assistant", "model": chunk.Model,
+				"content": []any{}, "stop_reason": nil, "stop_sequence": nil,
+				"usage": map[string]any{"input_tokens": 0, "output_tokens": 0},
+			},
+		}))
+	}
+	if chunk.Usage != nil {
+		s.usage = chunk.Usage
+	}
+	for _, choice := range chunk.Choices {
+		if text := choice.Delta.Content; text != "" {
+			if s.blockType != "text" {
+				out = append(out, s.startBlock("text", map[string]any{"type": "text", "text": ""})...)
+			}
+			out = append(out, anthropicEvent(map[string]any{
+				"type": "content_block_delta", "index": s.block,
+				"delta": map[string]any{"type": "text_delta", "text": text},
+			}))
+		}
+		for _, call := range choice.Delta.ToolCalls {
+			if call.ID != "" {
+				out = append(out, s.startBlock("tool_use", map[string]any{
+					"type": "tool_use", "id": call.ID, "name": call.Function.Name, "input": map[string]any{},
+				})...)
+				s.tools[call.Index] = s.block
+			}
+			if index, ok := s.tools[call.Index]; ok && call.Function.Arguments != "" && index == s.block {
+				out = append(out, anthropicEvent(map[string]any{
+					"type": "content_block_delta", "index": index,
+					"delta": map[string]any{"type": "input_json_delta", "partial_json": call.Function.Arguments},
+				}))
+			}
+		}
+		if choice.FinishReason != "" {
+			s.finish = choice.FinishReason
+		}
+	}
+	return out
+}
+
+// startBlock closes the open content block and starts a new one
+func (s *openAIToAnthropicStream) startBlock(blockType string, block map[string]any) []sseEvent {
+	out := s.stopBlock()
+	s.block++
+	s.blockType = blockType
+	return append(out, anthropicEvent(map[string]any{"type": "content_block_start", "index": s.block, "content_block": block}))
+}
+
+func (s *openAIToAnthropicStream) stopBlock() []sseEvent {
+	if s.blockType == "" {
+		return nil
+	}
+	s.blockType = ""
+	return []sseEvent{anthropicEvent(map[string]any{"type": "content_block_stop", "index": s.block})}
+}
+
+func (s *openAIToAnthropicStream) finished() bool {
+	return s.done
+}
+
+// close ends the translated stream once the upstream sent [DONE]
+func (s *openAIToAnthropicStream) close() []sseEvent {
+	if s.done || !s.started {
+		return nil
+	}
+	s.done = true
+	out := s.stopBlock()
+	return append(out,
+		anthropicEvent(map[string]any{
+			"type":  "message_delta",
+			"delta": map[string]any{"stop_reason": anthropicStopReason(s.finish), "stop_sequence": nil},
+			"usage": map[string]any{
+				"input_tokens":  jsonInt(s.usage, "prompt_tokens"),
+				"output_tokens": jsonInt(s.usage, "completion_tokens"),
+			},
+		}),
+		anthropicEvent(map[string]any{"type": "message_stop"}),
+	)
+}
+
+// anthropicToOpenAIStream turns Messages API stream events into chat completion chunks
+type anthropicToOpenAIStream struct {
+	includeUsage bool
+	done         bool
+	id           string
+	model        string
+	created      int64
+	tools        map[int]int // content block index -> tool call index
+	in, out      int
+}
+
+func (s *anthropicToOpenAIStream) chunk(delta map[string]any, finish any) sseEvent {
+	data, _ := json.Marshal(map[string]any{
+		"id": s.id, "object": "chat.completion.chunk", "created": s.created, "model": s.model,
+		"choices": []any{map[string]any{"index": 0, "delta": delta, "finish_reason": finish}},
+	})
+	return sseEvent{data: string(data)}
+}
+
+func (s *anthropicToOpenAIStream) translate(event, data string) []sseEvent {
+	if s.done {
+		return nil
+	}
+	var msg struct {
+		Type    string `json:"type"`
+		Index   int    `json:"index"`
+		Message struct {
+			ID    string         `json:"id"`
+			Model string         `json:"model"`
+			Usage map[string]any `json:"usage"`
+		} `json:"message"`
+		ContentBlock struct {
+			Type string `json:"type"`
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"content_block"`
+		Delta struct {
+			Type        string `json:"type"`
+			Text        string `json:"text"`
+			PartialJSON string `json:"partial_json"`
+			StopReason  string `json:"stop_reason"`
+		} `json:"delta"`
+		Usage map[string]any `json:"usage"`
+	}
+	if json.Unmarshal([]byte(data), &msg) != nil {
+		return nil
+	}
+
+	switch msg.Type {
+	case "message_start":
+		s.id = "chatcmpl-" + msg.Message.ID
+		s.model = msg.Message.Model
+		s.created = time.Now().Unix()
+		s.tools = make(map[int]int)
+		s.in = jsonInt(msg.Message.Usage, "input_tokens")
+		return []sseEvent{s.chunk(map[string]any{"role": "assistant", "content": ""}, nil)}
+	case "content_block_start":
+		if msg.ContentBlock.Type != "tool_use" {
+			return nil
+		}
+		index := len(s.tools)
+		s.tools[msg.Index] = index
+		return []sseEvent{s.chunk(map[string]any{"tool_calls": []any{map[string]any{
+			"index": index, "id": msg.ContentBlock.ID, "type": "function",
+			"function": map[string]any{"name": msg.ContentBlock.Name, "arguments": ""},
+		}}}, nil)}
+	case "content_block_delta":
+		switch msg.Delta.Type {
+		case "text_delta":
+			return []sseEvent{s.chunk(map[string]any{"content": msg.Delta.Text}, nil)}
+		case "input_json_delta":
+			return []sseEvent{s.chunk(map[string]any{"tool_calls": []any{map[string]any{
+				"index": s.tools[msg.Index], "function": map[string]any{"arguments": msg.Delta.PartialJSON},
+			}}}, nil)}
+		}
+	case "message_delta":
+		if n := jsonInt(msg.Usage, "input_tokens"); n > 0 {
+			s.in = n
+		}
+		s.out = jsonInt(msg.Usage, "output_tokens")
+		return []sseEvent{s.chunk(map[string]any{}, openAIFinishReason(msg.Delta.StopReason))}
+	case "message_stop":
+		return s.close()
+	}
+	return nil
+}
+
+func (s *anthropicToOpenAIStream) finished() bool {
+	return s.done
+}
+
+// close ends the translated stream once the upstream sent message_stop
+func (s *anthropicToOpenAIStream) close() []sseEvent {
+	if s.done || s.id == "" {
+		return nil
+	}
+	s.done = true
+	var out []sseEvent
+	if s.includeUsage {
+		data, _ := json.Marshal(map[string]any{
+			"id": s.id, "object": "chat.completion.chunk", "created": s.created, "model": s.model,
+			"choices": []any{},
+			"usage":   map[string]any{"prompt_tokens": s.in, "completion_tokens": s.out, "total_tokens": s.in + s.out},
+		})
+		out = append(out, sseEvent{data: string(data)})
+	}
+	return append(out, sseEvent{data: "[DONE]"})
+}
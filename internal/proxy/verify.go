@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/braw-dev/memex/internal/store"
+	"github.com/braw-dev/memex/pkg/types"
+)
+
+// verifyHit sends a sample of cache hits upstream again in the background, compares the
+// fresh answer with the cached one and evicts the entry when they have diverged. The
+// sampled requests are billed by the provider like any other, and audited as misses of the
+// user and scope that got the hit.
+//
+// Similarity is lexical, so answers sampled with temperature > 0 that say the same thing
+// in other words can fall below the threshold and evict valid entries.
+func (h *proxyHandler) verifyHit(r *http.Request, scope *types.ScopeContext, schema types.SchemaType, codec schemaCodec, entry *store.CacheEntry, cached *cachedResponse) {
+	config := h.config.Cache.Verify
+	ac, ok := codec.(answerCodec)
+	if !ok || config.SampleRate <= 0 || rand.Float64() >= config.SampleRate {
+		return
+	}
+	body, err := peekBody(r)
+	if err != nil {
+		return
+	}
+	// The check outlives the client's request. Its audit log belongs to the same user, but
+	// the conversation's prefixes were already tracked with the hit.
+	details := *auditFromContext(r.Context())
+	details.prefixes, details.secrets = nil, 0
+	ctx := context.WithValue(context.WithoutCancel(r.Context()), auditContextKey, &details)
+	cancel := func() {}
+	if h.config.UpstreamTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, h.config.UpstreamTimeout)
+	}
+	out := r.Clone(ctx)
+
+	go func() {
+		defer cancel()
+		start := time.Now()
+		buf := h.forwardBuffered(out, body)
+		contentType := buf.header.Get("Content-Type")
+		u, complete := codec.usage(contentType, buf.body.Bytes())
+		h.auditObserved(out, scope, schema, u, start)
+		if buf.status != http.StatusOK || !complete {
+			slog.Debug("Cache hit verification failed upstream", "status", buf.status)
+			return
+		}
+		// Cached answers were scrubbed of secrets, so scrub the fresh one alike
+		fresh, _, _ := h.secrets.filter(buf.body.Bytes())
+
+		v := &store.HitVerification{
+			ScopeID:    entry.ScopeID,
+			HashKey:    entry.HashKey,
+			Similarity: textSimilarity(ac.answer(cached.ContentType, cached.Body), ac.answer(contentType, fresh)),
+		}
+		if v.Similarity < config.Threshold {
+			if err := h.store.DeleteCache(entry.HashKey); err != nil {
+				slog.Error("Failed to evict diverged cache entry", "err", err)
+			} else {
+				v.Evicted = true
+				slog.Info("Evicted cache entry whose answer diverged", "scope", entry.ScopeID, "key", entry.HashKey, "similarity", v.Similarity)
+			}
+		}
+		if err := h.store.RecordVerification(v); err != nil {
+			slog.Error("Failed to record cache hit verification", "err", err)
+		}
+	}()
+}
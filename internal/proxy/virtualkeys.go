@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/braw-dev/memex/internal/store"
+)
+
+// virtualKeyPrefix marks keys issued by memex, so they are told apart from provider keys
+const virtualKeyPrefix = "mx-"
+
+// virtualKeyIDLen is the length of the public key ID: the prefix and 8 hex characters
+const virtualKeyIDLen = len(virtualKeyPrefix) + 8
+
+// IssueVirtualKey creates a virtual key for a user. The key itself is only returned here;
+// the store keeps its hash.
+func IssueVirtualKey(st *store.Store, userID, name string) (string, *store.VirtualKey, error) {
+	if userID == "" {
+		return "", nil, errors.New("a user is required")
+	}
+	random := make([]byte, 24)
+	if _, err := rand.Read(random); err != nil {
+		return "", nil, err
+	}
+	key := virtualKeyPrefix + hex.EncodeToString(random)
+	record := &store.VirtualKey{
+		KeyID:   key[:virtualKeyIDLen],
+		KeyHash: hashText(key),
+		UserID:  userID,
+		Name:    name,
+	}
+	if err := st.CreateVirtualKey(record); err != nil {
+		return "", nil, err
+	}
+	return key, record, nil
+}
+
+// presentedKey returns the API key a client sent and the header carrying it
+func presentedKey(r *http.Request) (string, string) {
+	if key := r.Header.Get("x-api-key"); key != "" {
+		return key, "x-api-key"
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token, "Authorization"
+	}
+	return "", ""
+}
+
+// upstreamKey returns the real provider key configured for the request's upstream host
+func (h *proxyHandler) upstreamKey(r *http.Request) (string, bool) {
+	host := upstreamHost(r)
+	for _, rule := range h.config.VirtualKeys.Upstream {
+		if globMatch(rule.Host, host) {
+			return string(rule.APIKey), rule.APIKey != ""
+		}
+	}
+	return "", false
+}
+
+// authenticateVirtualKey swaps a virtual key for the real upstream key and attributes the
+// request to the key's user. It writes an error and returns false when the request must
+// not go any further.
+func (h *proxyHandler) authenticateVirtualKey(w http.ResponseWriter, r *http.Request) bool {
+	config := h.config.VirtualKeys
+	if !config.Enabled || h.store == nil {
+		return true
+	}
+	schema := schemaFromContext(r.Context())
+	key, header := presentedKey(r)
+	if !strings.HasPrefix(key, virtualKeyPrefix) {
+		if config.Required {
+			writeSchemaError(w, schema, http.StatusUnauthorized, errUnauthorized, "A memex virtual key is required")
+			return false
+		}
+		return true
+	}
+
+	record, err := h.store.GetVirtualKey(hashText(key))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.Error("Virtual key lookup failed", "err", err)
+		}
+		writeSchemaError(w, schema, http.StatusUnauthorized, errUnauthorized, "Invalid virtual key")
+		return false
+	}
+	if record.RevokedAt != nil {
+		writeSchemaError(w, schema, http.StatusUnauthorized, errUnauthorized, "Virtual key revoked")
+		return false
+	}
+	upstream, ok := h.upstreamKey(r)
+	if !ok {
+		writeSchemaError(w, schema, http.StatusForbidden, errForbidden, "No upstream key configured for "+upstreamHost(r))
+		return false
+	}
+
+	if header == "x-api-key" {
+		r.Header.Set("x-api-key", upstream)
+	} else {
+		r.Header.Set("Authorization", "Bearer "+upstream)
+	}
+	auditFromContext(r.Context()).user = record.UserID
+	return true
+}
+
+// virtualKeyJSON is the admin API view of a key; the key itself is only set on creation
+type virtualKeyJSON struct {
+	ID        string     `json:"id"`
+	Key       string     `json:"key,omitempty"`
+	User      string     `json:"user"`
+	Name      string     `json:"name,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+func newVirtualKeyJSON(k *store.VirtualKey) virtualKeyJSON {
+	return virtualKeyJSON{ID: k.KeyID, User: k.UserID, Name: k.Name, CreatedAt: k.CreatedAt, RevokedAt: k.RevokedAt}
+}
+
+// handleKeys serves the key management API: GET lists keys, POST {"user", "name"} issues
+// one and DELETE /_memex/keys/{id} revokes one. Requests for other hosts are proxied.
+func (h *proxyHandler) handleKeys(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Host != "" {
+		h.handleProxy(w, r)
+		return
+	}
+	token := string(h.config.VirtualKeys.AdminToken)
+	if token == "" || h.store == nil {
+		http.NotFound(w, r)
+		return
+	}
+	presented, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch id := r.PathValue("id"); {
+	case r.Method == http.MethodGet && id == "":
+		keys, err := h.store.ListVirtualKeys()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		out := make([]virtualKeyJSON, len(keys))
+		for i := range keys {
+			out[i] = newVirtualKeyJSON(&keys[i])
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"data": out})
+	case r.Method == http.MethodPost && id == "":
+		var req struct {
+			User string `json:"user"`
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		key, record, err := IssueVirtualKey(h.store, req.User, req.Name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		out := newVirtualKeyJSON(record)
+		out.Key = key
+		writeJSON(w, http.StatusCreated, out)
+	case r.Method == http.MethodDelete && id != "":
+		if err := h.store.RevokeVirtualKey(id); errors.Is(err, sql.ErrNoRows) {
+			http.NotFound(w, r)
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// writeJSON writes v as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -1,6 +1,7 @@
 package store
 
 import (
+	"strings"
 	"time"
 )
 
@@ -12,6 +13,18 @@ type AuditLog struct {
 	TokensOut int       `db:"tokens_out"`
 	Cost      float64   `db:"cost"`
 	Latency   int       `db:"latency"` // in milliseconds
+	Schema    string    `db:"schema"`
+	CacheHit  bool      `db:"cache_hit"`
+	// MessageCount is the number of messages in the request's conversation
+	MessageCount int `db:"message_count"`
+	// PrefixDepth is how many leading messages the scope had already seen
+	PrefixDepth int `db:"prefix_depth"`
+	// SecretsFound is the number of secrets detected in the response before caching
+	SecretsFound int `db:"secrets_found"`
+	// UserID is the user the request is attributed to (empty for anonymous requests)
+	UserID string `db:"user_id"`
+	// Model is the model the request asked for
+	Model string `db:"model"`
 }
 
 // WriteLog inserts a new audit log entry into the database
@@ -21,9 +34,38 @@ func (s *Store) WriteLog(log *AuditLog) error {
 	}
 
 	query := `
-	INSERT INTO audit_logs (timestamp, scope_id, tokens_in, tokens_out, cost, latency)
-	VALUES (:timestamp, :scope_id, :tokens_in, :tokens_out, :cost, :latency)
+	INSERT INTO audit_logs (timestamp, scope_id, tokens_in, tokens_out, cost, latency, schema, cache_hit,
+		message_count, prefix_depth, secrets_found, user_id, model)
+	VALUES (:timestamp, :scope_id, :tokens_in, :tokens_out, :cost, :latency, :schema, :cache_hit,
+		:message_count, :prefix_depth, :secrets_found, :user_id, :model)
 	`
 	_, err := s.db.NamedExec(query, log)
 	return err
 }
+
+// UsageFilter selects the audit logs a usage total covers. Nil fields match everything.
+type UsageFilter struct {
+	UserID  *string
+	ScopeID *string
+	Model   *string
+}
+
+// Usage totals the tokens and cost of upstream (non cache hit) requests since a time
+func (s *Store) Usage(since time.Time, filter UsageFilter) (int64, float64, error) {
+	where := []string{"timestamp >= ?", "NOT cache_hit"}
+	args := []any{since}
+	for column, value := range map[string]*string{"user_id": filter.UserID, "scope_id": filter.ScopeID, "model": filter.Model} {
+		if value != nil {
+			where = append(where, column+" = ?")
+			args = append(args, *value)
+		}
+	}
+	var total struct {
+		Tokens int64   `db:"tokens"`
+		Cost   float64 `db:"cost"`
+	}
+	query := `SELECT CAST(COALESCE(SUM(tokens_in + tokens_out), 0) AS BIGINT) AS tokens, COALESCE(SUM(cost), 0) AS cost
+	FROM audit_logs WHERE ` + strings.Join(where, " AND ")
+	err := s.db.Get(&total, query, args...)
+	return total.Tokens, total.Cost, err
+}
@@ -0,0 +1,117 @@
+package store
+
+import (
+	"fmt"
+	"time"
+)
+
+// MessageBatch is an Anthropic message batch seen by the proxy
+type MessageBatch struct {
+	BatchID string `db:"batch_id"`
+	ScopeID string `db:"scope_id"`
+	// Upstream is false when every request was answered from the cache and the batch
+	// only exists locally
+	Upstream  bool      `db:"upstream"`
+	CreatedAt time.Time `db:"created_at"`
+	// Salt is the scope's key derivation salt, used to encrypt item results (never stored)
+	Salt []byte `db:"-"`
+}
+
+// MessageBatchItem is one request of a message batch
+type MessageBatchItem struct {
+	BatchID  string `db:"batch_id"`
+	CustomID string `db:"custom_id"`
+	// HashKey is the cache key the item's result is stored under
+	HashKey string `db:"hash_key"`
+	// Cached marks items answered from the cache; ResultBlob then holds the message
+	Cached     bool   `db:"cached"`
+	ResultBlob []byte `db:"result_blob"`
+	// Recorded marks upstream items whose result has been cached and audited
+	Recorded bool `db:"recorded"`
+}
+
+// CreateBatch records a batch and its items
+func (s *Store) CreateBatch(batch *MessageBatch, items []MessageBatchItem) error {
+	if batch.CreatedAt.IsZero() {
+		batch.CreatedAt = time.Now()
+	}
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.NamedExec(`
+	INSERT INTO message_batches (batch_id, scope_id, upstream, created_at)
+	VALUES (:batch_id, :scope_id, :upstream, :created_at)
+	`, batch)
+	if err != nil {
+		return fmt.Errorf("failed to insert batch: %w", err)
+	}
+	for i := range items {
+		items[i].BatchID = batch.BatchID
+		item := items[i]
+		if item.ResultBlob, err = s.seal(batch.Salt, item.HashKey, item.ResultBlob); err != nil {
+			return err
+		}
+		_, err = tx.NamedExec(`
+		INSERT INTO message_batch_items (batch_id, custom_id, hash_key, cached, result_blob)
+		VALUES (:batch_id, :custom_id, :hash_key, :cached, :result_blob)
+		`, &item)
+		if err != nil {
+			return fmt.Errorf("failed to insert batch item: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// GetBatch retrieves a batch by id
+func (s *Store) GetBatch(batchID string) (*MessageBatch, error) {
+	batch := &MessageBatch{}
+	err := s.db.Get(batch, `SELECT * FROM message_batches WHERE batch_id = ?`, batchID)
+	if err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+// GetBatchItems retrieves the items of a batch in submission order, decrypting their
+// results with the salt of the batch's scope
+func (s *Store) GetBatchItems(batchID string, salt []byte) ([]MessageBatchItem, error) {
+	var items []MessageBatchItem
+	err := s.db.Select(&items, `SELECT * FROM message_batch_items WHERE batch_id = ? ORDER BY rowid`, batchID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range items {
+		if items[i].ResultBlob, err = s.open(salt, items[i].HashKey, items[i].ResultBlob); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+// ClaimBatchItem marks an upstream item as recorded. It reports false when the item was
+// already recorded (or does not exist), so each result is cached and audited only once
+// however often the results are fetched.
+func (s *Store) ClaimBatchItem(batchID, customID string) (bool, error) {
+	res, err := s.db.Exec(`
+	UPDATE message_batch_items SET recorded = true
+	WHERE batch_id = ? AND custom_id = ? AND NOT cached AND NOT recorded
+	`, batchID, customID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteBatch removes a batch and its items
+func (s *Store) DeleteBatch(batchID string) error {
+	if _, err := s.db.Exec(`DELETE FROM message_batch_items WHERE batch_id = ?`, batchID); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`DELETE FROM message_batches WHERE batch_id = ?`, batchID)
+	return err
+}
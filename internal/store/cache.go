@@ -1,40 +1,150 @@
 package store
 
 import (
+	"database/sql/driver"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// Vector is a FLOAT[] column value.
+// go-duckdb cannot bind Go slices directly, so vectors travel as DuckDB list literals.
+type Vector []float32
+
+// Value implements driver.Valuer
+func (v Vector) Value() (driver.Value, error) {
+	if v == nil {
+		return nil, nil
+	}
+	parts := make([]string, len(v))
+	for i, f := range v {
+		parts[i] = strconv.FormatFloat(float64(f), 'g', -1, 32)
+	}
+	return "[" + strings.Join(parts, ",") + "]", nil
+}
+
+// Scan implements sql.Scanner
+func (v *Vector) Scan(src any) error {
+	switch src := src.(type) {
+	case nil:
+		*v = nil
+	case []any:
+		out := make(Vector, len(src))
+		for i, e := range src {
+			f, ok := e.(float32)
+			if !ok {
+				return fmt.Errorf("unexpected vector element type %T", e)
+			}
+			out[i] = f
+		}
+		*v = out
+	default:
+		return fmt.Errorf("unsupported vector source type %T", src)
+	}
+	return nil
+}
+
 // CacheEntry represents a cached AI response
 type CacheEntry struct {
-	HashKey      string    `db:"hash_key"`
-	ScopeID      string    `db:"scope_id"`
-	SystemHash   string    `db:"system_hash"`
-	PromptVector []float32 `db:"prompt_vector"`
+	HashKey    string `db:"hash_key"`
+	ScopeID    string `db:"scope_id"`
+	SystemHash string `db:"system_hash"`
+	// Model is the model the request asked for, so similar prompts only match its answers
+	Model string `db:"model"`
+	// ContextHash identifies the conversation history the request's final turn continues,
+	// so similar prompts only match answers given at the same point of a conversation
+	ContextHash  string    `db:"context_hash"`
+	PromptVector Vector    `db:"prompt_vector"`
 	ResponseBlob []byte    `db:"response_blob"`
 	CreatedAt    time.Time `db:"created_at"`
+	// ExpiresAt is when the entry stops being served (nil never expires)
+	ExpiresAt *time.Time `db:"expires_at"`
+	// Salt is the scope's key derivation salt, used to encrypt ResponseBlob (never stored)
+	Salt []byte `db:"-"`
 }
 
-// GetCache retrieves a cache entry by its hash key
-func (s *Store) GetCache(hashKey string) (*CacheEntry, error) {
+// GetCache retrieves an unexpired cache entry by its hash key, decrypting it with the
+// salt of the scope it was stored in
+func (s *Store) GetCache(hashKey string, salt []byte) (*CacheEntry, error) {
 	entry := &CacheEntry{}
-	query := `SELECT * FROM cache_entries WHERE hash_key = ?`
-	err := s.db.Get(entry, query, hashKey)
+	query := `SELECT * FROM cache_entries WHERE hash_key = ? AND (expires_at IS NULL OR expires_at > ?)`
+	err := s.db.Get(entry, query, hashKey, time.Now())
 	if err != nil {
 		return nil, err
 	}
+	if entry.ResponseBlob, err = s.open(salt, hashKey, entry.ResponseBlob); err != nil {
+		return nil, err
+	}
+	entry.Salt = salt
 	return entry, nil
 }
 
-// SetCache inserts or updates a cache entry
+// SetCache inserts or updates a cache entry, encrypting its response with entry.Salt
+// when the store has a cipher
 func (s *Store) SetCache(entry *CacheEntry) error {
 	if entry.CreatedAt.IsZero() {
 		entry.CreatedAt = time.Now()
 	}
+	sealed := *entry
+	var err error
+	if sealed.ResponseBlob, err = s.seal(entry.Salt, entry.HashKey, entry.ResponseBlob); err != nil {
+		return err
+	}
 
 	query := `
-	INSERT OR REPLACE INTO cache_entries (hash_key, scope_id, system_hash, prompt_vector, response_blob, created_at)
-	VALUES (:hash_key, :scope_id, :system_hash, :prompt_vector, :response_blob, :created_at)
+	INSERT OR REPLACE INTO cache_entries (hash_key, scope_id, system_hash, model, context_hash, prompt_vector, response_blob, created_at, expires_at)
+	VALUES (:hash_key, :scope_id, :system_hash, :model, :context_hash, :prompt_vector, :response_blob, :created_at, :expires_at)
 	`
-	_, err := s.db.NamedExec(query, entry)
+	_, err = s.db.NamedExec(query, &sealed)
+	return err
+}
+
+// DeleteCache removes a cache entry
+func (s *Store) DeleteCache(hashKey string) error {
+	_, err := s.db.Exec(`DELETE FROM cache_entries WHERE hash_key = ?`, hashKey)
 	return err
 }
+
+// SimilarQuery selects the cache entries of a scope with the same system prompt, model and
+// conversation history as a request, ranked by the similarity of their prompt vectors
+type SimilarQuery struct {
+	ScopeID     string
+	SystemHash  string
+	Model       string
+	ContextHash string
+	Vector      Vector
+	// Expired includes entries past their expiry, to serve stale answers
+	Expired bool
+	Limit   int
+}
+
+// SimilarEntry is a cache entry with the cosine similarity of its prompt vector
+type SimilarEntry struct {
+	CacheEntry
+	Similarity float64 `db:"similarity"`
+}
+
+// SimilarCache returns the entries most similar to the query vector, most similar first,
+// decrypting them with the scope salt
+func (s *Store) SimilarCache(q SimilarQuery, salt []byte) ([]SimilarEntry, error) {
+	var entries []SimilarEntry
+	query := `
+	SELECT *, list_cosine_similarity(prompt_vector, ?::FLOAT[]) AS similarity FROM cache_entries
+	WHERE scope_id = ? AND system_hash = ? AND model = ? AND context_hash = ? AND prompt_vector IS NOT NULL
+	AND (? OR expires_at IS NULL OR expires_at > ?)
+	ORDER BY similarity DESC LIMIT ?
+	`
+	err := s.db.Select(&entries, query, q.Vector, q.ScopeID, q.SystemHash, q.Model, q.ContextHash, q.Expired, time.Now(), q.Limit)
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		entry := &entries[i].CacheEntry
+		if entry.ResponseBlob, err = s.open(salt, entry.HashKey, entry.ResponseBlob); err != nil {
+			return nil, err
+		}
+		entry.Salt = salt
+	}
+	return entries, nil
+}
@@ -0,0 +1,179 @@
+package store
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// sealedPrefix marks encrypted blobs: prefix | nonce | AES-GCM ciphertext
+var sealedPrefix = []byte("mxe1")
+
+// keyInfo binds derived keys to their use
+const keyInfo = "memex cache blob v1"
+
+// ErrEncrypted is returned when reading an encrypted blob without a cipher
+var ErrEncrypted = errors.New("blob is encrypted; configure the encryption key")
+
+// Cipher encrypts blobs at rest with AES-256-GCM. Each scope gets its own key, derived
+// with HKDF-SHA256 from the master secret and the scope salt, so data of one scope cannot
+// be decrypted with another scope's key.
+type Cipher struct {
+	secret []byte
+}
+
+// NewCipher creates a cipher for the master secret
+func NewCipher(secret string) *Cipher {
+	return &Cipher{secret: []byte(secret)}
+}
+
+// aead returns the AES-GCM instance for a scope salt
+func (c *Cipher) aead(salt []byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, c.secret, salt, keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypts plaintext for the scope. aad (e.g. the row's key) is authenticated but
+// not stored, so a blob moved to another row fails to decrypt.
+func (c *Cipher) Seal(salt []byte, aad string, plaintext []byte) ([]byte, error) {
+	gcm, err := c.aead(salt)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(sealedPrefix)+gcm.NonceSize(), len(sealedPrefix)+gcm.NonceSize()+len(plaintext)+gcm.Overhead())
+	copy(out, sealedPrefix)
+	nonce := out[len(sealedPrefix):]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(out, nonce, plaintext, []byte(aad)), nil
+}
+
+// Open decrypts a blob sealed for the scope
+func (c *Cipher) Open(salt []byte, aad string, blob []byte) ([]byte, error) {
+	if !IsSealed(blob) {
+		return nil, errors.New("blob is not encrypted")
+	}
+	gcm, err := c.aead(salt)
+	if err != nil {
+		return nil, err
+	}
+	rest := blob[len(sealedPrefix):]
+	if len(rest) < gcm.NonceSize() {
+		return nil, errors.New("encrypted blob is truncated")
+	}
+	plaintext, err := gcm.Open(nil, rest[:gcm.NonceSize()], rest[gcm.NonceSize():], []byte(aad))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt blob: %w", err)
+	}
+	return plaintext, nil
+}
+
+// IsSealed reports whether a blob was encrypted by a Cipher
+func IsSealed(blob []byte) bool {
+	return bytes.HasPrefix(blob, sealedPrefix)
+}
+
+// seal encrypts a blob when the store has a cipher
+func (s *Store) seal(salt []byte, aad string, blob []byte) ([]byte, error) {
+	if s.cipher == nil || blob == nil {
+		return blob, nil
+	}
+	return s.cipher.Seal(salt, aad, blob)
+}
+
+// open decrypts a blob. Plaintext blobs written before encryption was enabled are
+// returned as they are until Reencrypt converts them.
+func (s *Store) open(salt []byte, aad string, blob []byte) ([]byte, error) {
+	if !IsSealed(blob) {
+		return blob, nil
+	}
+	if s.cipher == nil {
+		return nil, ErrEncrypted
+	}
+	return s.cipher.Open(salt, aad, blob)
+}
+
+// UseCipher encrypts blobs written from now on and decrypts those read
+func (s *Store) UseCipher(c *Cipher) {
+	s.cipher = c
+}
+
+// Reencrypt rewrites every stored blob from one cipher to another. A nil from cipher
+// reads plaintext blobs only; a nil to cipher stores plaintext. salt returns the key
+// derivation salt of a scope ID. It returns the number of blobs rewritten.
+func (s *Store) Reencrypt(from, to *Cipher, salt func(scopeID string) []byte) (int, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	type row struct {
+		HashKey  string `db:"hash_key"`
+		ScopeID  string `db:"scope_id"`
+		BatchID  string `db:"batch_id"`
+		CustomID string `db:"custom_id"`
+		Blob     []byte `db:"blob"`
+	}
+	tables := []struct {
+		query  string
+		update string
+		where  func(r row) []any
+	}{
+		{
+			`SELECT hash_key, scope_id, '' AS batch_id, '' AS custom_id, response_blob AS blob
+			FROM cache_entries WHERE response_blob IS NOT NULL`,
+			`UPDATE cache_entries SET response_blob = ? WHERE hash_key = ?`,
+			func(r row) []any { return []any{r.HashKey} },
+		},
+		{
+			`SELECT i.hash_key, b.scope_id, i.batch_id, i.custom_id, i.result_blob AS blob
+			FROM message_batch_items i JOIN message_batches b USING (batch_id) WHERE i.result_blob IS NOT NULL`,
+			`UPDATE message_batch_items SET result_blob = ? WHERE batch_id = ? AND custom_id = ?`,
+			func(r row) []any { return []any{r.BatchID, r.CustomID} },
+		},
+	}
+
+	count := 0
+	for _, table := range tables {
+		var rows []row
+		if err := tx.Select(&rows, table.query); err != nil {
+			return 0, err
+		}
+		for _, r := range rows {
+			blob := r.Blob
+			scopeSalt := salt(r.ScopeID)
+			if IsSealed(blob) {
+				if from == nil {
+					return 0, fmt.Errorf("%s: %w", r.HashKey, ErrEncrypted)
+				}
+				if blob, err = from.Open(scopeSalt, r.HashKey, blob); err != nil {
+					return 0, fmt.Errorf("%s: %w", r.HashKey, err)
+				}
+			}
+			if to != nil {
+				if blob, err = to.Seal(scopeSalt, r.HashKey, blob); err != nil {
+					return 0, err
+				}
+			}
+			if _, err := tx.Exec(table.update, append([]any{blob}, table.where(r)...)...); err != nil {
+				return 0, err
+			}
+			count++
+		}
+	}
+	return count, tx.Commit()
+}
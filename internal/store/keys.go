@@ -0,0 +1,57 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+)
+
+// VirtualKey is an API key issued by memex to a user. Only its hash is stored.
+type VirtualKey struct {
+	// KeyID is the key's public prefix, used to list and revoke it
+	KeyID     string     `db:"key_id"`
+	KeyHash   string     `db:"key_hash"`
+	UserID    string     `db:"user_id"`
+	Name      string     `db:"name"`
+	CreatedAt time.Time  `db:"created_at"`
+	RevokedAt *time.Time `db:"revoked_at"`
+}
+
+// CreateVirtualKey records a newly issued key
+func (s *Store) CreateVirtualKey(key *VirtualKey) error {
+	if key.CreatedAt.IsZero() {
+		key.CreatedAt = time.Now()
+	}
+	_, err := s.db.NamedExec(`
+	INSERT INTO virtual_keys (key_id, key_hash, user_id, name, created_at, revoked_at)
+	VALUES (:key_id, :key_hash, :user_id, :name, :created_at, :revoked_at)
+	`, key)
+	return err
+}
+
+// GetVirtualKey returns the key with the given hash, revoked or not
+func (s *Store) GetVirtualKey(keyHash string) (*VirtualKey, error) {
+	key := &VirtualKey{}
+	if err := s.db.Get(key, `SELECT * FROM virtual_keys WHERE key_hash = ?`, keyHash); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ListVirtualKeys returns all issued keys, oldest first
+func (s *Store) ListVirtualKeys() ([]VirtualKey, error) {
+	var keys []VirtualKey
+	err := s.db.Select(&keys, `SELECT * FROM virtual_keys ORDER BY created_at`)
+	return keys, err
+}
+
+// RevokeVirtualKey revokes a key by its ID. It returns sql.ErrNoRows when no active key has it.
+func (s *Store) RevokeVirtualKey(keyID string) error {
+	res, err := s.db.Exec(`UPDATE virtual_keys SET revoked_at = ? WHERE key_id = ? AND revoked_at IS NULL`, time.Now(), keyID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
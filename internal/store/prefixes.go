@@ -0,0 +1,70 @@
+package store
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// PrefixNode is a node of a scope's conversation prefix trie. Each node is the cumulative
+// hash of a conversation's first Depth messages; its parent covers one message less.
+type PrefixNode struct {
+	ScopeID    string    `db:"scope_id"`
+	PrefixHash string    `db:"prefix_hash"`
+	ParentHash string    `db:"parent_hash"`
+	Depth      int       `db:"depth"`
+	LastSeen   time.Time `db:"last_seen"`
+}
+
+// MatchPrefix returns how many leading prefixes of a conversation are already in the
+// scope's trie. hashes holds the cumulative hash of each prefix, shortest first.
+func (s *Store) MatchPrefix(scopeID string, hashes []string) (int, error) {
+	if len(hashes) == 0 {
+		return 0, nil
+	}
+	query, args, err := sqlx.In(`
+	SELECT COALESCE(MAX(depth), 0) FROM conversation_prefixes
+	WHERE scope_id = ? AND prefix_hash IN (?)
+	`, scopeID, hashes)
+	if err != nil {
+		return 0, err
+	}
+	var depth int
+	err = s.db.Get(&depth, s.db.Rebind(query), args...)
+	return depth, err
+}
+
+// RecordPrefixes adds the prefixes of a conversation beyond the first known ones to the
+// scope's trie and refreshes the last seen time of the deepest known prefix
+func (s *Store) RecordPrefixes(scopeID string, hashes []string, known int) error {
+	now := time.Now()
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if known > 0 {
+		_, err = tx.Exec(`UPDATE conversation_prefixes SET last_seen = ? WHERE scope_id = ? AND prefix_hash = ?`,
+			now, scopeID, hashes[known-1])
+		if err != nil {
+			return fmt.Errorf("failed to refresh prefix: %w", err)
+		}
+	}
+	for i := known; i < len(hashes); i++ {
+		node := &PrefixNode{ScopeID: scopeID, PrefixHash: hashes[i], Depth: i + 1, LastSeen: now}
+		if i > 0 {
+			node.ParentHash = hashes[i-1]
+		}
+		_, err = tx.NamedExec(`
+		INSERT INTO conversation_prefixes (scope_id, prefix_hash, parent_hash, depth, last_seen)
+		VALUES (:scope_id, :prefix_hash, :parent_hash, :depth, :last_seen)
+		ON CONFLICT DO NOTHING
+		`, node)
+		if err != nil {
+			return fmt.Errorf("failed to insert prefix: %w", err)
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,21 @@
+package store
+
+import (
+	"time"
+)
+
+// SetResponseChain records the content key of a cached OpenAI Responses API response.
+// Later requests of the same scope chaining onto the response id via previous_response_id
+// are keyed by it.
+func (s *Store) SetResponseChain(scopeID, responseID, contentKey string) error {
+	query := `INSERT OR REPLACE INTO response_chain (scope_id, response_id, content_key, created_at) VALUES (?, ?, ?, ?)`
+	_, err := s.db.Exec(query, scopeID, responseID, contentKey, time.Now())
+	return err
+}
+
+// GetResponseChain returns the content key recorded for a response id in the scope
+func (s *Store) GetResponseChain(scopeID, responseID string) (string, error) {
+	var key string
+	err := s.db.Get(&key, `SELECT content_key FROM response_chain WHERE scope_id = ? AND response_id = ?`, scopeID, responseID)
+	return key, err
+}
@@ -0,0 +1,36 @@
+package store
+
+import "time"
+
+// ShadowComparison records a shadowed cache miss: the most similar cached request that a
+// similarity match would have served, and how its answer compared with the fresh one
+type ShadowComparison struct {
+	Timestamp time.Time `db:"timestamp"`
+	ScopeID   string    `db:"scope_id"`
+	// CandidateKey is the hash key of the cached entry ("" when the scope had none)
+	CandidateKey string `db:"candidate_key"`
+	// PromptSimilarity is the cosine similarity of the two requests' prompt vectors
+	PromptSimilarity float64 `db:"prompt_similarity"`
+	// AnswerSimilarity is the text similarity of the cached and the fresh answer
+	AnswerSimilarity float64 `db:"answer_similarity"`
+}
+
+// RecordShadow stores a shadow comparison
+func (s *Store) RecordShadow(c *ShadowComparison) error {
+	if c.Timestamp.IsZero() {
+		c.Timestamp = time.Now()
+	}
+	query := `
+	INSERT INTO shadow_comparisons (timestamp, scope_id, candidate_key, prompt_similarity, answer_similarity)
+	VALUES (:timestamp, :scope_id, :candidate_key, :prompt_similarity, :answer_similarity)
+	`
+	_, err := s.db.NamedExec(query, c)
+	return err
+}
+
+// ShadowComparisons returns the comparisons recorded since a time, oldest first
+func (s *Store) ShadowComparisons(since time.Time) ([]ShadowComparison, error) {
+	var out []ShadowComparison
+	err := s.db.Select(&out, `SELECT * FROM shadow_comparisons WHERE timestamp >= ? ORDER BY timestamp`, since)
+	return out, err
+}
@@ -0,0 +1,62 @@
+package store
+
+import "time"
+
+// HitVerification records a cache hit that was sent upstream again to check that the
+// cached answer still matches a fresh one
+type HitVerification struct {
+	Timestamp time.Time `db:"timestamp"`
+	ScopeID   string    `db:"scope_id"`
+	HashKey   string    `db:"hash_key"`
+	// Similarity is the text similarity of the cached and the fresh answer
+	Similarity float64 `db:"similarity"`
+	// Evicted is set when the answers diverged and the entry was removed
+	Evicted bool `db:"evicted"`
+}
+
+// RecordVerification stores the outcome of a hit verification
+func (s *Store) RecordVerification(v *HitVerification) error {
+	if v.Timestamp.IsZero() {
+		v.Timestamp = time.Now()
+	}
+	query := `
+	INSERT INTO hit_verifications (timestamp, scope_id, hash_key, similarity, evicted)
+	VALUES (:timestamp, :scope_id, :hash_key, :similarity, :evicted)
+	`
+	_, err := s.db.NamedExec(query, v)
+	return err
+}
+
+// Stats summarises cache effectiveness and quality over a period
+type Stats struct {
+	Requests int64 `db:"requests"`
+	Hits     int64 `db:"hits"`
+	// TokensSaved are the tokens of answers served from the cache
+	TokensSaved int64 `db:"tokens_saved"`
+	// Entries is the number of cached responses (regardless of the period)
+	Entries int64 `db:"entries"`
+	// Verified is the number of sampled hits checked against the upstream
+	Verified int64 `db:"verified"`
+	// MeanSimilarity is the mean answer similarity of the verified hits
+	MeanSimilarity float64 `db:"mean_similarity"`
+	// Evicted is the number of verified hits whose answers had diverged
+	Evicted int64 `db:"evicted"`
+}
+
+// Stats returns the cache statistics since a time
+func (s *Store) Stats(since time.Time) (*Stats, error) {
+	stats := &Stats{}
+	query := `
+	SELECT
+		(SELECT COUNT(*) FROM audit_logs WHERE timestamp >= $1) AS requests,
+		(SELECT COUNT(*) FROM audit_logs WHERE timestamp >= $1 AND cache_hit) AS hits,
+		(SELECT CAST(COALESCE(SUM(tokens_in + tokens_out), 0) AS BIGINT) FROM audit_logs
+			WHERE timestamp >= $1 AND cache_hit) AS tokens_saved,
+		(SELECT COUNT(*) FROM cache_entries) AS entries,
+		(SELECT COUNT(*) FROM hit_verifications WHERE timestamp >= $1) AS verified,
+		(SELECT COALESCE(AVG(similarity), 0) FROM hit_verifications WHERE timestamp >= $1) AS mean_similarity,
+		(SELECT COUNT(*) FROM hit_verifications WHERE timestamp >= $1 AND evicted) AS evicted
+	`
+	err := s.db.Get(stats, query, since)
+	return stats, err
+}
@@ -12,6 +12,8 @@ import (
 // Store represents the DuckDB storage engine
 type Store struct {
 	db *sqlx.DB
+	// cipher encrypts blobs at rest (nil stores plaintext)
+	cipher *Cipher
 }
 
 // NewStore initializes a new DuckDB store in the .memex directory
@@ -50,7 +52,9 @@ func (s *Store) initSchema() error {
 		tokens_in INTEGER,
 		tokens_out INTEGER,
 		cost DOUBLE,
-		latency INTEGER
+		latency INTEGER,
+		schema TEXT,
+		cache_hit BOOLEAN DEFAULT false
 	);
 
 	CREATE TABLE IF NOT EXISTS cache_entries (
@@ -59,8 +63,80 @@ func (s *Store) initSchema() error {
 		system_hash TEXT,
 		prompt_vector FLOAT[],
 		response_blob BLOB,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS response_chain (
+		scope_id TEXT,
+		response_id TEXT,
+		content_key TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (scope_id, response_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS message_batches (
+		batch_id TEXT PRIMARY KEY,
+		scope_id TEXT,
+		upstream BOOLEAN,
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 	);
+
+	CREATE TABLE IF NOT EXISTS message_batch_items (
+		batch_id TEXT,
+		custom_id TEXT,
+		hash_key TEXT,
+		cached BOOLEAN,
+		result_blob BLOB
+	);
+
+	CREATE TABLE IF NOT EXISTS conversation_prefixes (
+		scope_id TEXT,
+		prefix_hash TEXT,
+		parent_hash TEXT,
+		depth INTEGER,
+		last_seen TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (scope_id, prefix_hash)
+	);
+
+	CREATE TABLE IF NOT EXISTS virtual_keys (
+		key_id TEXT PRIMARY KEY,
+		key_hash TEXT UNIQUE,
+		user_id TEXT,
+		name TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		revoked_at TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS shadow_comparisons (
+		timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		scope_id TEXT,
+		candidate_key TEXT,
+		prompt_similarity DOUBLE,
+		answer_similarity DOUBLE
+	);
+
+	CREATE TABLE IF NOT EXISTS hit_verifications (
+		timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		scope_id TEXT,
+		hash_key TEXT,
+		similarity DOUBLE,
+		evicted BOOLEAN
+	);
+
+	-- Columns added after the initial schema
+	ALTER TABLE message_batch_items ADD COLUMN IF NOT EXISTS recorded BOOLEAN DEFAULT false;
+	ALTER TABLE cache_entries ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP;
+	ALTER TABLE cache_entries ADD COLUMN IF NOT EXISTS model TEXT DEFAULT '';
+	ALTER TABLE cache_entries ADD COLUMN IF NOT EXISTS context_hash TEXT DEFAULT '';
+	ALTER TABLE response_chain ADD COLUMN IF NOT EXISTS scope_id TEXT DEFAULT '';
+	ALTER TABLE audit_logs ADD COLUMN IF NOT EXISTS schema TEXT;
+	ALTER TABLE audit_logs ADD COLUMN IF NOT EXISTS cache_hit BOOLEAN DEFAULT false;
+	ALTER TABLE audit_logs ADD COLUMN IF NOT EXISTS message_count INTEGER DEFAULT 0;
+	ALTER TABLE audit_logs ADD COLUMN IF NOT EXISTS prefix_depth INTEGER DEFAULT 0;
+	ALTER TABLE audit_logs ADD COLUMN IF NOT EXISTS secrets_found INTEGER DEFAULT 0;
+	ALTER TABLE audit_logs ADD COLUMN IF NOT EXISTS user_id TEXT DEFAULT '';
+	ALTER TABLE audit_logs ADD COLUMN IF NOT EXISTS model TEXT DEFAULT '';
 	`
 	_, err := s.db.Exec(schema)
 	return err
@@ -0,0 +1,222 @@
+package types
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Role is the author of a conversation message
+type Role string
+
+const (
+	RoleUser      Role = "user"
+	RoleAssistant Role = "assistant"
+	// RoleSystem and RoleDeveloper are OpenAI instruction messages, which may appear
+	// anywhere in the conversation. Anthropic only has the top-level system prompt.
+	RoleSystem    Role = "system"
+	RoleDeveloper Role = "developer"
+	// RoleTool carries a single tool result (an OpenAI tool message)
+	RoleTool Role = "tool"
+)
+
+// BlockType is the kind of a content block
+type BlockType string
+
+const (
+	BlockText       BlockType = "text"
+	BlockImage      BlockType = "image"
+	BlockToolUse    BlockType = "tool_use"
+	BlockToolResult BlockType = "tool_result"
+	BlockThinking   BlockType = "thinking"
+	// BlockRaw is a block of a type the model does not know, kept verbatim in Raw
+	BlockRaw BlockType = "raw"
+)
+
+// ToolChoiceType says how the model may use tools
+type ToolChoiceType string
+
+const (
+	ToolChoiceAuto ToolChoiceType = "auto"
+	ToolChoiceAny  ToolChoiceType = "any"
+	ToolChoiceNone ToolChoiceType = "none"
+	ToolChoiceTool ToolChoiceType = "tool"
+)
+
+// DefaultMaxTokens is used when a conversation without a limit is sent to a provider that
+// requires one (the Anthropic Messages API)
+const DefaultMaxTokens = 4096
+
+// Conversation is a provider-neutral chat request.
+//
+// Parsing a provider body and serialising it back to the same provider is lossless: fields
+// without a neutral equivalent are kept in Extra (or Raw) and only written back to the
+// provider they came from (Source). Serialising to another provider translates what has
+// an equivalent and drops the rest.
+type Conversation struct {
+	// Source is the schema the conversation was parsed from
+	Source      SchemaType
+	Model       string
+	System      []ContentBlock
+	Messages    []Message
+	Tools       []Tool
+	ToolChoice  *ToolChoice
+	MaxTokens   int
+	Stream      bool
+	Temperature *float64
+	TopP        *float64
+	Stop        []string
+	Extra       map[string]json.RawMessage
+
+	// Wire details needed to serialise back to the source provider
+	systemPlain    bool
+	stopPlain      bool
+	maxTokensField string
+}
+
+// Message is one turn of a conversation
+type Message struct {
+	Role    Role
+	Content []ContentBlock
+	Extra   map[string]json.RawMessage
+
+	// plain is set when the content was a plain string rather than a list of blocks
+	plain bool
+}
+
+// ContentBlock is a piece of message content. Which fields are set depends on Type.
+type ContentBlock struct {
+	Type BlockType
+	// Text is the text of text blocks and the reasoning of thinking blocks
+	Text string
+	// Image is the source of image blocks
+	Image *ImageSource
+	// ToolUseID identifies the call of tool_use blocks and the call answered by tool_result blocks
+	ToolUseID string
+	// ToolName and Input are the tool and its JSON arguments of tool_use blocks
+	ToolName string
+	Input    json.RawMessage
+	// Content and IsError are the output of tool_result blocks
+	Content []ContentBlock
+	IsError bool
+	// Signature verifies thinking blocks with the provider that produced them
+	Signature string
+	// Raw is the verbatim JSON of raw blocks
+	Raw   json.RawMessage
+	Extra map[string]json.RawMessage
+
+	// plain is set when a tool result's content was a plain string
+	plain bool
+}
+
+// ImageSource is inline image data or a link to an image
+type ImageSource struct {
+	MediaType string
+	// Data is base64 encoded
+	Data string
+	URL  string
+	// Detail is the OpenAI image detail level (e.g. "low")
+	Detail string
+}
+
+// Tool is a function the model may call
+type Tool struct {
+	Name        string
+	Description string
+	InputSchema json.RawMessage
+	// Raw is the verbatim JSON of provider tools without an input schema (e.g. web search)
+	Raw   json.RawMessage
+	Extra map[string]json.RawMessage
+}
+
+// ToolChoice constrains tool use. Name is set for ToolChoiceTool.
+type ToolChoice struct {
+	Type  ToolChoiceType
+	Name  string
+	Extra map[string]json.RawMessage
+}
+
+// TextBlock returns a text content block
+func TextBlock(text string) ContentBlock {
+	return ContentBlock{Type: BlockText, Text: text}
+}
+
+// Text returns the text of the message, joining its text blocks
+func (m *Message) Text() string {
+	return blocksText(m.Content)
+}
+
+// SystemText returns the system prompt, including OpenAI system and developer messages
+func (c *Conversation) SystemText() string {
+	parts := []string{}
+	if text := blocksText(c.System); text != "" {
+		parts = append(parts, text)
+	}
+	for i := range c.Messages {
+		if c.Messages[i].Role == RoleSystem || c.Messages[i].Role == RoleDeveloper {
+			parts = append(parts, c.Messages[i].Text())
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// blocksText joins the text of text blocks
+func blocksText(blocks []ContentBlock) string {
+	var parts []string
+	for _, b := range blocks {
+		if b.Type == BlockText && b.Text != "" {
+			parts = append(parts, b.Text)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// jsonObject is a JSON object whose fields are consumed as they are parsed;
+// what remains are the extra fields
+type jsonObject map[string]json.RawMessage
+
+// take decodes and removes a field, reporting whether it was present
+func (o jsonObject) take(key string, v any) (bool, error) {
+	raw, ok := o[key]
+	if !ok {
+		return false, nil
+	}
+	delete(o, key)
+	if string(raw) == "null" {
+		return true, nil
+	}
+	return true, json.Unmarshal(raw, v)
+}
+
+// str removes and returns a string field, or "" when it is missing or not a string
+func (o jsonObject) str(key string) string {
+	var s string
+	if _, err := o.take(key, &s); err != nil {
+		return ""
+	}
+	return s
+}
+
+// extra returns the remaining fields, or nil when there are none
+func (o jsonObject) extra() map[string]json.RawMessage {
+	if len(o) == 0 {
+		return nil
+	}
+	return o
+}
+
+// object builds a JSON object for serialisation, adding extra fields when the
+// conversation is serialised back to the provider they came from
+func object(extra map[string]json.RawMessage, keep bool) map[string]any {
+	m := make(map[string]any)
+	if keep {
+		for k, v := range extra {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+// isJSONString reports whether raw JSON is a string rather than an array or object
+func isJSONString(raw json.RawMessage) bool {
+	return len(raw) > 0 && raw[0] == '"'
+}
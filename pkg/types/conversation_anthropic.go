@@ -0,0 +1,358 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ParseAnthropic parses an Anthropic Messages API request body
+func ParseAnthropic(body []byte) (*Conversation, error) {
+	var o jsonObject
+	if err := json.Unmarshal(body, &o); err != nil {
+		return nil, err
+	}
+	c := &Conversation{Source: SchemaAnthropic, Model: o.str("model")}
+
+	if raw, ok := o["system"]; ok {
+		delete(o, "system")
+		system, plain, err := parseAnthropicContent(raw)
+		if err != nil {
+			return nil, fmt.Errorf("system: %w", err)
+		}
+		c.System, c.systemPlain = system, plain
+	}
+
+	var messages []jsonObject
+	if _, err := o.take("messages", &messages); err != nil {
+		return nil, fmt.Errorf("messages: %w", err)
+	}
+	for i, m := range messages {
+		msg := Message{Role: Role(m.str("role"))}
+		raw := m["content"]
+		delete(m, "content")
+		content, plain, err := parseAnthropicContent(raw)
+		if err != nil {
+			return nil, fmt.Errorf("messages[%d]: %w", i, err)
+		}
+		msg.Content, msg.plain, msg.Extra = content, plain, m.extra()
+		c.Messages = append(c.Messages, msg)
+	}
+
+	var tools []jsonObject
+	if _, err := o.take("tools", &tools); err != nil {
+		return nil, fmt.Errorf("tools: %w", err)
+	}
+	for _, t := range tools {
+		if _, ok := t["input_schema"]; !ok {
+			raw, _ := json.Marshal(t)
+			c.Tools = append(c.Tools, Tool{Name: t.str("name"), Raw: raw})
+			continue
+		}
+		tool := Tool{Name: t.str("name"), Description: t.str("description"), InputSchema: t["input_schema"]}
+		delete(t, "input_schema")
+		tool.Extra = t.extra()
+		c.Tools = append(c.Tools, tool)
+	}
+
+	var choice jsonObject
+	if ok, err := o.take("tool_choice", &choice); err != nil {
+		return nil, fmt.Errorf("tool_choice: %w", err)
+	} else if ok && choice != nil {
+		c.ToolChoice = &ToolChoice{Type: ToolChoiceType(choice.str("type")), Name: choice.str("name")}
+		c.ToolChoice.Extra = choice.extra()
+	}
+
+	if _, err := o.take("max_tokens", &c.MaxTokens); err != nil {
+		return nil, fmt.Errorf("max_tokens: %w", err)
+	}
+	if _, err := o.take("stream", &c.Stream); err != nil {
+		return nil, fmt.Errorf("stream: %w", err)
+	}
+	if _, err := o.take("temperature", &c.Temperature); err != nil {
+		return nil, fmt.Errorf("temperature: %w", err)
+	}
+	if _, err := o.take("top_p", &c.TopP); err != nil {
+		return nil, fmt.Errorf("top_p: %w", err)
+	}
+	if _, err := o.take("stop_sequences", &c.Stop); err != nil {
+		return nil, fmt.Errorf("stop_sequences: %w", err)
+	}
+	c.Extra = o.extra()
+	return c, nil
+}
+
+// parseAnthropicContent parses content given as a string or as a list of blocks
+func parseAnthropicContent(raw json.RawMessage) ([]ContentBlock, bool, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, false, nil
+	}
+	if isJSONString(raw) {
+		var text string
+		if err := json.Unmarshal(raw, &text); err != nil {
+			return nil, false, err
+		}
+		return []ContentBlock{TextBlock(text)}, true, nil
+	}
+
+	var items []json.RawMessage
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return nil, false, err
+	}
+	blocks := make([]ContentBlock, 0, len(items))
+	for _, item := range items {
+		block, err := parseAnthropicBlock(item)
+		if err != nil {
+			return nil, false, err
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, false, nil
+}
+
+func parseAnthropicBlock(item json.RawMessage) (ContentBlock, error) {
+	var o jsonObject
+	if err := json.Unmarshal(item, &o); err != nil {
+		return ContentBlock{}, err
+	}
+	raw := ContentBlock{Type: BlockRaw, Raw: item}
+
+	var b ContentBlock
+	switch BlockType(o.str("type")) {
+	case BlockText:
+		b = ContentBlock{Type: BlockText, Text: o.str("text")}
+	case BlockImage:
+		var source jsonObject
+		if _, err := o.take("source", &source); err != nil {
+			return ContentBlock{}, err
+		}
+		image := &ImageSource{}
+		switch source.str("type") {
+		case "base64":
+			image.MediaType, image.Data = source.str("media_type"), source.str("data")
+		case "url":
+			image.URL = source.str("url")
+		default:
+			return raw, nil
+		}
+		if len(source) > 0 {
+			return raw, nil
+		}
+		b = ContentBlock{Type: BlockImage, Image: image}
+	case BlockToolUse:
+		b = ContentBlock{Type: BlockToolUse, ToolUseID: o.str("id"), ToolName: o.str("name"), Input: o["input"]}
+		delete(o, "input")
+	case BlockToolResult:
+		b = ContentBlock{Type: BlockToolResult, ToolUseID: o.str("tool_use_id")}
+		content, plain, err := parseAnthropicContent(o["content"])
+		if err != nil {
+			return ContentBlock{}, err
+		}
+		delete(o, "content")
+		b.Content, b.plain = content, plain
+		// An explicit "is_error": false stays in Extra so it survives a round trip
+		if string(o["is_error"]) == "true" {
+			b.IsError = true
+			delete(o, "is_error")
+		}
+	case BlockThinking:
+		b = ContentBlock{Type: BlockThinking, Text: o.str("thinking"), Signature: o.str("signature")}
+	default:
+		return raw, nil
+	}
+	b.Extra = o.extra()
+	return b, nil
+}
+
+// MarshalAnthropic serialises the conversation as an Anthropic Messages API request.
+// System and developer messages join the system prompt, tool results become user turns,
+// and consecutive turns of the same role are merged as the API requires them to alternate.
+func (c *Conversation) MarshalAnthropic() ([]byte, error) {
+	same := c.Source == SchemaAnthropic
+	out := object(c.Extra, same)
+	out["model"] = c.Model
+
+	system := append([]ContentBlock(nil), c.System...)
+	var messages []map[string]any
+	for i := range c.Messages {
+		msg := &c.Messages[i]
+		role := msg.Role
+		switch role {
+		case RoleSystem, RoleDeveloper:
+			system = append(system, msg.Content...)
+			continue
+		case RoleTool:
+			role = RoleUser
+		}
+		blocks := anthropicBlocks(msg.Content, same)
+
+		if n := len(messages); n > 0 && messages[n-1]["role"] == role && !same {
+			prev := messages[n-1]
+			prev["content"] = append(anthropicBlockList(prev["content"]), blocks...)
+			continue
+		}
+		m := object(msg.Extra, same)
+		m["role"] = role
+		if msg.plain && len(msg.Content) == 1 && msg.Content[0].Type == BlockText && (same || msg.Content[0].Text != "") {
+			m["content"] = msg.Content[0].Text
+		} else {
+			m["content"] = blocks
+		}
+		messages = append(messages, m)
+	}
+	if messages == nil {
+		messages = []map[string]any{}
+	}
+	out["messages"] = messages
+
+	if len(system) > 0 {
+		if (c.systemPlain || !same) && len(c.System) <= 1 && allText(system) {
+			out["system"] = blocksText(system)
+		} else {
+			out["system"] = anthropicBlocks(system, same)
+		}
+	}
+
+	if len(c.Tools) > 0 {
+		var tools []any
+		for _, t := range c.Tools {
+			if t.Raw != nil {
+				if same {
+					tools = append(tools, t.Raw)
+				}
+				continue
+			}
+			tool := object(t.Extra, same)
+			tool["name"] = t.Name
+			if t.Description != "" {
+				tool["description"] = t.Description
+			}
+			tool["input_schema"] = t.InputSchema
+			tools = append(tools, tool)
+		}
+		if len(tools) > 0 {
+			out["tools"] = tools
+		}
+	}
+	if c.ToolChoice != nil {
+		choice := object(c.ToolChoice.Extra, same)
+		choice["type"] = c.ToolChoice.Type
+		if c.ToolChoice.Type == ToolChoiceTool {
+			choice["name"] = c.ToolChoice.Name
+		}
+		out["tool_choice"] = choice
+	}
+
+	switch {
+	case c.MaxTokens > 0:
+		out["max_tokens"] = c.MaxTokens
+	case !same:
+		out["max_tokens"] = DefaultMaxTokens
+	}
+	if c.Stream {
+		out["stream"] = true
+	}
+	if c.Temperature != nil {
+		out["temperature"] = *c.Temperature
+	}
+	if c.TopP != nil {
+		out["top_p"] = *c.TopP
+	}
+	if c.Stop != nil {
+		out["stop_sequences"] = c.Stop
+	}
+	return json.Marshal(out)
+}
+
+// anthropicBlocks serialises content blocks. Raw blocks and thinking blocks from
+// other providers are dropped.
+func anthropicBlocks(blocks []ContentBlock, same bool) []any {
+	out := []any{}
+	for _, b := range blocks {
+		if b.Type == BlockRaw {
+			if same {
+				out = append(out, b.Raw)
+			}
+			continue
+		}
+		if b.Type == BlockText && b.Text == "" && !same {
+			// The Messages API rejects empty text blocks
+			continue
+		}
+		m := object(b.Extra, same)
+		m["type"] = b.Type
+		switch b.Type {
+		case BlockText:
+			m["text"] = b.Text
+		case BlockImage:
+			m["source"] = anthropicImageSource(b.Image)
+		case BlockToolUse:
+			m["id"] = b.ToolUseID
+			m["name"] = b.ToolName
+			m["input"] = toolInput(b.Input)
+		case BlockToolResult:
+			m["tool_use_id"] = b.ToolUseID
+			switch {
+			case b.plain && allText(b.Content):
+				m["content"] = blocksText(b.Content)
+			case b.Content != nil:
+				m["content"] = anthropicBlocks(b.Content, same)
+			}
+			if b.IsError {
+				m["is_error"] = true
+			}
+		case BlockThinking:
+			if !same {
+				continue
+			}
+			m["thinking"] = b.Text
+			m["signature"] = b.Signature
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+// anthropicBlockList returns the blocks of a serialised message, converting plain text
+func anthropicBlockList(content any) []any {
+	if text, ok := content.(string); ok {
+		return []any{map[string]any{"type": BlockText, "text": text}}
+	}
+	blocks, _ := content.([]any)
+	return blocks
+}
+
+func anthropicImageSource(image *ImageSource) map[string]any {
+	if image == nil {
+		return nil
+	}
+	if image.URL != "" {
+		return map[string]any{"type": "url", "url": image.URL}
+	}
+	return map[string]any{"type": "base64", "media_type": image.MediaType, "data": image.Data}
+}
+
+// toolInput returns tool arguments as a JSON object, parsing arguments that were
+// given as a JSON-encoded string
+func toolInput(input json.RawMessage) json.RawMessage {
+	if len(input) == 0 {
+		return json.RawMessage("{}")
+	}
+	if isJSONString(input) {
+		var s string
+		if json.Unmarshal(input, &s) == nil && json.Valid([]byte(s)) {
+			return json.RawMessage(s)
+		}
+		return json.RawMessage("{}")
+	}
+	return input
+}
+
+// allText reports whether all blocks are text blocks
+func allText(blocks []ContentBlock) bool {
+	for _, b := range blocks {
+		if b.Type != BlockText {
+			return false
+		}
+	}
+	return true
+}
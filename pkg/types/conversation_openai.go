@@ -0,0 +1,403 @@
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ParseOpenAI parses an OpenAI Chat Completions request body
+func ParseOpenAI(body []byte) (*Conversation, error) {
+	var o jsonObject
+	if err := json.Unmarshal(body, &o); err != nil {
+		return nil, err
+	}
+	c := &Conversation{Source: SchemaOpenAI, Model: o.str("model")}
+
+	var messages []jsonObject
+	if _, err := o.take("messages", &messages); err != nil {
+		return nil, fmt.Errorf("messages: %w", err)
+	}
+	for i, m := range messages {
+		msg, err := parseOpenAIMessage(m)
+		if err != nil {
+			return nil, fmt.Errorf("messages[%d]: %w", i, err)
+		}
+		c.Messages = append(c.Messages, msg)
+	}
+
+	var tools []jsonObject
+	if _, err := o.take("tools", &tools); err != nil {
+		return nil, fmt.Errorf("tools: %w", err)
+	}
+	for _, t := range tools {
+		if string(t["type"]) != `"function"` || len(t) != 2 {
+			raw, _ := json.Marshal(t)
+			c.Tools = append(c.Tools, Tool{Raw: raw})
+			continue
+		}
+		var fn jsonObject
+		if _, err := t.take("function", &fn); err != nil {
+			return nil, fmt.Errorf("tools: %w", err)
+		}
+		tool := Tool{Name: fn.str("name"), Description: fn.str("description"), InputSchema: fn["parameters"]}
+		delete(fn, "parameters")
+		tool.Extra = fn.extra()
+		c.Tools = append(c.Tools, tool)
+	}
+
+	if raw, ok := o["tool_choice"]; ok {
+		if choice, ok := parseOpenAIToolChoice(raw); ok {
+			c.ToolChoice = choice
+			delete(o, "tool_choice")
+		}
+	}
+
+	for _, field := range []string{"max_completion_tokens", "max_tokens"} {
+		if ok, err := o.take(field, &c.MaxTokens); err != nil {
+			return nil, fmt.Errorf("%s: %w", field, err)
+		} else if ok {
+			c.maxTokensField = field
+			break
+		}
+	}
+	if _, err := o.take("stream", &c.Stream); err != nil {
+		return nil, fmt.Errorf("stream: %w", err)
+	}
+	if _, err := o.take("temperature", &c.Temperature); err != nil {
+		return nil, fmt.Errorf("temperature: %w", err)
+	}
+	if _, err := o.take("top_p", &c.TopP); err != nil {
+		return nil, fmt.Errorf("top_p: %w", err)
+	}
+	if raw, ok := o["stop"]; ok {
+		delete(o, "stop")
+		if isJSONString(raw) {
+			var stop string
+			json.Unmarshal(raw, &stop)
+			c.Stop, c.stopPlain = []string{stop}, true
+		} else if err := json.Unmarshal(raw, &c.Stop); err != nil {
+			return nil, fmt.Errorf("stop: %w", err)
+		}
+	}
+	c.Extra = o.extra()
+	return c, nil
+}
+
+// parseOpenAIMessage parses a message. Tool calls become tool_use blocks and a tool
+// message becomes a single tool_result block.
+func parseOpenAIMessage(m jsonObject) (Message, error) {
+	msg := Message{Role: Role(m.str("role"))}
+	raw := m["content"]
+	delete(m, "content")
+	content, plain, err := parseOpenAIContent(raw)
+	if err != nil {
+		return msg, err
+	}
+
+	switch msg.Role {
+	case RoleTool:
+		result := ContentBlock{Type: BlockToolResult, ToolUseID: m.str("tool_call_id"), Content: content, plain: plain}
+		msg.Content = []ContentBlock{result}
+	case RoleAssistant:
+		msg.Content, msg.plain = content, plain
+		var calls []jsonObject
+		if _, err := m.take("tool_calls", &calls); err != nil {
+			return msg, err
+		}
+		for _, call := range calls {
+			var fn jsonObject
+			if _, err := call.take("function", &fn); err != nil {
+				return msg, err
+			}
+			args := fn.str("arguments")
+			input := json.RawMessage(args)
+			if !json.Valid(input) {
+				input, _ = json.Marshal(args)
+			}
+			msg.Content = append(msg.Content, ContentBlock{
+				Type:      BlockToolUse,
+				ToolUseID: call.str("id"),
+				ToolName:  fn.str("name"),
+				Input:     input,
+			})
+		}
+	default:
+		msg.Content, msg.plain = content, plain
+	}
+	msg.Extra = m.extra()
+	return msg, nil
+}
+
+// parseOpenAIContent parses content given as a string or as a list of parts
+func parseOpenAIContent(raw json.RawMessage) ([]ContentBlock, bool, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, false, nil
+	}
+	if isJSONString(raw) {
+		var text string
+		if err := json.Unmarshal(raw, &text); err != nil {
+			return nil, false, err
+		}
+		return []ContentBlock{TextBlock(text)}, true, nil
+	}
+
+	var parts []json.RawMessage
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return nil, false, err
+	}
+	var blocks []ContentBlock
+	for _, part := range parts {
+		var o jsonObject
+		if err := json.Unmarshal(part, &o); err != nil {
+			return nil, false, err
+		}
+		switch o.str("type") {
+		case "text":
+			block := TextBlock(o.str("text"))
+			block.Extra = o.extra()
+			blocks = append(blocks, block)
+		case "image_url":
+			var image jsonObject
+			if _, err := o.take("image_url", &image); err != nil {
+				return nil, false, err
+			}
+			source := openAIImageSource(image.str("url"))
+			source.Detail = image.str("detail")
+			if len(image) > 0 || len(o) > 0 {
+				blocks = append(blocks, ContentBlock{Type: BlockRaw, Raw: part})
+				continue
+			}
+			blocks = append(blocks, ContentBlock{Type: BlockImage, Image: source})
+		default:
+			blocks = append(blocks, ContentBlock{Type: BlockRaw, Raw: part})
+		}
+	}
+	return blocks, false, nil
+}
+
+// openAIImageSource parses an image URL, which may be a base64 data URL
+func openAIImageSource(url string) *ImageSource {
+	if rest, ok := strings.CutPrefix(url, "data:"); ok {
+		if mediaType, data, ok := strings.Cut(rest, ";base64,"); ok {
+			return &ImageSource{MediaType: mediaType, Data: data}
+		}
+	}
+	return &ImageSource{URL: url}
+}
+
+func parseOpenAIToolChoice(raw json.RawMessage) (*ToolChoice, bool) {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		switch s {
+		case "auto":
+			return &ToolChoice{Type: ToolChoiceAuto}, true
+		case "required":
+			return &ToolChoice{Type: ToolChoiceAny}, true
+		case "none":
+			return &ToolChoice{Type: ToolChoiceNone}, true
+		}
+		return nil, false
+	}
+	var choice struct {
+		Type     string `json:"type"`
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if json.Unmarshal(raw, &choice) != nil || choice.Type != "function" || choice.Function.Name == "" {
+		return nil, false
+	}
+	return &ToolChoice{Type: ToolChoiceTool, Name: choice.Function.Name}, true
+}
+
+// MarshalOpenAI serialises the conversation as an OpenAI Chat Completions request.
+// The system prompt becomes a leading system message and tool results become tool
+// messages, which directly follow the assistant turn that called the tools.
+func (c *Conversation) MarshalOpenAI() ([]byte, error) {
+	same := c.Source == SchemaOpenAI
+	out := object(c.Extra, same)
+	out["model"] = c.Model
+
+	messages := []map[string]any{}
+	if len(c.System) > 0 {
+		messages = append(messages, map[string]any{"role": RoleSystem, "content": blocksText(c.System)})
+	}
+	for i := range c.Messages {
+		msg := &c.Messages[i]
+		// Tool results come first: the API requires them right after the tool calls
+		var rest []ContentBlock
+		for _, b := range msg.Content {
+			if b.Type != BlockToolResult {
+				rest = append(rest, b)
+				continue
+			}
+			m := map[string]any{"role": RoleTool, "tool_call_id": b.ToolUseID}
+			if msg.Role == RoleTool {
+				m = object(msg.Extra, same)
+				m["role"], m["tool_call_id"] = RoleTool, b.ToolUseID
+			}
+			if b.plain || !same {
+				m["content"] = blocksText(b.Content)
+			} else {
+				m["content"] = openAIParts(b.Content, same)
+			}
+			messages = append(messages, m)
+		}
+		if msg.Role == RoleTool || (len(rest) == 0 && len(msg.Content) > 0) {
+			continue
+		}
+
+		m := object(msg.Extra, same)
+		m["role"] = msg.Role
+		if msg.Role == RoleAssistant {
+			var text []ContentBlock
+			var calls []any
+			for _, b := range rest {
+				switch b.Type {
+				case BlockText:
+					text = append(text, b)
+				case BlockToolUse:
+					calls = append(calls, map[string]any{
+						"id":       b.ToolUseID,
+						"type":     "function",
+						"function": map[string]any{"name": b.ToolName, "arguments": toolArguments(b.Input, same)},
+					})
+				}
+			}
+			switch {
+			case len(text) == 0:
+				m["content"] = nil
+			case msg.plain || !same:
+				m["content"] = blocksText(text)
+			default:
+				m["content"] = openAIParts(text, same)
+			}
+			if calls != nil {
+				m["tool_calls"] = calls
+			}
+		} else if msg.plain && len(rest) == 1 && rest[0].Type == BlockText {
+			m["content"] = rest[0].Text
+		} else {
+			m["content"] = openAIParts(rest, same)
+		}
+		messages = append(messages, m)
+	}
+	out["messages"] = messages
+
+	if len(c.Tools) > 0 {
+		var tools []any
+		for _, t := range c.Tools {
+			if t.Raw != nil {
+				if same {
+					tools = append(tools, t.Raw)
+				}
+				continue
+			}
+			fn := object(t.Extra, same)
+			fn["name"] = t.Name
+			if t.Description != "" {
+				fn["description"] = t.Description
+			}
+			if t.InputSchema != nil {
+				fn["parameters"] = t.InputSchema
+			}
+			tools = append(tools, map[string]any{"type": "function", "function": fn})
+		}
+		if len(tools) > 0 {
+			out["tools"] = tools
+		}
+	}
+	if c.ToolChoice != nil {
+		switch c.ToolChoice.Type {
+		case ToolChoiceAuto:
+			out["tool_choice"] = "auto"
+		case ToolChoiceAny:
+			out["tool_choice"] = "required"
+		case ToolChoiceNone:
+			out["tool_choice"] = "none"
+		case ToolChoiceTool:
+			out["tool_choice"] = map[string]any{"type": "function", "function": map[string]any{"name": c.ToolChoice.Name}}
+		}
+	}
+
+	if c.MaxTokens > 0 {
+		field := c.maxTokensField
+		if field == "" {
+			field = "max_tokens"
+		}
+		out[field] = c.MaxTokens
+	}
+	if c.Stream {
+		out["stream"] = true
+		if !same {
+			// Other providers always report usage at the end of a stream
+			out["stream_options"] = map[string]any{"include_usage": true}
+		}
+	}
+	if c.Temperature != nil {
+		out["temperature"] = *c.Temperature
+	}
+	if c.TopP != nil {
+		out["top_p"] = *c.TopP
+	}
+	if c.stopPlain && len(c.Stop) == 1 {
+		out["stop"] = c.Stop[0]
+	} else if c.Stop != nil {
+		out["stop"] = c.Stop
+	}
+	return json.Marshal(out)
+}
+
+// openAIParts serialises content blocks as message parts. Blocks without an OpenAI
+// equivalent (e.g. thinking) are dropped.
+func openAIParts(blocks []ContentBlock, same bool) []any {
+	parts := []any{}
+	for _, b := range blocks {
+		switch b.Type {
+		case BlockText:
+			m := object(b.Extra, same)
+			m["type"], m["text"] = "text", b.Text
+			parts = append(parts, m)
+		case BlockImage:
+			image := map[string]any{"url": openAIImageURL(b.Image)}
+			if b.Image.Detail != "" {
+				image["detail"] = b.Image.Detail
+			}
+			parts = append(parts, map[string]any{"type": "image_url", "image_url": image})
+		case BlockRaw:
+			if same {
+				parts = append(parts, b.Raw)
+			}
+		}
+	}
+	return parts
+}
+
+// openAIImageURL returns the remote URL of an image, or a data URL for inline data
+func openAIImageURL(image *ImageSource) string {
+	if image.URL != "" {
+		return image.URL
+	}
+	return "data:" + image.MediaType + ";base64," + image.Data
+}
+
+// toolArguments returns tool input as the JSON-encoded string OpenAI expects.
+// Arguments parsed from OpenAI are returned verbatim.
+func toolArguments(input json.RawMessage, same bool) string {
+	if len(input) == 0 {
+		return "{}"
+	}
+	if isJSONString(input) {
+		var s string
+		if json.Unmarshal(input, &s) == nil {
+			return s
+		}
+	}
+	var b bytes.Buffer
+	if same || json.Compact(&b, input) != nil {
+		return string(input)
+	}
+	return b.String()
+}
@@ -0,0 +1,199 @@
+package types
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+const anthropicRequest = `{
+	"model": "claude-sonnet-4-5",
+	"max_tokens": 1024,
+	"stream": true,
+	"temperature": 0.2,
+	"stop_sequences": ["END"],
+	"metadata": {"user_id": "u1"},
+	"thinking": {"type": "enabled", "budget_tokens": 2000},
+	"system": [{"type": "text", "text": "You are terse.", "cache_control": {"type": "ephemeral"}}],
+	"tools": [
+		{"name": "read", "description": "Read a file", "input_schema": {"type": "object", "properties": {"path": {"type": "string"}}}},
+		{"type": "web_search_20250305", "name": "web_search", "max_uses": 2}
+	],
+	"tool_choice": {"type": "auto", "disable_parallel_tool_use": true},
+	"messages": [
+		{"role": "user", "content": "Read main.go"},
+		{"role": "assistant", "content": [
+			{"type": "thinking", "thinking": "I should read it.", "signature": "sig"},
+			{"type": "text", "text": "Reading."},
+			{"type": "tool_use", "id": "toolu_1", "name": "read", "input": {"path": "main.go"}}
+		]},
+		{"role": "user", "content": [
+			{"type": "tool_result", "tool_use_id": "toolu_1", "content": "package main", "is_error": false},
+			{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "iVBOR"}},
+			{"type": "document", "source": {"type": "text", "media_type": "text/plain", "data": "notes"}},
+			{"type": "text", "text": "Explain it", "cache_control": {"type": "ephemeral"}}
+		]}
+	]
+}`
+
+const openAIRequest = `{
+	"model": "gpt-4.1",
+	"max_completion_tokens": 512,
+	"stop": "END",
+	"user": "u1",
+	"response_format": {"type": "text"},
+	"tools": [{"type": "function", "function": {"name": "read", "description": "Read a file", "parameters": {"type": "object"}, "strict": true}}],
+	"tool_choice": "required",
+	"messages": [
+		{"role": "developer", "content": "You are terse."},
+		{"role": "user", "content": [
+			{"type": "text", "text": "What is this?"},
+			{"type": "image_url", "image_url": {"url": "data:image/png;base64,iVBOR", "detail": "low"}},
+			{"type": "input_audio", "input_audio": {"data": "UklG", "format": "wav"}}
+		]},
+		{"role": "assistant", "content": null, "tool_calls": [
+			{"id": "call_1", "type": "function", "function": {"name": "read", "arguments": "{\"path\":\"a.go\"}"}},
+			{"id": "call_2", "type": "function", "function": {"name": "read", "arguments": "{\"path\":\"b.go\"}"}}
+		]},
+		{"role": "tool", "tool_call_id": "call_1", "content": "package a"},
+		{"role": "tool", "tool_call_id": "call_2", "content": "package b"},
+		{"role": "user", "name": "dev", "content": "Thanks"}
+	]
+}`
+
+// assertJSONEqual compares two JSON documents ignoring formatting and key order
+func assertJSONEqual(t *testing.T, want, got []byte) {
+	t.Helper()
+	var w, g any
+	if err := json.Unmarshal(want, &w); err != nil {
+		t.Fatalf("invalid expected JSON: %v", err)
+	}
+	if err := json.Unmarshal(got, &g); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if !reflect.DeepEqual(w, g) {
+		t.Errorf("JSON differs\nwant: %s\ngot:  %s", want, got)
+	}
+}
+
+func TestConversation_AnthropicRoundTrip(t *testing.T) {
+	c, err := ParseAnthropic([]byte(anthropicRequest))
+	if err != nil {
+		t.Fatalf("ParseAnthropic failed: %v", err)
+	}
+	if c.MaxTokens != 1024 || !c.Stream || len(c.Messages) != 3 || len(c.Tools) != 2 {
+		t.Fatalf("unexpected conversation %+v", c)
+	}
+	blocks := c.Messages[1].Content
+	if blocks[0].Type != BlockThinking || blocks[2].Type != BlockToolUse || blocks[2].ToolName != "read" {
+		t.Errorf("unexpected assistant blocks %+v", blocks)
+	}
+	result := c.Messages[2].Content
+	if result[0].Type != BlockToolResult || result[0].Content[0].Text != "package main" ||
+		result[1].Image.MediaType != "image/png" || result[2].Type != BlockRaw {
+		t.Errorf("unexpected user blocks %+v", result)
+	}
+	if c.SystemText() != "You are terse." {
+		t.Errorf("unexpected system text %q", c.SystemText())
+	}
+
+	out, err := c.MarshalAnthropic()
+	if err != nil {
+		t.Fatalf("MarshalAnthropic failed: %v", err)
+	}
+	assertJSONEqual(t, []byte(anthropicRequest), out)
+}
+
+func TestConversation_OpenAIRoundTrip(t *testing.T) {
+	c, err := ParseOpenAI([]byte(openAIRequest))
+	if err != nil {
+		t.Fatalf("ParseOpenAI failed: %v", err)
+	}
+	if c.MaxTokens != 512 || c.ToolChoice.Type != ToolChoiceAny || len(c.Messages) != 6 {
+		t.Fatalf("unexpected conversation %+v", c)
+	}
+	if c.Messages[3].Role != RoleTool || c.Messages[3].Content[0].ToolUseID != "call_1" {
+		t.Errorf("unexpected tool message %+v", c.Messages[3])
+	}
+	if img := c.Messages[1].Content[1].Image; img.Data != "iVBOR" || img.Detail != "low" {
+		t.Errorf("unexpected image %+v", img)
+	}
+	if c.SystemText() != "You are terse." {
+		t.Errorf("unexpected system text %q", c.SystemText())
+	}
+
+	out, err := c.MarshalOpenAI()
+	if err != nil {
+		t.Fatalf("MarshalOpenAI failed: %v", err)
+	}
+	assertJSONEqual(t, []byte(openAIRequest), out)
+}
+
+func TestConversation_AnthropicToOpenAI(t *testing.T) {
+	c, err := ParseAnthropic([]byte(anthropicRequest))
+	if err != nil {
+		t.Fatalf("ParseAnthropic failed: %v", err)
+	}
+	out, err := c.MarshalOpenAI()
+	if err != nil {
+		t.Fatalf("MarshalOpenAI failed: %v", err)
+	}
+	want := `{
+		"model": "claude-sonnet-4-5",
+		"max_tokens": 1024,
+		"stream": true,
+		"stream_options": {"include_usage": true},
+		"temperature": 0.2,
+		"stop": ["END"],
+		"tools": [{"type": "function", "function": {"name": "read", "description": "Read a file", "parameters": {"type": "object", "properties": {"path": {"type": "string"}}}}}],
+		"tool_choice": "auto",
+		"messages": [
+			{"role": "system", "content": "You are terse."},
+			{"role": "user", "content": "Read main.go"},
+			{"role": "assistant", "content": "Reading.", "tool_calls": [
+				{"id": "toolu_1", "type": "function", "function": {"name": "read", "arguments": "{\"path\":\"main.go\"}"}}
+			]},
+			{"role": "tool", "tool_call_id": "toolu_1", "content": "package main"},
+			{"role": "user", "content": [
+				{"type": "image_url", "image_url": {"url": "data:image/png;base64,iVBOR"}},
+				{"type": "text", "text": "Explain it"}
+			]}
+		]
+	}`
+	assertJSONEqual(t, []byte(want), out)
+}
+
+func TestConversation_OpenAIToAnthropic(t *testing.T) {
+	c, err := ParseOpenAI([]byte(openAIRequest))
+	if err != nil {
+		t.Fatalf("ParseOpenAI failed: %v", err)
+	}
+	out, err := c.MarshalAnthropic()
+	if err != nil {
+		t.Fatalf("MarshalAnthropic failed: %v", err)
+	}
+	want := `{
+		"model": "gpt-4.1",
+		"max_tokens": 512,
+		"stop_sequences": ["END"],
+		"system": "You are terse.",
+		"tools": [{"name": "read", "description": "Read a file", "input_schema": {"type": "object"}}],
+		"tool_choice": {"type": "any"},
+		"messages": [
+			{"role": "user", "content": [
+				{"type": "text", "text": "What is this?"},
+				{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "iVBOR"}}
+			]},
+			{"role": "assistant", "content": [
+				{"type": "tool_use", "id": "call_1", "name": "read", "input": {"path": "a.go"}},
+				{"type": "tool_use", "id": "call_2", "name": "read", "input": {"path": "b.go"}}
+			]},
+			{"role": "user", "content": [
+				{"type": "tool_result", "tool_use_id": "call_1", "content": "package a"},
+				{"type": "tool_result", "tool_use_id": "call_2", "content": "package b"},
+				{"type": "text", "text": "Thanks"}
+			]}
+		]
+	}`
+	assertJSONEqual(t, []byte(want), out)
+}
@@ -0,0 +1,8 @@
+package types
+
+// Identity is the authenticated user a request is made on behalf of
+type Identity struct {
+	User string
+	// Method is how the user authenticated ("basic" or "bearer")
+	Method string
+}
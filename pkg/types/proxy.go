@@ -14,6 +14,14 @@ const (
 	SchemaUnknown SchemaType = iota
 	SchemaAnthropic
 	SchemaOpenAI
+	SchemaMCP
+	SchemaGemini
+	SchemaOpenAIResponses
+	SchemaOllama
+	SchemaEmbeddings
+	SchemaAnthropicCountTokens
+	SchemaModels
+	SchemaAnthropicBatches
 )
 
 func (s SchemaType) String() string {
@@ -22,6 +30,22 @@ func (s SchemaType) String() string {
 		return "Anthropic"
 	case SchemaOpenAI:
 		return "OpenAI"
+	case SchemaMCP:
+		return "MCP"
+	case SchemaGemini:
+		return "Gemini"
+	case SchemaOpenAIResponses:
+		return "OpenAIResponses"
+	case SchemaOllama:
+		return "Ollama"
+	case SchemaEmbeddings:
+		return "Embeddings"
+	case SchemaAnthropicCountTokens:
+		return "AnthropicCountTokens"
+	case SchemaModels:
+		return "Models"
+	case SchemaAnthropicBatches:
+		return "AnthropicBatches"
 	default:
 		return "Unknown"
 	}
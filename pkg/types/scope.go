@@ -8,6 +8,8 @@ type ScopeType int
 const (
 	ScopeTypeGitRemote ScopeType = iota
 	ScopeTypePathHash
+	ScopeTypeSubdir
+	ScopeTypeGlobal
 )
 
 // String returns the string representation of ScopeType
@@ -17,6 +19,10 @@ func (s ScopeType) String() string {
 		return "GitRemote"
 	case ScopeTypePathHash:
 		return "PathHash"
+	case ScopeTypeSubdir:
+		return "Subdir"
+	case ScopeTypeGlobal:
+		return "Global"
 	default:
 		return "Unknown"
 	}
@@ -28,11 +34,23 @@ type ScopeContext struct {
 	ID string
 	// Type indicates how the ID was derived
 	Type ScopeType
-	// Salt is a cryptographic salt derived from ID (used in cache key generation)
+	// Salt is a cryptographic salt derived from ID (used in cache key generation and to
+	// derive the scope's encryption key)
 	Salt []byte
+	// Parent is the scope consulted when a lookup misses in this one (optional)
+	Parent *ScopeContext
 }
 
 // String returns a string representation of the ScopeContext
 func (s *ScopeContext) String() string {
 	return fmt.Sprintf("%s (%s)", s.ID, s.Type)
 }
+
+// Chain returns the scope followed by its parents, in lookup order
+func (s *ScopeContext) Chain() []*ScopeContext {
+	var chain []*ScopeContext
+	for cur := s; cur != nil; cur = cur.Parent {
+		chain = append(chain, cur)
+	}
+	return chain
+}
@@ -0,0 +1,127 @@
+package integration
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/braw-dev/memex/internal/proxy"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestProxyAuthentication(t *testing.T) {
+	var leaked bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			leaked = true
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(anthropicJSON))
+	}))
+	defer upstream.Close()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("bcrypt failed: %v", err)
+	}
+	usersFile := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(usersFile, []byte("# team\nalice:"+string(hash)+"\n"), 0600); err != nil {
+		t.Fatalf("Failed to write users file: %v", err)
+	}
+	basic := func(user, password string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+	}
+	allow := true
+
+	tests := []struct {
+		name     string
+		listen   string
+		auth     proxy.AuthConfig
+		header   string
+		expected int
+		user     string
+	}{
+		{"No auth configured on loopback", "127.0.0.1:0", proxy.AuthConfig{}, "", http.StatusOK, ""},
+		{"No auth configured on shared listener", ":0", proxy.AuthConfig{}, "", http.StatusProxyAuthRequired, ""},
+		{"Anonymous rejected on shared listener", ":0", proxy.AuthConfig{UsersFile: usersFile}, "", http.StatusProxyAuthRequired, ""},
+		{"Wrong password", ":0", proxy.AuthConfig{UsersFile: usersFile}, basic("alice", "guess"), http.StatusProxyAuthRequired, ""},
+		{"Basic auth", ":0", proxy.AuthConfig{UsersFile: usersFile}, basic("alice", "s3cret"), http.StatusOK, "alice"},
+		{"Bearer token", ":0", proxy.AuthConfig{Tokens: []proxy.AuthToken{{User: "ci", Token: "tok-123"}}}, "Bearer tok-123", http.StatusOK, "ci"},
+		{"Empty bearer never matches an empty token", ":0", proxy.AuthConfig{Tokens: []proxy.AuthToken{{User: "ghost"}, {User: "ci", Token: "tok-123"}}},
+			"Bearer ", http.StatusProxyAuthRequired, ""},
+		{"Anonymous allowed on loopback", "127.0.0.1:0", proxy.AuthConfig{UsersFile: usersFile}, "", http.StatusOK, ""},
+		{"Anonymous allowed explicitly", ":0", proxy.AuthConfig{UsersFile: usersFile, Anonymous: &allow}, "", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, st := newCachingProxy(t, &proxy.ProxyConfig{
+				ListenAddr:      tt.listen,
+				UpstreamTimeout: 5 * time.Second,
+				IdleTimeout:     5 * time.Second,
+				Auth:            tt.auth,
+			})
+			body := `{"model":"claude","max_tokens":100,"messages":[{"role":"user","content":"hi"}]}`
+			req, _ := http.NewRequest("POST", upstream.URL+"/v1/messages", strings.NewReader(body))
+			if tt.header != "" {
+				req.Header.Set("Proxy-Authorization", tt.header)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.expected {
+				t.Fatalf("Expected status %d, got %d", tt.expected, resp.StatusCode)
+			}
+			if tt.expected == http.StatusProxyAuthRequired && resp.Header.Get("Proxy-Authenticate") == "" {
+				t.Error("Expected a Proxy-Authenticate challenge")
+			}
+			if tt.expected != http.StatusOK {
+				return
+			}
+			var users []string
+			for i := 0; i < 50 && len(users) == 0; i++ {
+				st.DB().Select(&users, `SELECT user_id FROM audit_logs`)
+				time.Sleep(10 * time.Millisecond)
+			}
+			if len(users) != 1 || users[0] != tt.user {
+				t.Errorf("Expected audit log for user '%s', got %v", tt.user, users)
+			}
+		})
+	}
+	if leaked {
+		t.Error("Proxy-Authorization was forwarded upstream")
+	}
+}
+
+func TestCheckAuth(t *testing.T) {
+	allow := true
+	tests := []struct {
+		name   string
+		listen string
+		auth   proxy.AuthConfig
+		fails  bool
+	}{
+		{"Loopback without auth", "127.0.0.1:8080", proxy.AuthConfig{}, false},
+		{"Shared listener without auth", ":8080", proxy.AuthConfig{}, true},
+		{"Shared listener with tokens", ":8080", proxy.AuthConfig{Tokens: []proxy.AuthToken{{User: "ci", Token: "tok-123"}}}, false},
+		{"Shared listener open explicitly", "0.0.0.0:8080", proxy.AuthConfig{Anonymous: &allow}, false},
+		{"Token without a value", "127.0.0.1:8080", proxy.AuthConfig{Tokens: []proxy.AuthToken{{User: "ghost"}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := proxy.CheckAuth(&proxy.ProxyConfig{ListenAddr: tt.listen, Auth: tt.auth})
+			if (err != nil) != tt.fails {
+				t.Errorf("Expected failure %v, got %v", tt.fails, err)
+			}
+		})
+	}
+}
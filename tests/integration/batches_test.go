@@ -0,0 +1,189 @@
+package integration
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/braw-dev/memex/internal/proxy"
+)
+
+func TestMessageBatchSplitting(t *testing.T) {
+	var submitted [][]string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/v1/messages":
+			w.Write([]byte(`{"id":"msg_direct","type":"message","content":[{"type":"text","text":"direct"}],"usage":{"input_tokens":5,"output_tokens":1}}`))
+		case r.Method == "POST" && r.URL.Path == "/v1/messages/batches":
+			var body struct {
+				Requests []struct {
+					CustomID string `json:"custom_id"`
+				} `json:"requests"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			var ids []string
+			for _, req := range body.Requests {
+				ids = append(ids, req.CustomID)
+			}
+			submitted = append(submitted, ids)
+			w.Write([]byte(`{"id":"msgbatch_up","type":"message_batch","processing_status":"ended","request_counts":{"processing":0,"succeeded":` +
+				strconv.Itoa(len(ids)) + `,"errored":0,"canceled":0,"expired":0}}`))
+		case r.URL.Path == "/v1/messages/batches/msgbatch_up/results":
+			for _, id := range submitted[len(submitted)-1] {
+				w.Write([]byte(`{"custom_id":"` + id + `","result":{"type":"succeeded","message":{"id":"msg_` + id +
+					`","type":"message","model":"claude","content":[{"type":"text","text":"` + id + `"}],"usage":{"input_tokens":5,"output_tokens":1}}}}` + "\n"))
+			}
+		default:
+			t.Errorf("Unexpected upstream request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer upstream.Close()
+
+	client, st := newCachingProxy(t, &proxy.ProxyConfig{
+		ListenAddr:      "127.0.0.1:0",
+		UpstreamTimeout: 5 * time.Second,
+		IdleTimeout:     5 * time.Second,
+		Cache:           proxy.CacheConfig{LLM: proxy.LLMCacheConfig{Enabled: true}},
+		Prices:          []proxy.ModelPrice{{Model: "claude", Input: 1e6, Output: 1e6}},
+	})
+
+	params := func(prompt string) string {
+		return `{"model":"claude","max_tokens":10,"messages":[{"role":"user","content":"` + prompt + `"}]}`
+	}
+	do := func(method, path, body string) (string, string) {
+		req, _ := http.NewRequest(method, upstream.URL+path, strings.NewReader(body))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return string(data), resp.Header.Get("X-Memex-Cache")
+	}
+	results := func(id string) map[string]string {
+		body, _ := do("GET", "/v1/messages/batches/"+id+"/results", "")
+		texts := make(map[string]string)
+		scanner := bufio.NewScanner(strings.NewReader(body))
+		for scanner.Scan() {
+			var line struct {
+				CustomID string `json:"custom_id"`
+				Result   struct {
+					Message struct {
+						Content []struct {
+							Text string `json:"text"`
+						} `json:"content"`
+					} `json:"message"`
+				} `json:"result"`
+			}
+			json.Unmarshal(scanner.Bytes(), &line)
+			texts[line.CustomID] = line.Result.Message.Content[0].Text
+		}
+		return texts
+	}
+
+	// Warm the cache with a regular request
+	do("POST", "/v1/messages", params("one"))
+
+	batch := `{"requests":[{"custom_id":"a","params":` + params("one") + `},{"custom_id":"b","params":` + params("two") + `}]}`
+	body, status := do("POST", "/v1/messages/batches", batch)
+	if status != "partial" {
+		t.Errorf("Expected partial batch, got '%s'", status)
+	}
+	if len(submitted) != 1 || strings.Join(submitted[0], ",") != "b" {
+		t.Errorf("Expected only 'b' to be submitted upstream, got %v", submitted)
+	}
+	if !strings.Contains(body, `"succeeded":2`) {
+		t.Errorf("Expected cached item counted as succeeded, got %s", body)
+	}
+
+	texts := results("msgbatch_up")
+	if texts["a"] != "direct" || texts["b"] != "b" {
+		t.Errorf("Unexpected merged results %v", texts)
+	}
+
+	// Fetching the results again records nothing new
+	if texts = results("msgbatch_up"); texts["b"] != "b" {
+		t.Errorf("Unexpected results on second fetch %v", texts)
+	}
+	// Audit logs are written asynchronously; give a duplicate time to appear
+	time.Sleep(100 * time.Millisecond)
+	var rows, tokens int
+	var cost float64
+	st.DB().QueryRow(`SELECT COUNT(*), COALESCE(SUM(tokens_in), 0), COALESCE(SUM(cost), 0) FROM audit_logs
+		WHERE schema = 'AnthropicBatches' AND NOT cache_hit AND model = 'claude'`).Scan(&rows, &tokens, &cost)
+	if rows != 1 || tokens != 5 || cost != 6 {
+		t.Errorf("Expected the upstream result audited once with 5 input tokens for $6, got %d rows with %d for $%f", rows, tokens, cost)
+	}
+
+	// Both items are now cached, so the same batch never reaches upstream
+	body, status = do("POST", "/v1/messages/batches", batch)
+	if status != "hit" {
+		t.Errorf("Expected batch answered from cache, got '%s'", status)
+	}
+	var local struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal([]byte(body), &local)
+	if !strings.HasPrefix(local.ID, "msgbatch_memex_") {
+		t.Fatalf("Expected a local batch id, got %s", body)
+	}
+	if _, status := do("GET", "/v1/messages/batches/"+local.ID, ""); status != "hit" {
+		t.Errorf("Expected local batch retrieval, got '%s'", status)
+	}
+	texts = results(local.ID)
+	if texts["a"] != "direct" || texts["b"] != "b" {
+		t.Errorf("Unexpected local results %v", texts)
+	}
+	if len(submitted) != 1 {
+		t.Errorf("Expected no further upstream submissions, got %v", submitted)
+	}
+
+	// Recorded batches are still served once the LLM cache is disabled
+	disabled := httptest.NewServer(proxy.NewServer(&proxy.ProxyConfig{
+		ListenAddr:      "127.0.0.1:0",
+		UpstreamTimeout: 5 * time.Second,
+		IdleTimeout:     5 * time.Second,
+	}, proxy.WithStore(st)))
+	defer disabled.Close()
+	disabledURL, _ := url.Parse(disabled.URL)
+	client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(disabledURL)}}
+	if _, status := do("GET", "/v1/messages/batches/"+local.ID, ""); status != "hit" {
+		t.Errorf("Expected local batch retrieval with the LLM cache disabled, got '%s'", status)
+	}
+	if texts = results(local.ID); texts["a"] != "direct" || texts["b"] != "b" {
+		t.Errorf("Unexpected local results with the LLM cache disabled %v", texts)
+	}
+
+	// Batches recorded for another scope are not found, locally or upstream
+	st.DB().Exec(`UPDATE message_batches SET scope_id = 'other'`)
+	for _, tt := range []struct{ method, path string }{
+		{"GET", "/v1/messages/batches/" + local.ID},
+		{"GET", "/v1/messages/batches/" + local.ID + "/results"},
+		{"DELETE", "/v1/messages/batches/" + local.ID},
+		{"GET", "/v1/messages/batches/msgbatch_up/results"},
+	} {
+		req, _ := http.NewRequest(tt.method, upstream.URL+tt.path, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound || !strings.Contains(string(body), "not_found_error") {
+			t.Errorf("Expected %s %s to be not found, got %d %s", tt.method, tt.path, resp.StatusCode, body)
+		}
+	}
+	var batches int
+	st.DB().QueryRow(`SELECT COUNT(*) FROM message_batches`).Scan(&batches)
+	if batches != 2 {
+		t.Errorf("Expected the other scope's batches to be kept, got %d", batches)
+	}
+}
@@ -0,0 +1,161 @@
+package integration
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/braw-dev/memex/internal/proxy"
+)
+
+func TestBudgets(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(anthropicJSON))
+	}))
+	defer upstream.Close()
+
+	client, st := newCachingProxy(t, &proxy.ProxyConfig{
+		ListenAddr:      "127.0.0.1:0",
+		UpstreamTimeout: 5 * time.Second,
+		IdleTimeout:     5 * time.Second,
+		Cache:           proxy.CacheConfig{LLM: proxy.LLMCacheConfig{Enabled: true}},
+		// Each response uses 12 + 3 tokens
+		Budgets: []proxy.Budget{
+			{Name: "daily-tokens", User: "*", Period: "daily", Tokens: 18},
+			{Name: "gpt-dollars", Model: "gpt-*", Period: "monthly", Dollars: 100},
+		},
+		Prices: []proxy.ModelPrice{{Model: "claude*", Input: 10000, Output: 20000}},
+	})
+
+	// waitForLogs waits until n audit logs have been written
+	waitForLogs := func(n int) {
+		var count int
+		for i := 0; i < 50 && count < n; i++ {
+			st.DB().Get(&count, `SELECT COUNT(*) FROM audit_logs`)
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	send := func(path, prompt string) (*http.Response, string) {
+		body := `{"model":"claude-sonnet","max_tokens":100,"messages":[{"role":"user","content":"` + prompt + `"}]}`
+		switch {
+		case strings.Contains(path, "chat"):
+			body = `{"model":"gpt-4.1","messages":[{"role":"user","content":"` + prompt + `"}]}`
+		case strings.Contains(path, "batches"):
+			body = `{"requests":[{"custom_id":"a","params":` + body + `}]}`
+		}
+		req, _ := http.NewRequest("POST", upstream.URL+path, strings.NewReader(body))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp, string(data)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		prompt  string
+		logs    int
+		status  int
+		warning string
+		body    string
+	}{
+		{"Within budget", "/v1/messages", "first", 1, http.StatusOK, "", ""},
+		{"Nearly used up", "/v1/messages", "second", 2, http.StatusOK, "daily-tokens=83%", ""},
+		{"Exceeded", "/v1/messages", "third", 2, http.StatusTooManyRequests, "",
+			`{"error":{"message":"memex budget \"daily-tokens\" exceeded`},
+		{"Cache hits still served", "/v1/messages", "first", 3, http.StatusOK, "", ""},
+		{"Exceeded in the OpenAI schema", "/v1/chat/completions", "fourth", 3, http.StatusTooManyRequests, "",
+			`"type":"insufficient_quota"`},
+		{"Batch creation blocked", "/v1/messages/batches", "fifth", 3, http.StatusTooManyRequests, "",
+			`memex budget \"daily-tokens\" exceeded`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := send(tt.path, tt.prompt)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("Expected status %d, got %d: %s", tt.status, resp.StatusCode, body)
+			}
+			if got := resp.Header.Get("X-Memex-Budget"); got != tt.warning {
+				t.Errorf("Expected budget warning '%s', got '%s'", tt.warning, got)
+			}
+			if !strings.Contains(body, tt.body) {
+				t.Errorf("Expected body to contain %s, got %s", tt.body, body)
+			}
+			waitForLogs(tt.logs)
+		})
+	}
+
+	var cost float64
+	st.DB().Get(&cost, `SELECT SUM(cost) FROM audit_logs WHERE model = 'claude-sonnet'`)
+	if cost < 0.359 || cost > 0.361 {
+		t.Errorf("Expected two upstream responses costing $0.36, got $%f", cost)
+	}
+}
+
+func TestUncachedUsageAudited(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("case") {
+		case "cut":
+			// The stream ends without message_stop, as when the client goes away
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte(strings.TrimSuffix(anthropicSSE, "event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n")))
+		case "error":
+			// An error that still reports the tokens it consumed
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"type":"error","error":{"type":"invalid_request_error","message":"bad tool call"},"usage":{"input_tokens":12,"output_tokens":3}}`))
+		case "large":
+			// An answer too large to keep, with usage in its first and last events
+			w.Header().Set("Content-Type", "text/event-stream")
+			delta := "event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"" +
+				strings.Repeat("x", 1<<20) + "\"}}\n\n"
+			w.Write([]byte(anthropicSSE[:strings.Index(anthropicSSE, "event: content_block_delta")]))
+			for i := 0; i < 9; i++ {
+				w.Write([]byte(delta))
+			}
+			w.Write([]byte(anthropicSSE[strings.Index(anthropicSSE, "event: message_delta"):]))
+		}
+	}))
+	defer upstream.Close()
+
+	client, st := newCachingProxy(t, &proxy.ProxyConfig{
+		ListenAddr:      "127.0.0.1:0",
+		UpstreamTimeout: 5 * time.Second,
+		IdleTimeout:     5 * time.Second,
+		Cache:           proxy.CacheConfig{LLM: proxy.LLMCacheConfig{Enabled: true}},
+	})
+
+	for i, name := range []string{"cut", "error", "large"} {
+		t.Run(name, func(t *testing.T) {
+			body := `{"model":"claude","max_tokens":100,"stream":true,"messages":[{"role":"user","content":"` + name + `"}]}`
+			for attempt := 0; attempt < 2; attempt++ {
+				req, _ := http.NewRequest("POST", upstream.URL+"/v1/messages?case="+name, strings.NewReader(body))
+				resp, err := client.Do(req)
+				if err != nil {
+					t.Fatalf("Request failed: %v", err)
+				}
+				io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if status := resp.Header.Get("X-Memex-Cache"); status == "hit" {
+					t.Errorf("Expected the response not to be cached")
+				}
+			}
+			// Both attempts were billed
+			var rows, tokens int
+			for j := 0; j < 50 && rows < 2*(i+1); j++ {
+				st.DB().QueryRow(`SELECT COUNT(*), COALESCE(SUM(tokens_in + tokens_out), 0) FROM audit_logs`).Scan(&rows, &tokens)
+				time.Sleep(10 * time.Millisecond)
+			}
+			if rows != 2*(i+1) || tokens != 30*(i+1) {
+				t.Errorf("Expected %d audit logs with %d tokens, got %d with %d", 2*(i+1), 30*(i+1), rows, tokens)
+			}
+		})
+	}
+}
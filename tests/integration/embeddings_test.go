@@ -0,0 +1,106 @@
+package integration
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/braw-dev/memex/internal/proxy"
+)
+
+func TestEmbeddingsPerItemCaching(t *testing.T) {
+	var received [][]string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Input []string `json:"input"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Failed to decode upstream request: %v", err)
+		}
+		received = append(received, req.Input)
+
+		// Each embedding is the length of its input, so answers can be matched to inputs
+		var data []map[string]any
+		for i, input := range req.Input {
+			data = append(data, map[string]any{"object": "embedding", "index": i, "embedding": []float64{float64(len(input))}})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"object": "list",
+			"data":   data,
+			"model":  "text-embedding-3-small",
+			"usage":  map[string]any{"prompt_tokens": len(req.Input), "total_tokens": len(req.Input)},
+		})
+	}))
+	defer upstream.Close()
+
+	client, _ := newCachingProxy(t, &proxy.ProxyConfig{
+		ListenAddr:      "127.0.0.1:0",
+		UpstreamTimeout: 5 * time.Second,
+		IdleTimeout:     5 * time.Second,
+	})
+
+	embed := func(input string) ([]float64, string) {
+		body := `{"model":"text-embedding-3-small","input":` + input + `}`
+		resp, err := client.Post(upstream.URL+"/v1/embeddings", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var out struct {
+			Data []struct {
+				Index     int       `json:"index"`
+				Embedding []float64 `json:"embedding"`
+			} `json:"data"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		var lengths []float64
+		for i, d := range out.Data {
+			if d.Index != i {
+				t.Errorf("Expected index %d, got %d", i, d.Index)
+			}
+			lengths = append(lengths, d.Embedding[0])
+		}
+		return lengths, resp.Header.Get("X-Memex-Cache")
+	}
+
+	tests := []struct {
+		input    string
+		expected []float64
+		status   string
+		upstream []string
+	}{
+		{input: `["a","bb","ccc"]`, expected: []float64{1, 2, 3}, status: "miss", upstream: []string{"a", "bb", "ccc"}},
+		{input: `["bb","dddd","a"]`, expected: []float64{2, 4, 1}, status: "partial", upstream: []string{"dddd"}},
+		{input: `"ccc"`, expected: []float64{3}, status: "hit"},
+	}
+	for i, tt := range tests {
+		before := len(received)
+		got, status := embed(tt.input)
+		if status != tt.status {
+			t.Errorf("%d: expected status '%s', got '%s'", i, tt.status, status)
+		}
+		if len(got) != len(tt.expected) {
+			t.Fatalf("%d: expected %v, got %v", i, tt.expected, got)
+		}
+		for j := range got {
+			if got[j] != tt.expected[j] {
+				t.Errorf("%d: expected %v, got %v", i, tt.expected, got)
+			}
+		}
+		if tt.upstream == nil {
+			if len(received) != before {
+				t.Errorf("%d: expected no upstream call", i)
+			}
+			continue
+		}
+		if len(received) != before+1 || strings.Join(received[before], ",") != strings.Join(tt.upstream, ",") {
+			t.Errorf("%d: expected upstream inputs %v, got %v", i, tt.upstream, received[before:])
+		}
+	}
+}
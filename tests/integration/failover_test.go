@@ -0,0 +1,330 @@
+package integration
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/braw-dev/memex/internal/proxy"
+)
+
+func TestFailoverAnthropicToOpenAI(t *testing.T) {
+	primaryDown := true
+	primaryCalls := 0
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryCalls++
+		if primaryDown {
+			w.WriteHeader(529)
+			w.Write([]byte(`{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"msg_1","type":"message","content":[{"type":"text","text":"primary"}],"usage":{"input_tokens":1,"output_tokens":1}}`))
+	}))
+	defer primary.Close()
+
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			t.Errorf("Expected chat completions path, got %s", r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "Bearer sk-fallback" || r.Header.Get("x-api-key") != "" {
+			t.Errorf("Expected only the fallback credentials, got %v", r.Header)
+		}
+		var req struct {
+			Model    string           `json:"model"`
+			Stream   bool             `json:"stream"`
+			Messages []map[string]any `json:"messages"`
+			Tools    []map[string]any `json:"tools"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Model != "gpt-fallback" {
+			t.Errorf("Expected model override, got %s", req.Model)
+		}
+		if len(req.Messages) != 4 || req.Messages[0]["role"] != "system" || req.Messages[3]["role"] != "tool" ||
+			req.Messages[3]["tool_call_id"] != "toolu_1" || req.Messages[3]["content"] != "file contents" {
+			t.Errorf("Unexpected translated messages %v", req.Messages)
+		}
+		if len(req.Tools) != 1 || req.Tools[0]["type"] != "function" {
+			t.Errorf("Unexpected translated tools %v", req.Tools)
+		}
+
+		if !req.Stream {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"id":"c1","model":"gpt-fallback","choices":[{"index":0,"message":{"role":"assistant","content":"Let me look",` +
+				`"tool_calls":[{"id":"call_1","type":"function","function":{"name":"read","arguments":"{\"path\":\"b.go\"}"}}]},` +
+				`"finish_reason":"tool_calls"}],"usage":{"prompt_tokens":20,"completion_tokens":8}}`))
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range []string{
+			`{"id":"c2","model":"gpt-fallback","choices":[{"index":0,"delta":{"role":"assistant","content":"Let"}}]}`,
+			`{"id":"c2","model":"gpt-fallback","choices":[{"index":0,"delta":{"content":" me look"}}]}`,
+			`{"id":"c2","model":"gpt-fallback","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_2","type":"function","function":{"name":"read","arguments":""}}]}}]}`,
+			`{"id":"c2","model":"gpt-fallback","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"path\":\"b.go\"}"}}]}}]}`,
+			`{"id":"c2","model":"gpt-fallback","choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`,
+			`{"id":"c2","model":"gpt-fallback","choices":[],"usage":{"prompt_tokens":20,"completion_tokens":8}}`,
+			`[DONE]`,
+		} {
+			w.Write([]byte("data: " + chunk + "\n\n"))
+		}
+	}))
+	defer fallback.Close()
+
+	client, st := newCachingProxy(t, &proxy.ProxyConfig{
+		ListenAddr:      "127.0.0.1:0",
+		UpstreamTimeout: 5 * time.Second,
+		IdleTimeout:     5 * time.Second,
+		Cache:           proxy.CacheConfig{LLM: proxy.LLMCacheConfig{Enabled: true}},
+		Failover: []proxy.FailoverRule{
+			{Host: "127.0.0.1", Upstream: fallback.URL, Schema: "openai", Model: "gpt-fallback", APIKey: "sk-fallback"},
+		},
+		Prices: []proxy.ModelPrice{{Model: "gpt-fallback", Input: 1e6, Output: 1e6}},
+	})
+
+	send := func(stream bool) (*http.Response, string) {
+		body := `{"model":"claude","max_tokens":100,"stream":` + map[bool]string{true: "true", false: "false"}[stream] +
+			`,"system":"Be brief","tools":[{"name":"read","description":"Read a file","input_schema":{"type":"object"}}],` +
+			`"messages":[{"role":"user","content":"Read a.go"},` +
+			`{"role":"assistant","content":[{"type":"tool_use","id":"toolu_1","name":"read","input":{"path":"a.go"}}]},` +
+			`{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":"file contents"}]}]}`
+		req, _ := http.NewRequest("POST", primary.URL+"/v1/messages", strings.NewReader(body))
+		req.Header.Set("x-api-key", "sk-ant-client")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp, string(data)
+	}
+
+	resp, body := send(false)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Memex-Failover") == "" {
+		t.Fatalf("Expected failover response, got %d %v: %s", resp.StatusCode, resp.Header, body)
+	}
+	var msg struct {
+		Type       string `json:"type"`
+		StopReason string `json:"stop_reason"`
+		Content    []struct {
+			Type  string         `json:"type"`
+			Text  string         `json:"text"`
+			ID    string         `json:"id"`
+			Input map[string]any `json:"input"`
+		} `json:"content"`
+		Usage map[string]int `json:"usage"`
+	}
+	if err := json.Unmarshal([]byte(body), &msg); err != nil {
+		t.Fatalf("Expected an Anthropic message, got %s", body)
+	}
+	if msg.Type != "message" || msg.StopReason != "tool_use" || len(msg.Content) != 2 ||
+		msg.Content[1].Type != "tool_use" || msg.Content[1].ID != "call_1" || msg.Content[1].Input["path"] != "b.go" {
+		t.Errorf("Unexpected translated message %s", body)
+	}
+	if msg.Usage["input_tokens"] != 20 || msg.Usage["output_tokens"] != 8 {
+		t.Errorf("Unexpected translated usage %v", msg.Usage)
+	}
+
+	resp, body = send(true)
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected a translated stream, got %s", resp.Header.Get("Content-Type"))
+	}
+	for _, want := range []string{
+		"event: message_start",
+		`"delta":{"text":"Let","type":"text_delta"}`,
+		`"content_block":{"id":"call_2","input":{},"name":"read","type":"tool_use"}`,
+		`"partial_json":"{\"path\":\"b.go\"}"`,
+		`"stop_reason":"tool_use"`,
+		"event: message_stop",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected stream to contain %s, got:\n%s", want, body)
+		}
+	}
+
+	// Fallback answers are billed and priced as the fallback model
+	var rows int
+	var cost float64
+	for i := 0; i < 50 && rows < 2; i++ {
+		st.DB().QueryRow(`SELECT COUNT(*), COALESCE(SUM(cost), 0) FROM audit_logs WHERE model = 'gpt-fallback'`).Scan(&rows, &cost)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rows != 2 || cost != 56 {
+		t.Errorf("Expected both fallback answers audited for $56, got %d rows for $%f", rows, cost)
+	}
+
+	// Fallback answers are not cached, so the recovered primary answers again
+	primaryDown = false
+	calls := primaryCalls
+	if _, body := send(false); !strings.Contains(body, "primary") || primaryCalls != calls+1 {
+		t.Errorf("Expected the primary to answer once it recovers, got %s", body)
+	}
+}
+
+func TestFailoverOpenAIToAnthropic(t *testing.T) {
+	// Nothing listens on the primary's address once it is closed
+	primary := httptest.NewServer(http.NotFoundHandler())
+	primary.Close()
+
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/messages" || r.Header.Get("x-api-key") != "sk-ant-fallback" {
+			t.Errorf("Unexpected fallback request %s %v", r.URL.Path, r.Header)
+		}
+		var req struct {
+			System    string           `json:"system"`
+			MaxTokens int              `json:"max_tokens"`
+			Messages  []map[string]any `json:"messages"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.System != "Be brief" || req.MaxTokens == 0 || len(req.Messages) != 1 {
+			t.Errorf("Unexpected translated request %+v", req)
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, e := range []string{
+			`message_start`, `{"type":"message_start","message":{"id":"msg_9","model":"claude","usage":{"input_tokens":12}}}`,
+			`content_block_start`, `{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+			`content_block_delta`, `{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}`,
+			`content_block_stop`, `{"type":"content_block_stop","index":0}`,
+			`message_delta`, `{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":3}}`,
+			`message_stop`, `{"type":"message_stop"}`,
+		} {
+			if strings.HasPrefix(e, "{") {
+				w.Write([]byte("data: " + e + "\n\n"))
+			} else {
+				w.Write([]byte("event: " + e + "\n"))
+			}
+		}
+	}))
+	defer fallback.Close()
+
+	client, _ := newCachingProxy(t, &proxy.ProxyConfig{
+		ListenAddr:      "127.0.0.1:0",
+		UpstreamTimeout: 5 * time.Second,
+		IdleTimeout:     5 * time.Second,
+		Cache:           proxy.CacheConfig{LLM: proxy.LLMCacheConfig{Enabled: true}},
+		Failover: []proxy.FailoverRule{
+			{Upstream: fallback.URL, Schema: "anthropic", APIKey: "sk-ant-fallback"},
+		},
+	})
+
+	body := `{"model":"gpt","stream":true,"stream_options":{"include_usage":true},` +
+		`"messages":[{"role":"system","content":"Be brief"},{"role":"user","content":"Hi"}]}`
+	req, _ := http.NewRequest("POST", primary.URL+"/v1/chat/completions", strings.NewReader(body))
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+
+	for _, want := range []string{
+		`"delta":{"content":"","role":"assistant"}`,
+		`"delta":{"content":"Hello"}`,
+		`"finish_reason":"stop"`,
+		`"usage":{"completion_tokens":3,"prompt_tokens":12,"total_tokens":15}`,
+		"data: [DONE]",
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("Expected stream to contain %s, got:\n%s", want, data)
+		}
+	}
+}
+
+func TestFailoverUnusableFallback(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(529)
+		w.Write([]byte(`{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`))
+	}))
+	defer primary.Close()
+
+	// The fallback request cannot even be built, so the primary's error is passed on
+	client, _ := newCachingProxy(t, &proxy.ProxyConfig{
+		ListenAddr:      "127.0.0.1:0",
+		UpstreamTimeout: 5 * time.Second,
+		IdleTimeout:     5 * time.Second,
+		Failover:        []proxy.FailoverRule{{Upstream: "http://[::1", Schema: "openai"}},
+	})
+
+	body := `{"model":"claude","max_tokens":100,"messages":[{"role":"user","content":"Hi"}]}`
+	req, _ := http.NewRequest("POST", primary.URL+"/v1/messages", strings.NewReader(body))
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 529 || !strings.Contains(string(data), "overloaded_error") || resp.Header.Get("X-Memex-Failover") != "" {
+		t.Errorf("Expected the primary's 529, got %d %v: %s", resp.StatusCode, resp.Header, data)
+	}
+}
+
+func TestFailoverBrokenFallback(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(529)
+	}))
+	defer primary.Close()
+
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Stream   bool `json:"stream"`
+			Messages []struct {
+				Content string `json:"content"`
+			} `json:"messages"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if !req.Stream {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":{"message":"context_length_exceeded","type":"invalid_request_error","param":null,"code":null}}`))
+			return
+		}
+		// The stream ends without finishing the answer or sending [DONE]
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(`data: {"id":"c1","model":"gpt","choices":[{"index":0,"delta":{"role":"assistant","content":"Half an"}}]}` + "\n\n"))
+	}))
+	defer fallback.Close()
+
+	client, _ := newCachingProxy(t, &proxy.ProxyConfig{
+		ListenAddr:      "127.0.0.1:0",
+		UpstreamTimeout: 5 * time.Second,
+		IdleTimeout:     5 * time.Second,
+		Failover:        []proxy.FailoverRule{{Upstream: fallback.URL, Schema: "openai"}},
+	})
+	send := func(stream string) (*http.Response, string) {
+		body := `{"model":"claude","max_tokens":100,"stream":` + stream + `,"messages":[{"role":"user","content":"Hi"}]}`
+		req, _ := http.NewRequest("POST", primary.URL+"/v1/messages", strings.NewReader(body))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp, string(data)
+	}
+
+	// The fallback's error arrives in the client's schema
+	resp, body := send("false")
+	var shaped struct {
+		Type  string `json:"type"`
+		Error struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	json.Unmarshal([]byte(body), &shaped)
+	if resp.StatusCode != http.StatusBadRequest || shaped.Type != "error" ||
+		shaped.Error.Type != "invalid_request_error" || shaped.Error.Message != "context_length_exceeded" {
+		t.Errorf("Expected an Anthropic-shaped 400 with the fallback's message, got %d: %s", resp.StatusCode, body)
+	}
+
+	// A cut-off stream ends with an error event, not a clean stop
+	_, body = send("true")
+	if !strings.Contains(body, `"text":"Half an"`) || !strings.Contains(body, "event: error") || strings.Contains(body, "message_stop") {
+		t.Errorf("Expected the stream to end with an error event, got:\n%s", body)
+	}
+}
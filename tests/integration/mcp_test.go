@@ -0,0 +1,207 @@
+package integration
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/braw-dev/memex/internal/proxy"
+	"github.com/braw-dev/memex/internal/store"
+)
+
+// newMCPUpstream returns a Streamable HTTP MCP server answering tools/call with the call count
+func newMCPUpstream(t *testing.T, calls *atomic.Int32, sse bool) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Mcp-Session-Id") != "session-1" {
+			t.Errorf("Expected Mcp-Session-Id to be passed through")
+		}
+		var req struct {
+			ID json.RawMessage `json:"id"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		n := calls.Add(1)
+
+		msg := `{"jsonrpc":"2.0","id":` + string(req.ID) + `,"result":{"content":[{"type":"text","text":"call ` + strconv.Itoa(int(n)) + `"}]}}`
+		if sse {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("event: message\ndata: " + msg + "\n\n"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(msg))
+	}))
+}
+
+func newCachingProxy(t *testing.T, config *proxy.ProxyConfig) (*http.Client, *store.Store) {
+	t.Helper()
+	st, err := store.NewStore(filepath.Join(t.TempDir(), "brain.duckdb"))
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+	t.Cleanup(func() { st.Close() })
+
+	proxyServer := httptest.NewServer(proxy.NewServer(config, proxy.WithStore(st)))
+	t.Cleanup(proxyServer.Close)
+
+	proxyURL, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyURL(proxyURL),
+		},
+	}
+	return client, st
+}
+
+func callTool(t *testing.T, client *http.Client, target, id, tool string) (string, string) {
+	t.Helper()
+	body := `{"jsonrpc":"2.0","id":` + id + `,"method":"tools/call","params":{"name":"` + tool + `","arguments":{"q":"go","limit":5}}}`
+	req, _ := http.NewRequest("POST", target+"/mcp", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json, text/event-stream")
+	req.Header.Set("Mcp-Session-Id", "session-1")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	return string(data), resp.Header.Get("X-Memex-Cache")
+}
+
+func TestMCPToolCallCaching(t *testing.T) {
+	for _, sse := range []bool{false, true} {
+		var calls atomic.Int32
+		upstream := newMCPUpstream(t, &calls, sse)
+		defer upstream.Close()
+
+		client, _ := newCachingProxy(t, &proxy.ProxyConfig{
+			ListenAddr:      "127.0.0.1:0",
+			UpstreamTimeout: 5 * time.Second,
+			IdleTimeout:     5 * time.Second,
+			MCP:             proxy.MCPConfig{IdempotentTools: []string{"search*"}},
+		})
+
+		_, status := callTool(t, client, upstream.URL, "1", "search_docs")
+		if status != "miss" {
+			t.Errorf("Expected first call to miss, got '%s'", status)
+		}
+
+		body, status := callTool(t, client, upstream.URL, `"second"`, "search_docs")
+		if status != "hit" {
+			t.Errorf("Expected second call to hit, got '%s'", status)
+		}
+		if calls.Load() != 1 {
+			t.Errorf("Expected 1 upstream call, got %d", calls.Load())
+		}
+		if !strings.Contains(body, `"id":"second"`) || !strings.Contains(body, "call 1") {
+			t.Errorf("Unexpected cached response '%s'", body)
+		}
+
+		// Tools not marked idempotent are always forwarded
+		callTool(t, client, upstream.URL, "3", "create_issue")
+		callTool(t, client, upstream.URL, "4", "create_issue")
+		if calls.Load() != 3 {
+			t.Errorf("Expected 3 upstream calls, got %d", calls.Load())
+		}
+	}
+}
+
+func TestMCPAnnotationPolicy(t *testing.T) {
+	distrust := false
+	cases := []struct {
+		name    string
+		trust   *bool
+		trusted bool
+	}{
+		{"Annotations trusted by default", nil, true},
+		{"Annotations ignored", &distrust, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls atomic.Int32
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var req struct {
+					ID     json.RawMessage `json:"id"`
+					Method string          `json:"method"`
+				}
+				json.NewDecoder(r.Body).Decode(&req)
+				w.Header().Set("Content-Type", "application/json")
+				if req.Method == "tools/list" {
+					w.Write([]byte(`{"jsonrpc":"2.0","id":` + string(req.ID) + `,"result":{"tools":[
+						{"name":"search_docs","annotations":{"readOnlyHint":true}},
+						{"name":"search_secrets","annotations":{"readOnlyHint":true}},
+						{"name":"create_issue","annotations":{"readOnlyHint":false,"destructiveHint":false}},
+						{"name":"fetch_page","annotations":{"readOnlyHint":true}}
+					]}}`))
+					return
+				}
+				n := calls.Add(1)
+				w.Write([]byte(`{"jsonrpc":"2.0","id":` + string(req.ID) + `,"result":{"content":[{"type":"text","text":"call ` + strconv.Itoa(int(n)) + `"}]}}`))
+			}))
+			defer upstream.Close()
+
+			client, _ := newCachingProxy(t, &proxy.ProxyConfig{
+				ListenAddr:      "127.0.0.1:0",
+				UpstreamTimeout: 5 * time.Second,
+				IdleTimeout:     5 * time.Second,
+				MCP: proxy.MCPConfig{
+					TrustAnnotations: tc.trust,
+					DenyTools:        []string{"*secrets*"},
+					Servers: []proxy.MCPServerPolicy{{
+						Server: "127.0.0.1:*/mcp",
+						TTL:    time.Nanosecond,
+						// A rule without a TTL keeps the server's
+						Tools: []proxy.MCPToolRule{{Name: "search_docs", TTL: time.Hour}, {Name: "fetch_page"}},
+					}},
+				},
+			})
+
+			// Before tools/list nothing is known about the tools
+			if _, status := callTool(t, client, upstream.URL, "1", "search_docs"); status == "hit" {
+				t.Errorf("Expected no caching before tools/list")
+			}
+
+			req, _ := http.NewRequest("POST", upstream.URL+"/mcp", strings.NewReader(`{"jsonrpc":"2.0","id":0,"method":"tools/list"}`))
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("tools/list failed: %v", err)
+			}
+			resp.Body.Close()
+
+			readOnly := func(status string) string {
+				if tc.trusted {
+					return status
+				}
+				return ""
+			}
+			tests := []struct {
+				tool     string
+				expected string
+			}{
+				{tool: "search_docs", expected: readOnly("hit")},
+				{tool: "search_secrets", expected: ""},
+				{tool: "create_issue", expected: ""},
+				{tool: "fetch_page", expected: readOnly("miss")},
+			}
+			for _, tt := range tests {
+				callTool(t, client, upstream.URL, "2", tt.tool)
+				if _, status := callTool(t, client, upstream.URL, "3", tt.tool); status != tt.expected {
+					t.Errorf("%s: expected second call status '%s', got '%s'", tt.tool, tt.expected, status)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package integration
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/braw-dev/memex/internal/proxy"
+	"github.com/braw-dev/memex/internal/store"
+)
+
+// TestMCPWrapHelperProcess is not a real test: it is the stdio MCP server spawned by
+// TestMCPWrap, answering every request with the number of requests seen so far.
+func TestMCPWrapHelperProcess(t *testing.T) {
+	if !slices.Contains(os.Args, "mcp-helper") {
+		return
+	}
+	r := bufio.NewReader(os.Stdin)
+	calls := 0
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			os.Exit(0)
+		}
+		var req struct {
+			ID json.RawMessage `json:"id"`
+		}
+		json.Unmarshal(line, &req)
+		calls++
+		fmt.Printf(`{"jsonrpc":"2.0","id":%s,"result":{"content":[{"type":"text","text":"call %d"}]}}`+"\n", req.ID, calls)
+	}
+}
+
+func TestMCPWrap(t *testing.T) {
+	st, err := store.NewStore(filepath.Join(t.TempDir(), "brain.duckdb"))
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+	defer st.Close()
+
+	config := &proxy.ProxyConfig{
+		MCP: proxy.MCPConfig{IdempotentTools: []string{"search"}},
+	}
+	command := []string{os.Args[0], "-test.run=TestMCPWrapHelperProcess", "--", "mcp-helper"}
+	wrapper := proxy.NewMCPWrapper(config, st, command)
+
+	clientIn, serverIn := io.Pipe()
+	serverOut, clientOut := io.Pipe()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- wrapper.Run(ctx, clientIn, clientOut)
+		clientOut.Close()
+	}()
+
+	responses := bufio.NewReader(serverOut)
+	call := func(id int, tool string) string {
+		fmt.Fprintf(serverIn, `{"jsonrpc":"2.0","id":%d,"method":"tools/call","params":{"name":"%s","arguments":{"q":"go"}}}`+"\n", id, tool)
+		line, err := responses.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		return line
+	}
+
+	if resp := call(1, "search"); !strings.Contains(resp, `"id":1`) || !strings.Contains(resp, "call 1") {
+		t.Errorf("Unexpected first response '%s'", resp)
+	}
+	if resp := call(2, "search"); !strings.Contains(resp, `"id":2`) || !strings.Contains(resp, "call 1") {
+		t.Errorf("Expected cached response for id 2, got '%s'", resp)
+	}
+	if resp := call(3, "create_issue"); !strings.Contains(resp, "call 2") {
+		t.Errorf("Expected non-idempotent tool to reach the server, got '%s'", resp)
+	}
+
+	serverIn.Close()
+	if err := <-done; err != nil {
+		t.Errorf("Run failed: %v", err)
+	}
+}
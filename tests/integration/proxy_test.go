@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -33,7 +34,7 @@ func TestHTTPPassthrough(t *testing.T) {
 
 	// 2. Setup Proxy
 	config := &proxy.ProxyConfig{
-		ListenAddr:      ":0", // Random port
+		ListenAddr:      "127.0.0.1:0", // Random port
 		UpstreamTimeout: 5 * time.Second,
 		IdleTimeout:     5 * time.Second,
 		FlushInterval:   0,
@@ -74,9 +75,43 @@ func TestHTTPPassthrough(t *testing.T) {
 	}
 }
 
+func TestLargeBodyPassthrough(t *testing.T) {
+	const size = 40 << 20
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, err := io.Copy(io.Discard, r.Body)
+		if err != nil || n != size {
+			t.Errorf("Expected %d body bytes upstream, got %d (%v)", size, n, err)
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	handler := proxy.NewServer(&proxy.ProxyConfig{
+		ListenAddr:      "127.0.0.1:0",
+		UpstreamTimeout: 5 * time.Second,
+		IdleTimeout:     5 * time.Second,
+	})
+	proxyServer := httptest.NewServer(handler)
+	defer proxyServer.Close()
+	proxyURL, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	// A body of unknown length over the inspection limit streams through untouched
+	body := io.LimitReader(strings.NewReader(strings.Repeat("x", size)), size)
+	req, _ := http.NewRequest("POST", upstream.URL+"/upload", io.NopCloser(body))
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", resp.StatusCode)
+	}
+}
+
 func TestHealthz(t *testing.T) {
 	config := &proxy.ProxyConfig{
-		ListenAddr: ":0",
+		ListenAddr: "127.0.0.1:0",
 		Log:        proxy.LogConfig{Level: "error"},
 	}
 	handler := proxy.NewServer(config)
@@ -110,7 +145,7 @@ func TestProxyHeaders(t *testing.T) {
 	defer upstream.Close()
 
 	config := &proxy.ProxyConfig{
-		ListenAddr: ":0",
+		ListenAddr: "127.0.0.1:0",
 		Log:        proxy.LogConfig{Level: "debug"},
 	}
 	handler := proxy.NewServer(config)
@@ -133,3 +168,75 @@ func TestProxyHeaders(t *testing.T) {
 	}
 	resp.Body.Close()
 }
+
+func TestUpstreamErrors(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		switch r.URL.Query().Get("fail") {
+		case "slow":
+			select {
+			case <-time.After(2 * time.Second):
+			case <-r.Context().Done():
+			}
+		case "stream":
+			// Start a stream and drop the connection halfway through
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("event: message_start\ndata: {\"type\":\"message_start\"}\n\nevent: content_block_delta\ndata: {\"type\":"))
+			http.NewResponseController(w).Flush()
+			conn, _, _ := http.NewResponseController(w).Hijack()
+			conn.Close()
+		}
+	}))
+	defer upstream.Close()
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	handler := proxy.NewServer(&proxy.ProxyConfig{
+		ListenAddr:      "127.0.0.1:0",
+		UpstreamTimeout: 100 * time.Millisecond,
+		IdleTimeout:     5 * time.Second,
+	})
+	proxyServer := httptest.NewServer(handler)
+	defer proxyServer.Close()
+	proxyURL, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	tests := []struct {
+		name     string
+		target   string
+		status   int
+		expected []string
+	}{
+		{"Unreachable Anthropic upstream", unreachable.URL + "/v1/messages", http.StatusBadGateway,
+			[]string{`"type":"error"`, `"type":"api_error"`, "memex could not reach the upstream"}},
+		{"Unreachable OpenAI upstream", unreachable.URL + "/v1/chat/completions", http.StatusBadGateway,
+			[]string{`"type":"server_error"`, `"param":null`}},
+		{"Timeout", upstream.URL + "/v1/messages?fail=slow", http.StatusGatewayTimeout,
+			[]string{`"type":"timeout_error"`, "did not respond within 100ms"}},
+		{"Stream broken mid-flight", upstream.URL + "/v1/messages?fail=stream", http.StatusOK,
+			[]string{"event: message_start", "\n\nevent: error\ndata: {\"error\":{\"message\":\"the upstream stream broke"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"model":"claude-sonnet","max_tokens":100,"messages":[{"role":"user","content":"hi"}]}`
+			req, _ := http.NewRequest("POST", tt.target, strings.NewReader(body))
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			defer resp.Body.Close()
+			data, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("Expected a complete response, got %v", err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Errorf("Expected status %d, got %d: %s", tt.status, resp.StatusCode, data)
+			}
+			for _, e := range tt.expected {
+				if !strings.Contains(string(data), e) {
+					t.Errorf("Expected response to contain %q, got %s", e, data)
+				}
+			}
+		})
+	}
+}
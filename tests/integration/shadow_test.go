@@ -0,0 +1,149 @@
+package integration
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/braw-dev/memex/internal/proxy"
+	"github.com/braw-dev/memex/internal/store"
+)
+
+func TestShadowMode(t *testing.T) {
+	var upstreamHits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHits.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(anthropicJSON))
+	}))
+	defer upstream.Close()
+
+	config := &proxy.ProxyConfig{
+		ListenAddr:      "127.0.0.1:0",
+		UpstreamTimeout: 5 * time.Second,
+		IdleTimeout:     5 * time.Second,
+		Cache:           proxy.CacheConfig{LLM: proxy.LLMCacheConfig{Enabled: true}, Semantic: proxy.SemanticConfig{Mode: "shadow", Threshold: 0.9}},
+	}
+	client, st := newCachingProxy(t, config)
+
+	prompts := []string{
+		"What is the capital of France",
+		// Differs from the first only in punctuation: a would-be hit
+		"What is the capital of France?",
+		"Write a haiku about garbage collection",
+	}
+	for i, prompt := range prompts {
+		body := `{"model":"claude-sonnet","max_tokens":100,"messages":[{"role":"user","content":"` + prompt + `"}]}`
+		req, _ := http.NewRequest("POST", upstream.URL+"/v1/messages", strings.NewReader(body))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("X-Memex-Cache"); got != "miss" {
+			t.Errorf("Shadow mode must not serve similar requests, got X-Memex-Cache '%s'", got)
+		}
+		if got := upstreamHits.Load(); got != int32(i+1) {
+			t.Errorf("Expected %d upstream requests, got %d", i+1, got)
+		}
+	}
+
+	var comparisons []store.ShadowComparison
+	for i := 0; i < 50 && len(comparisons) < len(prompts); i++ {
+		comparisons, _ = st.ShadowComparisons(time.Time{})
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(comparisons) != len(prompts) {
+		t.Fatalf("Expected %d shadow comparisons, got %d", len(prompts), len(comparisons))
+	}
+	if comparisons[0].CandidateKey != "" {
+		t.Errorf("Expected no candidate in an empty cache, got %+v", comparisons[0])
+	}
+	if c := comparisons[1]; c.CandidateKey == "" || c.PromptSimilarity < 0.99 || c.AnswerSimilarity != 1 {
+		t.Errorf("Expected a near-identical candidate with the same answer, got %+v", c)
+	}
+	if c := comparisons[2]; c.CandidateKey == "" || c.PromptSimilarity > 0.5 {
+		t.Errorf("Expected a dissimilar candidate, got %+v", c)
+	}
+
+	var report bytes.Buffer
+	if err := proxy.ShadowReport(config, st, time.Time{}, &report); err != nil {
+		t.Fatalf("ShadowReport failed: %v", err)
+	}
+	if !strings.Contains(report.String(), "Suggested threshold: 0.50 (33.3% of misses would hit, 0.0% drift)") {
+		t.Errorf("Unexpected report:\n%s", report.String())
+	}
+}
+
+func TestShadowModeFinalTurn(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(anthropicJSON))
+	}))
+	defer upstream.Close()
+
+	billing := `{"role":"user","content":"` + strings.Repeat("Here is the design document for the billing service. ", 40) + `"},` +
+		`{"role":"assistant","content":"Understood"},`
+	history := billing
+	send := func(client *http.Client, prompt string) {
+		body := `{"model":"claude-sonnet","max_tokens":100,"messages":[` + history + `{"role":"user","content":"` + prompt + `"}]}`
+		req, _ := http.NewRequest("POST", upstream.URL+"/v1/messages", strings.NewReader(body))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	client, st := newCachingProxy(t, &proxy.ProxyConfig{
+		ListenAddr:      "127.0.0.1:0",
+		UpstreamTimeout: 5 * time.Second,
+		IdleTimeout:     5 * time.Second,
+		Cache:           proxy.CacheConfig{LLM: proxy.LLMCacheConfig{Enabled: true}, Semantic: proxy.SemanticConfig{Mode: "shadow", Threshold: 0.9}},
+	})
+	// A long shared history must not make different questions look alike
+	send(client, "Summarise the retry policy")
+	send(client, "Write a haiku about garbage collection")
+
+	var comparisons []store.ShadowComparison
+	for i := 0; i < 50 && len(comparisons) < 2; i++ {
+		comparisons, _ = st.ShadowComparisons(time.Time{})
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(comparisons) != 2 {
+		t.Fatalf("Expected 2 shadow comparisons, got %d", len(comparisons))
+	}
+	if c := comparisons[1]; c.CandidateKey == "" || c.PromptSimilarity > 0.5 {
+		t.Errorf("Expected a dissimilar candidate, got %+v", c)
+	}
+
+	// The same question in another conversation is not answered from this one
+	history = `{"role":"user","content":"Here is the design document for the search service."},{"role":"assistant","content":"Understood"},`
+	send(client, "Summarise the retry policy")
+	history = billing
+	for i := 0; i < 50 && len(comparisons) < 3; i++ {
+		comparisons, _ = st.ShadowComparisons(time.Time{})
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(comparisons) != 3 || comparisons[2].CandidateKey != "" {
+		t.Errorf("Expected no candidate from another conversation, got %+v", comparisons)
+	}
+
+	// Without a feature looking them up, no vectors are stored
+	client, st = newCachingProxy(t, &proxy.ProxyConfig{
+		ListenAddr:      "127.0.0.1:0",
+		UpstreamTimeout: 5 * time.Second,
+		IdleTimeout:     5 * time.Second,
+		Cache:           proxy.CacheConfig{LLM: proxy.LLMCacheConfig{Enabled: true}},
+	})
+	send(client, "Summarise the retry policy")
+	var entries, vectors int
+	st.DB().QueryRow(`SELECT COUNT(*), COUNT(prompt_vector) FROM cache_entries`).Scan(&entries, &vectors)
+	if entries != 1 || vectors != 0 {
+		t.Errorf("Expected one cached entry without a prompt vector, got %d entries and %d vectors", entries, vectors)
+	}
+}
@@ -0,0 +1,130 @@
+package integration
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/braw-dev/memex/internal/proxy"
+)
+
+func TestStaleAnswers(t *testing.T) {
+	var down atomic.Bool
+	var upstreamHits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHits.Add(1)
+		if down.Load() {
+			http.Error(w, `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`, http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), `"stream":true`) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte(anthropicSSE))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(anthropicJSON))
+	}))
+	defer upstream.Close()
+
+	config := &proxy.ProxyConfig{
+		ListenAddr:      "127.0.0.1:0",
+		UpstreamTimeout: 5 * time.Second,
+		IdleTimeout:     5 * time.Second,
+		Cache: proxy.CacheConfig{
+			LLM:   proxy.LLMCacheConfig{Enabled: true},
+			Stale: proxy.StaleConfig{IfError: true, MinSimilarity: 0.8, Footer: true},
+		},
+	}
+	client, _ := newCachingProxy(t, config)
+
+	send := func(prompt string, stream bool) (*http.Response, string) {
+		// A prompt may carry earlier turns of its conversation
+		body := `{"model":"claude-sonnet","max_tokens":100,"messages":[{"role":"user","content":"` + prompt + `"}]`
+		if stream {
+			body += `,"stream":true`
+		}
+		req, _ := http.NewRequest("POST", upstream.URL+"/v1/messages", strings.NewReader(body+"}"))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp, string(data)
+	}
+
+	// Fill the cache while the upstream is up
+	send("What is the capital of France", false)
+	send("What is the capital of France", true)
+	send(`Explain the billing service"},{"role":"assistant","content":"It invoices customers"},{"role":"user","content":"continue`, false)
+	down.Store(true)
+
+	tests := []struct {
+		name    string
+		prompt  string
+		stream  bool
+		status  int
+		cache   string
+		stale   string
+		content []string
+	}{
+		{"Similar request served stale", "What is the capital of France?", false, http.StatusOK, "stale",
+			"upstream-error; similarity=1.00", []string{`"text":"Hello"`, "[memex] the upstream is unavailable"}},
+		{"Footer inserted into streams", "what is the capital of france", true, http.StatusOK, "stale",
+			"upstream-error; similarity=1.00", []string{"event: content_block_delta", "[memex] the upstream is unavailable"}},
+		{"Dissimilar request gets the upstream error", "Write a haiku about garbage collection", false,
+			http.StatusServiceUnavailable, "miss", "", []string{"overloaded_error"}},
+		{"Follow-up in another conversation gets the upstream error",
+			`Explain the search service"},{"role":"assistant","content":"It indexes documents"},{"role":"user","content":"continue`, false,
+			http.StatusServiceUnavailable, "miss", "", []string{"overloaded_error"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := send(tt.prompt, tt.stream)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("Expected status %d, got %d: %s", tt.status, resp.StatusCode, body)
+			}
+			if got := resp.Header.Get("X-Memex-Cache"); got != tt.cache {
+				t.Errorf("Expected X-Memex-Cache '%s', got '%s'", tt.cache, got)
+			}
+			if got := resp.Header.Get("X-Memex-Stale"); !strings.HasPrefix(got, tt.stale) {
+				t.Errorf("Expected X-Memex-Stale to start with '%s', got '%s'", tt.stale, got)
+			}
+			for _, c := range tt.content {
+				if !strings.Contains(body, c) {
+					t.Errorf("Expected body to contain %s, got %s", c, body)
+				}
+			}
+			if tt.stream && strings.Index(body, "[memex]") > strings.Index(body, "event: message_delta") {
+				t.Errorf("Expected the footer before message_delta, got %s", body)
+			}
+		})
+	}
+
+	t.Run("Offline mode never contacts the upstream", func(t *testing.T) {
+		config.Cache.Stale.Offline = true
+		defer func() { config.Cache.Stale.Offline = false }()
+		before := upstreamHits.Load()
+
+		resp, body := send("What is the capital of France, please", false)
+		if got := resp.Header.Get("X-Memex-Stale"); resp.StatusCode != http.StatusOK || !strings.HasPrefix(got, "offline;") {
+			t.Errorf("Expected an offline answer, got %d '%s': %s", resp.StatusCode, got, body)
+		}
+		if !strings.Contains(body, "[memex] memex is in offline mode") {
+			t.Errorf("Expected an offline footer, got %s", body)
+		}
+		resp, body = send("Write a haiku about garbage collection", false)
+		if resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(body, `"type":"api_error"`) {
+			t.Errorf("Expected an Anthropic error without a cached answer, got %d: %s", resp.StatusCode, body)
+		}
+		if got := upstreamHits.Load(); got != before {
+			t.Errorf("Expected no upstream requests offline, got %d", got-before)
+		}
+	})
+}
@@ -0,0 +1,150 @@
+package integration
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/braw-dev/memex/internal/proxy"
+	"github.com/braw-dev/memex/internal/store"
+)
+
+func TestHitVerification(t *testing.T) {
+	var upstreamHits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		// The answer changes after the first two requests
+		if upstreamHits.Add(1) <= 2 {
+			w.Write([]byte(anthropicJSON))
+			return
+		}
+		w.Write([]byte(strings.Replace(anthropicJSON, "Hello", "The build is broken on main since yesterday", 1)))
+	}))
+	defer upstream.Close()
+
+	client, st := newCachingProxy(t, &proxy.ProxyConfig{
+		ListenAddr:      "127.0.0.1:0",
+		UpstreamTimeout: 5 * time.Second,
+		IdleTimeout:     5 * time.Second,
+		Cache:           proxy.CacheConfig{LLM: proxy.LLMCacheConfig{Enabled: true}, Verify: proxy.VerifyConfig{SampleRate: 1, Threshold: 0.8}},
+	})
+
+	send := func() string {
+		body := `{"model":"claude-sonnet","max_tokens":100,"messages":[{"role":"user","content":"status?"}]}`
+		req, _ := http.NewRequest("POST", upstream.URL+"/v1/messages", strings.NewReader(body))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.Header.Get("X-Memex-Cache")
+	}
+	// waitForVerifications waits until n hits have been verified
+	waitForVerifications := func(n int64) *store.Stats {
+		stats := &store.Stats{}
+		for i := 0; i < 50 && stats.Verified < n; i++ {
+			time.Sleep(10 * time.Millisecond)
+			stats, _ = st.Stats(time.Time{})
+		}
+		if stats.Verified != n {
+			t.Fatalf("Expected %d verified hits, got %d", n, stats.Verified)
+		}
+		return stats
+	}
+
+	if got := send(); got != "miss" {
+		t.Fatalf("Expected first request to miss, got '%s'", got)
+	}
+	if got := send(); got != "hit" {
+		t.Fatalf("Expected second request to hit, got '%s'", got)
+	}
+	if stats := waitForVerifications(1); stats.Evicted != 0 || stats.MeanSimilarity != 1 {
+		t.Errorf("Expected a matching answer to be kept, got %+v", stats)
+	}
+
+	if got := send(); got != "hit" {
+		t.Fatalf("Expected third request to hit, got '%s'", got)
+	}
+	if stats := waitForVerifications(2); stats.Evicted != 1 {
+		t.Errorf("Expected the diverged answer to be evicted, got %+v", stats)
+	}
+	if got := send(); got != "miss" {
+		t.Errorf("Expected the evicted entry to miss, got '%s'", got)
+	}
+	if got := upstreamHits.Load(); got != 4 {
+		t.Errorf("Expected 4 upstream requests, got %d", got)
+	}
+}
+
+func TestHitVerificationNonDeterministic(t *testing.T) {
+	// Sampled with temperature > 0, the upstream says the same thing in other words each time
+	answers := []string{
+		"The build on main is failing because the linter step times out",
+		"Main is red: its lint job keeps hitting the timeout",
+	}
+	var upstreamHits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := upstreamHits.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet","content":[{"type":"text","text":"` +
+			answers[(n-1)%2] + `"}],"stop_reason":"end_turn","usage":{"input_tokens":10,"output_tokens":7}}`))
+	}))
+	defer upstream.Close()
+
+	client, st := newCachingProxy(t, &proxy.ProxyConfig{
+		ListenAddr:      "127.0.0.1:0",
+		UpstreamTimeout: 5 * time.Second,
+		IdleTimeout:     5 * time.Second,
+		Auth:            proxy.AuthConfig{Tokens: []proxy.AuthToken{{User: "ci", Token: "tok-123"}}},
+		Cache:           proxy.CacheConfig{LLM: proxy.LLMCacheConfig{Enabled: true}, Verify: proxy.VerifyConfig{SampleRate: 1, Threshold: 0.8}},
+	})
+
+	send := func() string {
+		body := `{"model":"claude-sonnet","max_tokens":100,"temperature":1,"messages":[{"role":"user","content":"status?"}]}`
+		req, _ := http.NewRequest("POST", upstream.URL+"/v1/messages", strings.NewReader(body))
+		req.Header.Set("Proxy-Authorization", "Bearer tok-123")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.Header.Get("X-Memex-Cache")
+	}
+
+	if got := send(); got != "miss" {
+		t.Fatalf("Expected first request to miss, got '%s'", got)
+	}
+	if got := send(); got != "hit" {
+		t.Fatalf("Expected second request to hit, got '%s'", got)
+	}
+	stats := &store.Stats{}
+	for i := 0; i < 50 && stats.Verified < 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+		stats, _ = st.Stats(time.Time{})
+	}
+	// Similarity is lexical, so the rephrased answer evicts a valid entry
+	if stats.Verified != 1 || stats.Evicted != 1 {
+		t.Errorf("Expected the rephrased answer to be evicted, got %+v", stats)
+	}
+
+	// The verification is billed to the user and scope that got the hit
+	var misses, tokens, scopes int
+	var user string
+	for i := 0; i < 50 && misses < 2; i++ {
+		st.DB().QueryRow(`SELECT COUNT(*), COALESCE(SUM(tokens_in + tokens_out), 0), COUNT(DISTINCT scope_id), COALESCE(MIN(user_id), '')
+			FROM audit_logs WHERE NOT cache_hit`).Scan(&misses, &tokens, &scopes, &user)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if misses != 2 || tokens != 34 || scopes != 1 || user != "ci" {
+		t.Errorf("Expected the miss and the verification audited for ci in one scope with 34 tokens, got %d rows with %d tokens in %d scopes for '%s'",
+			misses, tokens, scopes, user)
+	}
+	var prefixed int
+	st.DB().QueryRow(`SELECT COUNT(*) FROM audit_logs WHERE NOT cache_hit AND message_count > 0`).Scan(&prefixed)
+	if prefixed != 1 {
+		t.Errorf("Expected only the original miss to track conversation prefixes, got %d", prefixed)
+	}
+}
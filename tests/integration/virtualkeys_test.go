@@ -0,0 +1,107 @@
+package integration
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/braw-dev/memex/internal/proxy"
+)
+
+func TestVirtualKeys(t *testing.T) {
+	var mu sync.Mutex
+	var seenKeys []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seenKeys = append(seenKeys, r.Header.Get("x-api-key")+r.Header.Get("Authorization"))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(anthropicJSON))
+	}))
+	defer upstream.Close()
+
+	config := &proxy.ProxyConfig{
+		ListenAddr:      "127.0.0.1:0",
+		UpstreamTimeout: 5 * time.Second,
+		IdleTimeout:     5 * time.Second,
+		VirtualKeys: proxy.VirtualKeysConfig{
+			Enabled:    true,
+			AdminToken: "admin-token",
+			Upstream:   []proxy.UpstreamKey{{Host: "127.0.0.1", APIKey: "sk-company"}},
+		},
+	}
+	client, st := newCachingProxy(t, config)
+	admin := proxy.NewServer(config, proxy.WithStore(st))
+
+	// adminCall calls the key management API directly, not as a forward proxy
+	adminCall := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, req)
+		return rec
+	}
+	send := func(key string, prompt string) int {
+		body := `{"model":"claude","max_tokens":100,"messages":[{"role":"user","content":"` + prompt + `"}]}`
+		req, _ := http.NewRequest("POST", upstream.URL+"/v1/messages", strings.NewReader(body))
+		req.Header.Set("x-api-key", key)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		io.ReadAll(resp.Body)
+		return resp.StatusCode
+	}
+
+	if rec := adminCall("POST", "/_memex/keys", "wrong", `{"user":"alice"}`); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected admin API to reject a wrong token, got %d", rec.Code)
+	}
+	rec := adminCall("POST", "/_memex/keys", "admin-token", `{"user":"alice","name":"laptop"}`)
+	var created struct {
+		ID   string `json:"id"`
+		Key  string `json:"key"`
+		User string `json:"user"`
+	}
+	if rec.Code != http.StatusCreated || json.Unmarshal(rec.Body.Bytes(), &created) != nil || !strings.HasPrefix(created.Key, "mx-") {
+		t.Fatalf("Failed to create key: %d %s", rec.Code, rec.Body)
+	}
+	if rec := adminCall("GET", "/_memex/keys", "admin-token", ""); strings.Contains(rec.Body.String(), created.Key) ||
+		!strings.Contains(rec.Body.String(), created.ID) {
+		t.Errorf("Expected the key list to show the ID but not the key: %s", rec.Body)
+	}
+
+	if code := send(created.Key, "hello"); code != http.StatusOK {
+		t.Fatalf("Expected virtual key to be accepted, got %d", code)
+	}
+	mu.Lock()
+	if len(seenKeys) != 1 || seenKeys[0] != "sk-company" {
+		t.Errorf("Expected upstream to receive the company key, got %v", seenKeys)
+	}
+	mu.Unlock()
+
+	var user string
+	for i := 0; i < 50 && user == ""; i++ {
+		st.DB().Get(&user, `SELECT COALESCE(MAX(user_id), '') FROM audit_logs`)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if user != "alice" {
+		t.Errorf("Expected usage attributed to alice, got '%s'", user)
+	}
+
+	if code := send("mx-unknown", "hello"); code != http.StatusUnauthorized {
+		t.Errorf("Expected unknown virtual key to be rejected, got %d", code)
+	}
+	if rec := adminCall("DELETE", "/_memex/keys/"+created.ID, "admin-token", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("Failed to revoke key: %d", rec.Code)
+	}
+	// Revoked keys are rejected before the cache, so cached answers are not served either
+	if code := send(created.Key, "hello"); code != http.StatusUnauthorized {
+		t.Errorf("Expected revoked key to be rejected, got %d", code)
+	}
+}
@@ -0,0 +1,131 @@
+package unit
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/braw-dev/memex/internal/proxy"
+	"github.com/braw-dev/memex/internal/store"
+	"github.com/braw-dev/memex/pkg/types"
+)
+
+func newTestStore(t *testing.T) *store.Store {
+	t.Helper()
+	s, err := store.NewStore(filepath.Join(t.TempDir(), "brain.duckdb"))
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestLookupCache_ParentFallback(t *testing.T) {
+	s := newTestStore(t)
+
+	parent := &types.ScopeContext{ID: "repo", Salt: []byte("repo")}
+	child := &types.ScopeContext{ID: "repo#services/billing", Type: types.ScopeTypeSubdir, Salt: []byte("billing"), Parent: parent}
+	sibling := &types.ScopeContext{ID: "repo#services/web", Type: types.ScopeTypeSubdir, Salt: []byte("web")}
+	fingerprint := []byte("how does auth work?")
+
+	if _, err := proxy.LookupCache(s, child, fingerprint); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("Expected miss, got %v", err)
+	}
+
+	err := s.SetCache(&store.CacheEntry{
+		HashKey:      proxy.CacheKey(parent, fingerprint),
+		ScopeID:      parent.ID,
+		ResponseBlob: []byte("shared docs"),
+	})
+	if err != nil {
+		t.Fatalf("SetCache failed: %v", err)
+	}
+
+	entry, err := proxy.LookupCache(s, child, fingerprint)
+	if err != nil {
+		t.Fatalf("Expected hit via parent, got %v", err)
+	}
+	if string(entry.ResponseBlob) != "shared docs" {
+		t.Errorf("Unexpected response blob '%s'", entry.ResponseBlob)
+	}
+
+	if _, err := proxy.LookupCache(s, sibling, fingerprint); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected sibling scope without parent to miss, got %v", err)
+	}
+}
+
+func TestCacheEncryption(t *testing.T) {
+	s := newTestStore(t)
+	s.UseCipher(store.NewCipher("master secret"))
+
+	scope := &types.ScopeContext{ID: "repo", Salt: []byte("repo")}
+	other := &types.ScopeContext{ID: "other", Salt: []byte("other")}
+	fingerprint := []byte("how does auth work?")
+	key := proxy.CacheKey(scope, fingerprint)
+
+	err := s.SetCache(&store.CacheEntry{HashKey: key, ScopeID: scope.ID, ResponseBlob: []byte("use OAuth"), Salt: scope.Salt})
+	if err != nil {
+		t.Fatalf("SetCache failed: %v", err)
+	}
+
+	var raw []byte
+	if err := s.DB().Get(&raw, `SELECT response_blob FROM cache_entries WHERE hash_key = ?`, key); err != nil {
+		t.Fatalf("Failed to read raw blob: %v", err)
+	}
+	if !store.IsSealed(raw) || strings.Contains(string(raw), "OAuth") {
+		t.Errorf("Expected an encrypted blob, got %q", raw)
+	}
+
+	entry, err := proxy.LookupCache(s, scope, fingerprint)
+	if err != nil || string(entry.ResponseBlob) != "use OAuth" {
+		t.Fatalf("Expected decrypted hit, got %v %v", entry, err)
+	}
+	if _, err := s.GetCache(key, other.Salt); err == nil {
+		t.Error("Expected another scope's salt to fail to decrypt")
+	}
+
+	s.UseCipher(nil)
+	if _, err := s.GetCache(key, scope.Salt); !errors.Is(err, store.ErrEncrypted) {
+		t.Errorf("Expected ErrEncrypted without a key, got %v", err)
+	}
+}
+
+func TestReencrypt(t *testing.T) {
+	s := newTestStore(t)
+	scope := &types.ScopeContext{ID: "repo", Salt: proxy.ScopeSalt("repo")}
+	fingerprint := []byte("how does auth work?")
+
+	// Written before encryption was enabled
+	err := s.SetCache(&store.CacheEntry{HashKey: proxy.CacheKey(scope, fingerprint), ScopeID: scope.ID, ResponseBlob: []byte("use OAuth")})
+	if err != nil {
+		t.Fatalf("SetCache failed: %v", err)
+	}
+
+	steps := []struct {
+		name     string
+		from, to *store.Cipher
+	}{
+		{"Encrypt plaintext", nil, store.NewCipher("key 1")},
+		{"Rotate", store.NewCipher("key 1"), store.NewCipher("key 2")},
+		{"Decrypt", store.NewCipher("key 2"), nil},
+	}
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			n, err := s.Reencrypt(step.from, step.to, proxy.ScopeSalt)
+			if err != nil || n != 1 {
+				t.Fatalf("Reencrypt failed: %d %v", n, err)
+			}
+			s.UseCipher(step.to)
+			entry, err := proxy.LookupCache(s, scope, fingerprint)
+			if err != nil || string(entry.ResponseBlob) != "use OAuth" {
+				t.Errorf("Expected readable entry after re-encryption, got %v %v", entry, err)
+			}
+		})
+	}
+
+	if _, err := s.Reencrypt(store.NewCipher("wrong"), nil, proxy.ScopeSalt); err != nil {
+		t.Errorf("Plaintext blobs should re-encrypt with any key, got %v", err)
+	}
+}
@@ -1,8 +1,11 @@
 package unit
 
 import (
+	"io"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/braw-dev/memex/internal/proxy"
@@ -37,6 +40,46 @@ func TestSchemaDetector(t *testing.T) {
 			path:     "/openai/v1/chat/completions",
 			expected: types.SchemaOpenAI,
 		},
+		{
+			name:     "OpenAI Responses",
+			path:     "/v1/responses",
+			expected: types.SchemaOpenAIResponses,
+		},
+		{
+			name:     "Gemini generateContent",
+			path:     "/v1beta/models/gemini-2.0-flash:generateContent",
+			expected: types.SchemaGemini,
+		},
+		{
+			name:     "Gemini streamGenerateContent",
+			path:     "/v1beta/models/gemini-2.0-flash:streamGenerateContent",
+			expected: types.SchemaGemini,
+		},
+		{
+			name:     "Ollama chat",
+			path:     "/api/chat",
+			expected: types.SchemaOllama,
+		},
+		{
+			name:     "Ollama generate",
+			path:     "/api/generate",
+			expected: types.SchemaOllama,
+		},
+		{
+			name:     "Embeddings",
+			path:     "/v1/embeddings",
+			expected: types.SchemaEmbeddings,
+		},
+		{
+			name:     "Anthropic count tokens",
+			path:     "/v1/messages/count_tokens",
+			expected: types.SchemaAnthropicCountTokens,
+		},
+		{
+			name:     "Anthropic message batch results",
+			path:     "/v1/messages/batches/msgbatch_01/results",
+			expected: types.SchemaAnthropicBatches,
+		},
 		{
 			name:     "Unknown Path",
 			path:     "/v1/other",
@@ -60,3 +103,72 @@ func TestSchemaDetector(t *testing.T) {
 		})
 	}
 }
+
+func TestSchemaDetector_MCP(t *testing.T) {
+	detector := proxy.NewSchemaDetector()
+
+	tests := []struct {
+		name     string
+		method   string
+		body     string
+		expected types.SchemaType
+	}{
+		{
+			name:     "Tool call",
+			method:   "POST",
+			body:     `{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"search","arguments":{"q":"go"}}}`,
+			expected: types.SchemaMCP,
+		},
+		{
+			name:     "Resource read",
+			method:   "POST",
+			body:     `{"jsonrpc":"2.0","id":"a","method":"resources/read","params":{"uri":"file:///README.md"}}`,
+			expected: types.SchemaMCP,
+		},
+		{
+			name:     "Plain JSON",
+			method:   "POST",
+			body:     `{"model":"x"}`,
+			expected: types.SchemaUnknown,
+		},
+		{
+			name:     "GET request",
+			method:   "GET",
+			expected: types.SchemaUnknown,
+		},
+		{
+			// Large uploads are not buffered to be sniffed
+			name:     "Oversized body",
+			method:   "POST",
+			body:     `{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"upload","arguments":{"data":"` + strings.Repeat("x", 2<<20) + `"}}}`,
+			expected: types.SchemaUnknown,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "http://example.com/mcp", strings.NewReader(tt.body))
+			// Streamed uploads do not announce their length
+			req.ContentLength = -1
+			if got := detector.Detect(req); got != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+			// The body must still be readable after detection
+			body, _ := io.ReadAll(req.Body)
+			if string(body) != tt.body {
+				t.Errorf("expected body to be preserved, got '%s'", body)
+			}
+		})
+	}
+}
+
+func TestSchemaDetector_Models(t *testing.T) {
+	detector := proxy.NewSchemaDetector()
+
+	if got := detector.Detect(httptest.NewRequest("GET", "http://example.com/v1/models", nil)); got != types.SchemaModels {
+		t.Errorf("expected %v, got %v", types.SchemaModels, got)
+	}
+	if got := detector.Detect(httptest.NewRequest("POST", "http://example.com/v1/models", nil)); got != types.SchemaUnknown {
+		t.Errorf("expected %v, got %v", types.SchemaUnknown, got)
+	}
+}
@@ -1,7 +1,9 @@
 package unit
 
 import (
+	"bytes"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/braw-dev/memex/internal/proxy"
@@ -74,3 +76,158 @@ func TestDetectScope_NoGit(t *testing.T) {
 		t.Error("Expected ID to be non-empty")
 	}
 }
+
+func TestDetectScope_NoRemoteSubdir(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "memex-scope-test-noremote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if _, err := git.PlainInit(tmpDir, false); err != nil {
+		t.Fatal(err)
+	}
+	sub := filepath.Join(tmpDir, "services", "billing")
+	if err := os.MkdirAll(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a remote or a matching rule, the scope is the hash of the directory itself
+	scope, err := proxy.DetectScope(sub)
+	if err != nil {
+		t.Fatalf("DetectScope failed: %v", err)
+	}
+	root, err := proxy.DetectScope(tmpDir)
+	if err != nil {
+		t.Fatalf("DetectScope failed: %v", err)
+	}
+	if scope.Type != types.ScopeTypePathHash || scope.ID == root.ID {
+		t.Errorf("Expected a path hash scope of the sub-directory, got %v", scope)
+	}
+
+	// Sub-scope rules resolve against the repository root
+	scope, err = proxy.DetectScopeWithRules(sub, []proxy.SubScopeRule{{Pattern: "services/*", Parent: "."}})
+	if err != nil {
+		t.Fatalf("DetectScopeWithRules failed: %v", err)
+	}
+	if scope.Type != types.ScopeTypeSubdir || scope.ID != root.ID+"#services/billing" {
+		t.Errorf("Unexpected sub-scope %v", scope)
+	}
+	if scope.Parent == nil || scope.Parent.ID != root.ID {
+		t.Errorf("Expected repository root scope as parent, got %v", scope.Parent)
+	}
+}
+
+func TestDetectScope_SubScope(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "memex-scope-test-subscope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	r, err := git.PlainInit(tmpDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.CreateRemote(&config.RemoteConfig{
+		Name: "origin",
+		URLs: []string{"https://github.com/example/monorepo.git"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	billing := filepath.Join(tmpDir, "services", "billing", "internal")
+	web := filepath.Join(tmpDir, "web")
+	for _, dir := range []string{billing, web} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rules := []proxy.SubScopeRule{{Pattern: "services/*", Parent: "."}}
+
+	scope, err := proxy.DetectScopeWithRules(billing, rules)
+	if err != nil {
+		t.Fatalf("DetectScopeWithRules failed: %v", err)
+	}
+	if scope.Type != types.ScopeTypeSubdir {
+		t.Errorf("Expected ScopeTypeSubdir, got %v", scope.Type)
+	}
+	if scope.ID != "https://github.com/example/monorepo.git#services/billing" {
+		t.Errorf("Unexpected sub-scope ID '%s'", scope.ID)
+	}
+	if scope.Parent == nil || scope.Parent.ID != "https://github.com/example/monorepo.git" {
+		t.Errorf("Expected repository scope as parent, got %v", scope.Parent)
+	}
+	if len(scope.Chain()) != 2 {
+		t.Errorf("Expected chain of 2 scopes, got %d", len(scope.Chain()))
+	}
+
+	// Directories outside the rules keep the scope they had without rules: the path hash
+	// of a sub-directory, the remote at the repository root
+	scope, err = proxy.DetectScopeWithRules(web, rules)
+	if err != nil {
+		t.Fatalf("DetectScopeWithRules failed: %v", err)
+	}
+	plain, err := proxy.DetectScope(web)
+	if err != nil {
+		t.Fatalf("DetectScope failed: %v", err)
+	}
+	if scope.Type != types.ScopeTypePathHash || scope.ID != plain.ID {
+		t.Errorf("Expected the path hash scope of the directory, got %v", scope)
+	}
+	scope, err = proxy.DetectScopeWithRules(tmpDir, rules)
+	if err != nil {
+		t.Fatalf("DetectScopeWithRules failed: %v", err)
+	}
+	if scope.Type != types.ScopeTypeGitRemote {
+		t.Errorf("Expected ScopeTypeGitRemote at the repository root, got %v", scope.Type)
+	}
+
+	// Without a parent the sub-scope is isolated
+	scope, err = proxy.DetectScopeWithRules(billing, []proxy.SubScopeRule{{Pattern: "services/*"}})
+	if err != nil {
+		t.Fatalf("DetectScopeWithRules failed: %v", err)
+	}
+	if scope.Parent != nil {
+		t.Errorf("Expected no parent scope, got %v", scope.Parent)
+	}
+}
+
+func TestScopeSalt(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "memex-scope-test-salt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	r, err := git.PlainInit(tmpDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := filepath.Join(tmpDir, "services", "billing")
+	if err := os.MkdirAll(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	rules := []proxy.SubScopeRule{{Pattern: "services/*", Parent: "."}}
+
+	// The salt of every detected scope can be recomputed from its stored ID
+	detect := func(dir string) *types.ScopeContext {
+		scope, err := proxy.DetectScopeWithRules(dir, rules)
+		if err != nil {
+			t.Fatalf("DetectScopeWithRules failed: %v", err)
+		}
+		return scope
+	}
+	scopes := []*types.ScopeContext{detect(tmpDir), detect(sub)}
+	if _, err := r.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{"https://github.com/example/repo.git"}}); err != nil {
+		t.Fatal(err)
+	}
+	scopes = append(scopes, detect(tmpDir), detect(sub), proxy.GlobalScope)
+	for _, scope := range scopes {
+		if !bytes.Equal(proxy.ScopeSalt(scope.ID), scope.Salt) {
+			t.Errorf("Salt of %s scope %q does not match ScopeSalt", scope.Type, scope.ID)
+		}
+	}
+}
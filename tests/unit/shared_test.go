@@ -0,0 +1,89 @@
+package unit
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/braw-dev/memex/internal/proxy"
+	"github.com/braw-dev/memex/pkg/types"
+)
+
+func TestIsShared(t *testing.T) {
+	rules := []proxy.SharedRule{
+		{Host: "*.context7.com"},
+		{Path: "/docs/*"},
+		{MCPTool: "get-library-docs"},
+	}
+
+	tests := []struct {
+		name     string
+		url      string
+		body     string
+		schema   types.SchemaType
+		expected bool
+	}{
+		{
+			name:     "Host match",
+			url:      "http://mcp.context7.com:443/mcp",
+			expected: true,
+		},
+		{
+			name:     "Path match",
+			url:      "http://example.com/docs/react",
+			expected: true,
+		},
+		{
+			name:     "MCP tool match",
+			url:      "http://example.com/mcp",
+			body:     `{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"get-library-docs","arguments":{}}}`,
+			schema:   types.SchemaMCP,
+			expected: true,
+		},
+		{
+			name:     "Other MCP tool",
+			url:      "http://example.com/mcp",
+			body:     `{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"create_issue"}}`,
+			schema:   types.SchemaMCP,
+			expected: false,
+		},
+		{
+			name:     "Tool rules only apply to MCP requests",
+			url:      "http://example.com/upload",
+			body:     `{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"get-library-docs"}}`,
+			expected: false,
+		},
+		{
+			name:     "LLM completion never shared",
+			url:      "http://api.context7.com/v1/messages",
+			schema:   types.SchemaAnthropic,
+			expected: false,
+		},
+		{
+			name:     "Gemini completion never shared",
+			url:      "http://api.context7.com/v1beta/models/gemini-2.0-flash:generateContent",
+			schema:   types.SchemaGemini,
+			expected: false,
+		},
+		{
+			name:     "Ollama completion never shared",
+			url:      "http://example.com/docs/api/chat",
+			schema:   types.SchemaOllama,
+			expected: false,
+		},
+		{
+			name:     "No match",
+			url:      "http://example.com/other",
+			expected: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", tt.url, strings.NewReader(tt.body))
+			if got := proxy.IsShared(req, tt.schema, rules); got != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}